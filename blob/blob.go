@@ -0,0 +1,47 @@
+// Package blob implements storage for message attachments
+// Backends implement Store, the backend is selected by the blob settings
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/naman1402/distributed-chat-app/settings"
+)
+
+// ErrNotFound is returned when the key does not exist in the store
+var ErrNotFound = errors.New("blob not found")
+
+// Store abstracts the object storage used for attachments
+// Put: stores size bytes from r under key
+// Get: opens the object stored under key
+// Delete: removes the object, deleting a missing key is not an error
+// URL: returns a direct, time-limited download URL, or "" if the backend cannot serve one
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	URL(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// Default is the store used by the attachment controllers
+var Default Store
+
+// Setup initializes Default from the blob settings
+// local: files under cfg.Dir
+// s3: cfg.S3Bucket on cfg.S3Endpoint
+// Panics if the store cannot be initialized
+func Setup(cfg settings.Blob) {
+	var err error
+	switch cfg.Store {
+	case "s3":
+		Default, err = NewS3Store(cfg.S3Endpoint, cfg.S3Bucket, cfg.S3AccessKey, cfg.S3SecretKey, cfg.S3UseSSL)
+	default:
+		Default, err = NewLocalStore(cfg.Dir)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
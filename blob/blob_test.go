@@ -0,0 +1,199 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// S3 tests run against the S3-compatible server in S3_TEST_ENDPOINT (e.g. a local MinIO
+// started with `minio server /tmp/data`), credentials default to MinIO's minioadmin
+func s3TestStore(t *testing.T) *S3Store {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT not set")
+	}
+	accessKey, secretKey := os.Getenv("S3_TEST_ACCESS_KEY"), os.Getenv("S3_TEST_SECRET_KEY")
+	if accessKey == "" {
+		accessKey, secretKey = "minioadmin", "minioadmin"
+	}
+	bucket := fmt.Sprintf("blob-test-%d", time.Now().UnixNano())
+	s, err := NewS3Store(endpoint, bucket, accessKey, secretKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func localTestStore(t *testing.T) *LocalStore {
+	s, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestLocalStore(t *testing.T) {
+	testStore(t, localTestStore(t))
+}
+
+func TestS3Store(t *testing.T) {
+	testStore(t, s3TestStore(t))
+}
+
+func testStore(t *testing.T, s Store) {
+	t.Run("put and get", func(t *testing.T) {
+		testPutGet(t, s)
+	})
+	t.Run("missing key", func(t *testing.T) {
+		testMissing(t, s)
+	})
+	t.Run("chunked upload", func(t *testing.T) {
+		testChunkedUpload(t, s)
+	})
+}
+
+func testPutGet(t *testing.T, s Store) {
+	ctx := context.Background()
+	if err := s.Put(ctx, "attachments/a", strings.NewReader("hello"), 5, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(t, s, "attachments/a"); got != "hello" {
+		t.Fatalf("got %q, want hello", got)
+	}
+	// a second put replaces the object
+	if err := s.Put(ctx, "attachments/a", strings.NewReader("bye"), 3, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(t, s, "attachments/a"); got != "bye" {
+		t.Fatalf("got %q, want bye", got)
+	}
+}
+
+func testMissing(t *testing.T, s Store) {
+	ctx := context.Background()
+	if _, err := s.Get(ctx, "attachments/missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+	if err := s.Delete(ctx, "attachments/missing"); err != nil {
+		t.Fatalf("deleting a missing key: %v", err)
+	}
+}
+
+// testChunkedUpload stores an upload the way the attachment controller does: one blob per
+// chunk under uploads/{id}/{offset}, a retried chunk overwriting the first attempt, then
+// the chunks are concatenated into the final blob and deleted
+func testChunkedUpload(t *testing.T, s Store) {
+	ctx := context.Background()
+	chunks := [][]byte{
+		bytes.Repeat([]byte("a"), 1000),
+		bytes.Repeat([]byte("b"), 1000),
+		[]byte("tail"),
+	}
+	keys := []string{}
+	offset := 0
+	for i, chunk := range chunks {
+		key := fmt.Sprintf("uploads/u1/%020d", offset)
+		if i == 1 {
+			// interrupted attempt, resumed from the same offset
+			if err := s.Put(ctx, key, bytes.NewReader(chunk[:10]), 10, "application/octet-stream"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Put(ctx, key, bytes.NewReader(chunk), int64(len(chunk)), "application/octet-stream"); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		offset += len(chunk)
+	}
+
+	readers := []io.Reader{}
+	for _, key := range keys {
+		r, err := s.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		readers = append(readers, r)
+	}
+	if err := s.Put(ctx, "attachments/u1", io.MultiReader(readers...), int64(offset), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if err := s.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := string(bytes.Join(chunks, nil))
+	if got := read(t, s, "attachments/u1"); got != want {
+		t.Fatalf("assembled blob has %d bytes, want %d", len(got), len(want))
+	}
+	for _, key := range keys {
+		if _, err := s.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("chunk %s not deleted: %v", key, err)
+		}
+	}
+	assertURL(t, s, "attachments/u1", want)
+}
+
+// assertURL checks the direct download url serves the blob, if the store has one
+func assertURL(t *testing.T, s Store, key, want string) {
+	url, err := s.URL(context.Background(), key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url == "" {
+		return
+	}
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(data) != want {
+		t.Fatalf("presigned url: status %d, %d bytes", res.StatusCode, len(data))
+	}
+}
+
+func read(t *testing.T, s Store, key string) string {
+	r, err := s.Get(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestLocalStoreSizeMismatch(t *testing.T) {
+	s := localTestStore(t)
+	ctx := context.Background()
+	if err := s.Put(ctx, "uploads/u1/0", strings.NewReader("short"), 10, ""); err == nil {
+		t.Fatal("put with a wrong size succeeded")
+	}
+	// the partial file is not left behind
+	if _, err := s.Get(ctx, "uploads/u1/0"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+}
+
+func TestLocalStoreRejectsEscapingKeys(t *testing.T) {
+	s := localTestStore(t)
+	for _, key := range []string{"../outside", "uploads/../../outside"} {
+		if err := s.Put(context.Background(), key, strings.NewReader("x"), 1, ""); err == nil {
+			t.Fatalf("key %q was accepted", key)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Package broker abstracts how chat servers hand messages to each other
+// Every server subscribes to its own channel (named after its SERVERID) and publishes
+// to the channel of the server a recipient is connected to.
+// Room messages go through Rooms instead: published once per room, received by every
+// server subscribed to the room
+package broker
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrClosed is returned by brokers used after Close
+var ErrClosed = errors.New("broker closed")
+
+// Broker delivers payloads to servers
+// Publish: sends data to the channel of serverId
+// Subscribe: returns the payloads published to serverId, the channel is closed
+// when ctx is done, the broker is closed or the subscription fails for good
+// Ping: checks the broker's connection, subscriptions receive nothing while it fails
+// Close: releases the broker's connections
+type Broker interface {
+	Publish(ctx context.Context, serverId string, data []byte) error
+	Subscribe(ctx context.Context, serverId string) (<-chan Delivery, error)
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// Delivery is a payload received by a Broker subscription
+// Ack must be called once the payload is handled (written to its receivers, or dropped
+// because they are offline); brokers that redeliver payloads not acknowledged (streams)
+// rely on it, the others ignore it
+type Delivery struct {
+	Data []byte
+	ack  func()
+}
+
+// Ack confirms the payload was handled
+func (d Delivery) Ack() {
+	if d.ack != nil {
+		d.ack()
+	}
+}
+
+// Rooms fans payloads out to every server subscribed to a room
+// unlike Broker every subscriber receives each payload, and payloads for a room no server
+// is subscribed to are dropped (offline members catch up from the conversation log)
+// Join and Leave change the subscribed rooms, Messages carries the payloads of all of them
+// Ping checks the connection the rooms are received on
+type Rooms interface {
+	Publish(ctx context.Context, room string, data []byte) error
+	Join(ctx context.Context, rooms ...string) error
+	Leave(ctx context.Context, rooms ...string) error
+	Messages() <-chan []byte
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// roomBuffer is the number of room payloads queued before the subscription blocks
+const roomBuffer = 256
+
+// roomChannel names the channel of a room, distinct from server channels
+func roomChannel(room string) string {
+	return "room:" + room
+}
+
+func roomChannels(rooms []string) []string {
+	channels := make([]string, len(rooms))
+	for i, room := range rooms {
+		channels[i] = roomChannel(room)
+	}
+	return channels
+}
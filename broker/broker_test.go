@@ -0,0 +1,298 @@
+package broker
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	natstest "github.com/nats-io/nats-server/v2/test"
+)
+
+// brokers lists the brokers under test, each with its room fan-out
+// NATS runs against an embedded server
+var brokers = []struct {
+	name  string
+	setup func(t *testing.T) (Broker, Rooms)
+}{
+	{"memory", func(t *testing.T) (Broker, Rooms) {
+		return NewMemory(), NewMemoryRooms()
+	}},
+	{"nats", func(t *testing.T) (Broker, Rooms) {
+		opts := natstest.DefaultTestOptions
+		opts.Port = -1
+		server := natstest.RunServer(&opts)
+		t.Cleanup(server.Shutdown)
+		nb, err := NewNATS(server.ClientURL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nb, nb.Rooms()
+	}},
+}
+
+// next waits for the next payload of a room subscription
+func next(t *testing.T, messages <-chan []byte) string {
+	t.Helper()
+	select {
+	case data := <-messages:
+		return string(data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no room message")
+	}
+	return ""
+}
+
+// none checks no other room payload arrives
+func none(t *testing.T, messages <-chan []byte) {
+	t.Helper()
+	select {
+	case data := <-messages:
+		t.Fatalf("unexpected room message %q", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	for _, tt := range brokers {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := tt.setup(t)
+			defer b.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			out, err := b.Subscribe(ctx, "s1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the payload for another server is not received, the next one is
+			if err := b.Publish(ctx, "s2", []byte("for s2")); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Publish(ctx, "s1", []byte("for s1")); err != nil {
+				t.Fatal(err)
+			}
+			d := receive(t, out)
+			if string(d.Data) != "for s1" {
+				t.Fatalf("got %q, want %q", d.Data, "for s1")
+			}
+			d.Ack()
+
+			cancel()
+			select {
+			case _, ok := <-out:
+				if ok {
+					t.Fatal("payload received after cancel")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("subscription not closed when ctx is done")
+			}
+		})
+	}
+}
+
+func TestBrokerClose(t *testing.T) {
+	for _, tt := range brokers {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := tt.setup(t)
+			out, err := b.Subscribe(context.Background(), "s1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Close(); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-out:
+			case <-time.After(5 * time.Second):
+				t.Fatal("subscription not closed by Close")
+			}
+			if err := b.Publish(context.Background(), "s1", []byte("late")); err == nil {
+				t.Fatal("publish after Close succeeded")
+			}
+			if _, err := b.Subscribe(context.Background(), "s1"); err == nil {
+				t.Fatal("subscribe after Close succeeded")
+			}
+		})
+	}
+}
+
+func TestRooms(t *testing.T) {
+	for _, tt := range brokers {
+		t.Run(tt.name, func(t *testing.T) {
+			b, rooms := tt.setup(t)
+			defer b.Close()
+			ctx := context.Background()
+			publish := func(room, data string) {
+				t.Helper()
+				if err := rooms.Publish(ctx, room, []byte(data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := rooms.Join(ctx, "r1", "r2"); err != nil {
+				t.Fatal(err)
+			}
+			// joining twice does not deliver twice
+			if err := rooms.Join(ctx, "r1"); err != nil {
+				t.Fatal(err)
+			}
+			publish("r3", "not joined")
+			publish("r1", "r1 first")
+			publish("r2", "r2 first")
+			// payloads of different rooms are not ordered
+			got := []string{next(t, rooms.Messages()), next(t, rooms.Messages())}
+			sort.Strings(got)
+			if got[0] != "r1 first" || got[1] != "r2 first" {
+				t.Fatalf("got %v, want [r1 first r2 first]", got)
+			}
+			none(t, rooms.Messages())
+
+			if err := rooms.Leave(ctx, "r1"); err != nil {
+				t.Fatal(err)
+			}
+			publish("r1", "left")
+			publish("r2", "r2 second")
+			if got := next(t, rooms.Messages()); got != "r2 second" {
+				t.Fatalf("got %q after leaving r1, want %q", got, "r2 second")
+			}
+			none(t, rooms.Messages())
+
+			// Close leaves every room, the subscription can be used again afterwards
+			if err := rooms.Close(); err != nil {
+				t.Fatal(err)
+			}
+			publish("r2", "closed")
+			if err := rooms.Join(ctx, "r3"); err != nil {
+				t.Fatal(err)
+			}
+			publish("r3", "r3 after close")
+			if got := next(t, rooms.Messages()); got != "r3 after close" {
+				t.Fatalf("got %q after Close, want %q", got, "r3 after close")
+			}
+			none(t, rooms.Messages())
+		})
+	}
+}
+
+// every server subscribed to a room receives its payloads
+func TestNATSRoomsFanOut(t *testing.T) {
+	opts := natstest.DefaultTestOptions
+	opts.Port = -1
+	server := natstest.RunServer(&opts)
+	defer server.Shutdown()
+	ctx := context.Background()
+	servers := []*NATSRooms{}
+	for i := 0; i < 3; i++ {
+		nb, err := NewNATS(server.ClientURL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer nb.Close()
+		rooms := nb.Rooms()
+		if i < 2 {
+			if err := rooms.Join(ctx, "r1"); err != nil {
+				t.Fatal(err)
+			}
+			// the subscription must reach the server before another connection publishes
+			if err := nb.conn.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		servers = append(servers, rooms)
+	}
+	if err := servers[2].Publish(ctx, "r1", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for _, rooms := range servers[:2] {
+		if got := next(t, rooms.Messages()); got != "hello" {
+			t.Fatalf("got %q, want hello", got)
+		}
+	}
+	none(t, servers[2].Messages())
+}
+
+func TestPing(t *testing.T) {
+	for _, tt := range brokers {
+		t.Run(tt.name, func(t *testing.T) {
+			b, rooms := tt.setup(t)
+			ctx := context.Background()
+			if err := b.Ping(ctx); err != nil {
+				t.Fatalf("broker ping: %v", err)
+			}
+			if err := rooms.Join(ctx, "r1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := rooms.Ping(ctx); err != nil {
+				t.Fatalf("rooms ping: %v", err)
+			}
+			if err := b.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Ping(ctx); err == nil {
+				t.Fatal("broker ping after Close succeeded")
+			}
+		})
+	}
+}
+
+// the NATS pings fail while the connection is lost, the client reconnects on its own
+func TestNATSPingDisconnected(t *testing.T) {
+	opts := natstest.DefaultTestOptions
+	opts.Port = -1
+	server := natstest.RunServer(&opts)
+	nb, err := NewNATS(server.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nb.Close()
+	server.Shutdown()
+	deadline := time.Now().Add(5 * time.Second)
+	for nb.Ping(context.Background()) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("ping succeeds without a server")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := nb.Rooms().Ping(context.Background()); err == nil {
+		t.Fatal("rooms ping succeeds without a server")
+	}
+}
+
+func TestMemoryFullSubscriber(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the subscriber never reads
+	if _, err := m.Subscribe(ctx, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < memoryBuffer+10; i++ {
+			if err := m.Publish(ctx, "s1", []byte("payload")); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish blocked on a full subscriber")
+	}
+	if dropped := m.Dropped(); dropped != 10 {
+		t.Fatalf("dropped %d payloads, want 10", dropped)
+	}
+	// the lock is free: other servers still subscribe and receive
+	out, err := m.Subscribe(ctx, "s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Publish(ctx, "s2", []byte("for s2")); err != nil {
+		t.Fatal(err)
+	}
+	if d := receive(t, out); string(d.Data) != "for s2" {
+		t.Fatalf("got %q", d.Data)
+	}
+}
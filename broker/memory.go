@@ -0,0 +1,164 @@
+package broker
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// memoryBuffer is the number of payloads queued per subscriber before Publish drops them
+const memoryBuffer = 256
+
+// Memory is an in-process broker for single-node mode and tests
+// payloads published to a server with no subscriber are dropped, like Redis pub/sub, and so
+// are payloads for a subscriber whose buffer is full: Publish never waits on a slow
+// subscriber while holding the lock Subscribe, unsubscribe and Close need
+type Memory struct {
+	mu          sync.Mutex
+	subscribers map[string][]chan Delivery
+	closed      bool
+	dropped     atomic.Int64
+}
+
+// NewMemory returns an empty in-process broker
+func NewMemory() *Memory {
+	return &Memory{subscribers: make(map[string][]chan Delivery)}
+}
+
+func (m *Memory) Publish(ctx context.Context, serverId string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	for _, ch := range m.subscribers[serverId] {
+		select {
+		case ch <- Delivery{Data: data}:
+		default:
+			m.dropped.Add(1)
+			log.Println("memory broker: subscriber of", serverId, "is full, payload dropped")
+		}
+	}
+	return nil
+}
+
+// Dropped returns the number of payloads dropped because a subscriber was full
+func (m *Memory) Dropped() int64 {
+	return m.dropped.Load()
+}
+
+func (m *Memory) Subscribe(ctx context.Context, serverId string) (<-chan Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	ch := make(chan Delivery, memoryBuffer)
+	m.subscribers[serverId] = append(m.subscribers[serverId], ch)
+	go func() {
+		<-ctx.Done()
+		m.unsubscribe(serverId, ch)
+	}()
+	return ch, nil
+}
+
+// unsubscribe removes and closes the channel if it is still registered
+func (m *Memory) unsubscribe(serverId string, ch chan Delivery) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	subscribers := m.subscribers[serverId]
+	for i, sub := range subscribers {
+		if sub == ch {
+			m.subscribers[serverId] = append(subscribers[:i], subscribers[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+func (m *Memory) Ping(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	for _, subscribers := range m.subscribers {
+		for _, ch := range subscribers {
+			close(ch)
+		}
+	}
+	m.subscribers = nil
+	return nil
+}
+
+// MemoryRooms is the in-process room fan-out for single-node mode and tests
+type MemoryRooms struct {
+	mu     sync.Mutex
+	joined map[string]bool
+	out    chan []byte
+}
+
+// NewMemoryRooms returns a room subscription without rooms
+func NewMemoryRooms() *MemoryRooms {
+	return &MemoryRooms{joined: make(map[string]bool), out: make(chan []byte, roomBuffer)}
+}
+
+func (m *MemoryRooms) Publish(ctx context.Context, room string, data []byte) error {
+	m.mu.Lock()
+	joined := m.joined[room]
+	m.mu.Unlock()
+	if !joined {
+		return nil
+	}
+	select {
+	case m.out <- data:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *MemoryRooms) Join(ctx context.Context, rooms ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, room := range rooms {
+		m.joined[room] = true
+	}
+	return nil
+}
+
+func (m *MemoryRooms) Leave(ctx context.Context, rooms ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, room := range rooms {
+		delete(m.joined, room)
+	}
+	return nil
+}
+
+func (m *MemoryRooms) Messages() <-chan []byte {
+	return m.out
+}
+
+// Ping always succeeds, there is no connection to lose
+func (m *MemoryRooms) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryRooms) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.joined = make(map[string]bool)
+	return nil
+}
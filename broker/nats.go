@@ -0,0 +1,162 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsBuffer is the number of messages NATS queues for a slow subscriber
+const natsBuffer = 1024
+
+// NATS publishes to subject "chat.{serverId}"
+// like Redis pub/sub, messages for a server that is not subscribed are lost
+type NATS struct {
+	conn *nats.Conn
+	// closed is closed with the connection, it ends the subscriptions
+	closed chan struct{}
+}
+
+// NewNATS connects to url (e.g. nats://nats:4222), reconnecting forever if the server goes away
+func NewNATS(url string) (*NATS, error) {
+	closed := make(chan struct{})
+	conn, err := nats.Connect(url, nats.MaxReconnects(-1), nats.ClosedHandler(func(*nats.Conn) {
+		close(closed)
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return &NATS{conn: conn, closed: closed}, nil
+}
+
+func subject(serverId string) string {
+	return "chat." + serverId
+}
+
+func (n *NATS) Publish(ctx context.Context, serverId string, data []byte) error {
+	return n.conn.Publish(subject(serverId), data)
+}
+
+func (n *NATS) Subscribe(ctx context.Context, serverId string) (<-chan Delivery, error) {
+	msgs := make(chan *nats.Msg, natsBuffer)
+	sub, err := n.conn.ChanSubscribe(subject(serverId), msgs)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan Delivery)
+	go func() {
+		defer close(out)
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case msg := <-msgs:
+				select {
+				case out <- Delivery{Data: msg.Data}:
+				case <-ctx.Done():
+					return
+				case <-n.closed:
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-n.closed:
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Ping reports an error while the connection is not established (reconnecting, closed)
+func (n *NATS) Ping(ctx context.Context) error {
+	return connected(n.conn)
+}
+
+func connected(conn *nats.Conn) error {
+	if status := conn.Status(); status != nats.CONNECTED {
+		return fmt.Errorf("nats connection %s", status)
+	}
+	return nil
+}
+
+// Close drains pending messages and closes the connection, the subscriptions end once
+// it is closed
+func (n *NATS) Close() error {
+	return n.conn.Drain()
+}
+
+// NATSRooms subscribes to subject "chat.room.{room}" for every joined room,
+// on the connection of the NATS broker it was created from
+type NATSRooms struct {
+	conn *nats.Conn
+	mu   sync.Mutex
+	subs map[string]*nats.Subscription
+	out  chan []byte
+}
+
+// Rooms returns a room subscription sharing the broker's connection
+func (n *NATS) Rooms() *NATSRooms {
+	return &NATSRooms{conn: n.conn, subs: make(map[string]*nats.Subscription), out: make(chan []byte, roomBuffer)}
+}
+
+func roomSubject(room string) string {
+	return "chat." + roomChannel(room)
+}
+
+func (n *NATSRooms) Publish(ctx context.Context, room string, data []byte) error {
+	return n.conn.Publish(roomSubject(room), data)
+}
+
+func (n *NATSRooms) Join(ctx context.Context, rooms ...string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, room := range rooms {
+		if n.subs[room] != nil {
+			continue
+		}
+		sub, err := n.conn.Subscribe(roomSubject(room), func(msg *nats.Msg) {
+			n.out <- msg.Data
+		})
+		if err != nil {
+			return err
+		}
+		n.subs[room] = sub
+	}
+	return nil
+}
+
+func (n *NATSRooms) Leave(ctx context.Context, rooms ...string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, room := range rooms {
+		if sub := n.subs[room]; sub != nil {
+			delete(n.subs, room)
+			if err := sub.Unsubscribe(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (n *NATSRooms) Messages() <-chan []byte {
+	return n.out
+}
+
+// Ping checks the broker's connection, the room subscriptions are restored on reconnect
+func (n *NATSRooms) Ping(ctx context.Context) error {
+	return connected(n.conn)
+}
+
+// Close unsubscribes from every room, the connection belongs to the broker
+func (n *NATSRooms) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for room, sub := range n.subs {
+		sub.Unsubscribe()
+		delete(n.subs, room)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"context"
+	"log"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisPubSub uses a Redis pub/sub channel per server
+// payloads published while a server is not subscribed are lost, see RedisStreams
+type RedisPubSub struct {
+	Client redis.UniversalClient
+}
+
+func (r *RedisPubSub) Publish(ctx context.Context, serverId string, data []byte) error {
+	return r.Client.Publish(ctx, serverId, data).Err()
+}
+
+// Subscribe forwards the channel's messages until ctx is done or a receive fails
+func (r *RedisPubSub) Subscribe(ctx context.Context, serverId string) (<-chan Delivery, error) {
+	subscriber := r.Client.Subscribe(ctx, serverId)
+	// wait for the subscription to be confirmed so errors are reported here
+	if _, err := subscriber.Receive(ctx); err != nil {
+		subscriber.Close()
+		return nil, err
+	}
+	out := make(chan Delivery)
+	go func() {
+		defer close(out)
+		defer subscriber.Close()
+		for {
+			msg, err := subscriber.ReceiveMessage(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Println("pub/sub receive error: ", err)
+				}
+				return
+			}
+			select {
+			case out <- Delivery{Data: []byte(msg.Payload)}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (r *RedisPubSub) Ping(ctx context.Context) error {
+	return r.Client.Ping(ctx).Err()
+}
+
+// Close is a no-op, the Redis client is shared with the rest of the server
+func (r *RedisPubSub) Close() error {
+	return nil
+}
+
+// RedisRooms uses a Redis pub/sub channel per room ("room:{room}"), all of them received
+// on a single connection; the subscriptions are restored when the connection is re-established
+type RedisRooms struct {
+	client redis.UniversalClient
+	pubsub *redis.PubSub
+	out    chan []byte
+}
+
+// NewRedisRooms starts an empty room subscription on client
+func NewRedisRooms(client redis.UniversalClient) *RedisRooms {
+	r := &RedisRooms{client: client, pubsub: client.Subscribe(context.Background()), out: make(chan []byte, roomBuffer)}
+	go func() {
+		defer close(r.out)
+		for msg := range r.pubsub.Channel(redis.WithChannelSize(roomBuffer)) {
+			r.out <- []byte(msg.Payload)
+		}
+	}()
+	return r
+}
+
+func (r *RedisRooms) Publish(ctx context.Context, room string, data []byte) error {
+	return r.client.Publish(ctx, roomChannel(room), data).Err()
+}
+
+func (r *RedisRooms) Join(ctx context.Context, rooms ...string) error {
+	return r.pubsub.Subscribe(ctx, roomChannels(rooms)...)
+}
+
+func (r *RedisRooms) Leave(ctx context.Context, rooms ...string) error {
+	return r.pubsub.Unsubscribe(ctx, roomChannels(rooms)...)
+}
+
+func (r *RedisRooms) Messages() <-chan []byte {
+	return r.out
+}
+
+// Ping pings on the subscription's own connection, not on the shared client
+func (r *RedisRooms) Ping(ctx context.Context) error {
+	return r.pubsub.Ping(ctx)
+}
+
+// Close ends the subscription, Messages is closed once the pending payloads are read
+func (r *RedisRooms) Close() error {
+	return r.pubsub.Close()
+}
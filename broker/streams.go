@@ -0,0 +1,219 @@
+package broker
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/ksuid"
+)
+
+// Redis Streams settings
+const (
+	// streamGroup is the consumer group every server reads its own stream with
+	streamGroup = "chat"
+	// streamBlock bounds how long XREADGROUP waits for new entries
+	streamBlock = 5 * time.Second
+	// streamBatch is the number of entries read at once
+	streamBatch = 100
+	// reclaimIdle is how long an entry of another consumer stays pending before it is claimed
+	reclaimIdle = time.Minute
+	// reclaimEvery is how often pending entries are checked
+	reclaimEvery = 30 * time.Second
+)
+
+// RedisStreams uses a Redis Stream per server ("stream:{serverId}") read through a consumer group
+// entries published while a server is down are delivered when it comes back
+// MaxLen trims each stream to about that many entries on every add
+type RedisStreams struct {
+	Client redis.UniversalClient
+	MaxLen int64
+
+	// consumer names this process in the group, see Subscribe
+	once     sync.Once
+	consumer string
+}
+
+func streamKey(serverId string) string {
+	return "stream:" + serverId
+}
+
+func (r *RedisStreams) Publish(ctx context.Context, serverId string, data []byte) error {
+	return r.Client.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamKey(serverId),
+		MaxLen: r.MaxLen,
+		Approx: true,
+		Values: map[string]interface{}{"payload": data},
+	}).Err()
+}
+
+// Subscribe consumes the server's stream, the consumer is named after the server and
+// this process ("{serverId}-{ksuid}"), so a restarted server is a new consumer
+// Implementation:
+// 1. Creates the consumer group (from the start of the stream, so entries published
+// before the first start are not lost)
+// 2. Takes over the entries previous runs of this server left pending, see reclaim
+// 3. Reads new entries with XREADGROUP
+// 4. Periodically takes over entries other consumers left pending for reclaimIdle
+// Entries are acknowledged by Delivery.Ack, an entry handed over but never acknowledged
+// (the server crashed before delivering it) stays pending and is taken over by the next run
+// Errors are logged and retried until ctx is done
+func (r *RedisStreams) Subscribe(ctx context.Context, serverId string) (<-chan Delivery, error) {
+	stream := streamKey(serverId)
+	err := r.Client.XGroupCreateMkStream(ctx, stream, streamGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, err
+	}
+	r.once.Do(func() {
+		r.consumer = serverId + "-" + ksuid.New().String()
+	})
+	out := make(chan Delivery)
+	go func() {
+		defer close(out)
+		// a server id is served by one process at a time, what other consumers hold is left over
+		r.reclaim(ctx, stream, 0, out)
+		lastReclaim := time.Now()
+		for ctx.Err() == nil {
+			if time.Since(lastReclaim) > reclaimEvery {
+				r.reclaim(ctx, stream, reclaimIdle, out)
+				lastReclaim = time.Now()
+			}
+			if err := r.read(ctx, stream, out); err != nil && err != redis.Nil && ctx.Err() == nil {
+				log.Println("stream read error: ", err)
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+	return out, nil
+}
+
+// read hands the new entries of the group to the subscriber
+func (r *RedisStreams) read(ctx context.Context, stream string, out chan<- Delivery) error {
+	res, err := r.Client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    streamGroup,
+		Consumer: r.consumer,
+		Streams:  []string{stream, ">"},
+		Count:    streamBatch,
+		Block:    streamBlock,
+	}).Result()
+	if err != nil {
+		return err
+	}
+	for _, s := range res {
+		if !r.forward(ctx, stream, s.Messages, out) {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// reclaim takes over the entries other consumers of the group left pending for minIdle
+// and removes the consumers that have nothing pending and were idle for reclaimIdle
+func (r *RedisStreams) reclaim(ctx context.Context, stream string, minIdle time.Duration, out chan<- Delivery) {
+	consumers, err := r.Client.XInfoConsumers(ctx, stream, streamGroup).Result()
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Println("stream reclaim error: ", err)
+		}
+		return
+	}
+	for _, c := range consumers {
+		if c.Name == r.consumer {
+			continue
+		}
+		if c.Pending == 0 {
+			if c.Idle >= reclaimIdle {
+				r.Client.XGroupDelConsumer(ctx, stream, streamGroup, c.Name)
+			}
+			continue
+		}
+		if !r.claim(ctx, stream, c.Name, minIdle, out) {
+			return
+		}
+	}
+}
+
+// claim moves the entries pending for minIdle from consumer to this one with XCLAIM and
+// hands them to the subscriber, returns false if ctx is done before they were handed over
+func (r *RedisStreams) claim(ctx context.Context, stream, consumer string, minIdle time.Duration, out chan<- Delivery) bool {
+	for {
+		pending, err := r.Client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream:   stream,
+			Group:    streamGroup,
+			Idle:     minIdle,
+			Start:    "-",
+			End:      "+",
+			Count:    streamBatch,
+			Consumer: consumer,
+		}).Result()
+		if err != nil || len(pending) == 0 {
+			if err != nil && ctx.Err() == nil {
+				log.Println("stream reclaim error: ", err)
+			}
+			return ctx.Err() == nil
+		}
+		ids := make([]string, len(pending))
+		for i, p := range pending {
+			ids[i] = p.ID
+		}
+		entries, err := r.Client.XClaim(ctx, &redis.XClaimArgs{
+			Stream:   stream,
+			Group:    streamGroup,
+			Consumer: r.consumer,
+			MinIdle:  minIdle,
+			Messages: ids,
+		}).Result()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("stream reclaim error: ", err)
+			}
+			return ctx.Err() == nil
+		}
+		if !r.forward(ctx, stream, entries, out) {
+			return false
+		}
+		if len(entries) == 0 || len(pending) < streamBatch {
+			return true
+		}
+	}
+}
+
+// forward hands entries to the subscriber, each is acknowledged by its Delivery.Ack
+// entries trimmed before being read have no payload and are acknowledged right away
+// returns false if ctx is done before every entry was handed over
+func (r *RedisStreams) forward(ctx context.Context, stream string, entries []redis.XMessage, out chan<- Delivery) bool {
+	for _, entry := range entries {
+		id := entry.ID
+		payload, ok := entry.Values["payload"].(string)
+		if !ok {
+			r.ack(stream, id)
+			continue
+		}
+		select {
+		case out <- Delivery{Data: []byte(payload), ack: func() { r.ack(stream, id) }}:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// ack removes the entry from the pending entries of the group
+// it does not use the subscription's context, payloads are still acknowledged while draining
+func (r *RedisStreams) ack(stream, id string) {
+	if err := r.Client.XAck(context.Background(), stream, streamGroup, id).Err(); err != nil {
+		log.Println("stream ack error: ", err)
+	}
+}
+
+func (r *RedisStreams) Ping(ctx context.Context) error {
+	return r.Client.Ping(ctx).Err()
+}
+
+// Close is a no-op, the Redis client is shared with the rest of the server
+func (r *RedisStreams) Close() error {
+	return nil
+}
@@ -0,0 +1,149 @@
+package broker
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func streamsTestClient(t *testing.T) redis.UniversalClient {
+	m := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// receive waits for the next delivery of a subscription
+func receive(t *testing.T, out <-chan Delivery) Delivery {
+	t.Helper()
+	select {
+	case d, ok := <-out:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery")
+	}
+	return Delivery{}
+}
+
+func pendingCount(t *testing.T, client redis.UniversalClient, serverId string) int64 {
+	t.Helper()
+	res, err := client.XPending(context.Background(), streamKey(serverId), streamGroup).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Count
+}
+
+func TestStreamsAckAfterDelivery(t *testing.T) {
+	client := streamsTestClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &RedisStreams{Client: client}
+	out, err := r.Subscribe(ctx, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Publish(ctx, "s1", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	d := receive(t, out)
+	if string(d.Data) != "hello" {
+		t.Fatalf("got %q, want hello", d.Data)
+	}
+	// handed over but not delivered yet: still pending
+	if n := pendingCount(t, client, "s1"); n != 1 {
+		t.Fatalf("%d pending before ack, want 1", n)
+	}
+	d.Ack()
+	if n := pendingCount(t, client, "s1"); n != 0 {
+		t.Fatalf("%d pending after ack, want 0", n)
+	}
+}
+
+// a server crashing with entries handed over but not acknowledged gets them again
+// when it restarts, as a new consumer of the group
+func TestStreamsRestartedConsumer(t *testing.T) {
+	client := streamsTestClient(t)
+	first := &RedisStreams{Client: client}
+	for _, payload := range []string{"a", "b", "c"} {
+		if err := first.Publish(context.Background(), "s1", []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, crash := context.WithCancel(context.Background())
+	out, err := first.Subscribe(ctx, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(t, out).Ack()
+	if d := receive(t, out); string(d.Data) != "b" {
+		t.Fatalf("got %q, want b", d.Data)
+	}
+	crash()
+	for range out {
+	}
+
+	restarted := &RedisStreams{Client: client}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out, err = restarted.Subscribe(ctx, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for i := 0; i < 2; i++ {
+		d := receive(t, out)
+		got = append(got, string(d.Data))
+		d.Ack()
+	}
+	sort.Strings(got)
+	if got[0] != "b" || got[1] != "c" {
+		t.Fatalf("got %v after restart, want [b c]", got)
+	}
+	if n := pendingCount(t, client, "s1"); n != 0 {
+		t.Fatalf("%d pending, want 0", n)
+	}
+
+	// new entries still reach the restarted server
+	if err := restarted.Publish(ctx, "s1", []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	if d := receive(t, out); string(d.Data) != "d" {
+		t.Fatalf("got %q, want d", d.Data)
+	}
+}
+
+// the room subscription pings on its own connection, with or without rooms joined
+func TestRedisRoomsPing(t *testing.T) {
+	m := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: m.Addr(), MaxRetries: -1})
+	defer client.Close()
+	rooms := NewRedisRooms(client)
+	defer rooms.Close()
+	ctx := context.Background()
+	if err := rooms.Ping(ctx); err != nil {
+		t.Fatalf("ping without rooms: %v", err)
+	}
+	if err := rooms.Join(ctx, "r1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rooms.Ping(ctx); err != nil {
+		t.Fatalf("ping with rooms: %v", err)
+	}
+	m.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for rooms.Ping(ctx) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("ping succeeds without redis")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/naman1402/distributed-chat-app/broker"
+	"github.com/naman1402/distributed-chat-app/controller"
+	"github.com/naman1402/distributed-chat-app/metrics"
+	"github.com/naman1402/distributed-chat-app/settings"
+)
+
+// Broker carries messages between servers, see SetupBroker
+var Broker broker.Broker
+
+// Rooms carries room messages to the servers with members of the room online, see SetupBroker
+var Rooms broker.Rooms
+
+// BrokerKind is the broker selected by SetupBroker: redis, streams, nats or memory
+var BrokerKind string
+
+// SetupBroker creates the broker selected by cfg.Kind and its room fan-out
+// - "redis": Redis pub/sub, one channel per server and per room
+// - "streams": Redis Streams with consumer groups, trimmed to cfg.StreamMaxLen entries,
+// rooms use Redis pub/sub (a server that is down has no member to deliver to)
+// - "nats": NATS at cfg.NatsURL
+// - "memory": in-process, for single-node mode (with the memory storage backend the
+// state is in process too and the server runs without Redis, see SetupState)
+// Every server must use the same broker, the Redis brokers need NPool to run first
+// Returns the error if the broker cannot be created (NATS unreachable), otherwise starts
+// the monitor of the broker and room subscription for the readiness check
+func SetupBroker(cfg settings.Broker) error {
+	BrokerKind = cfg.Kind
+	switch cfg.Kind {
+	case "streams":
+		Broker = &broker.RedisStreams{Client: Conn, MaxLen: cfg.StreamMaxLen}
+		Rooms = broker.NewRedisRooms(Conn)
+	case "nats":
+		nb, err := broker.NewNATS(cfg.NatsURL)
+		if err != nil {
+			return fmt.Errorf("nats %s: %w", cfg.NatsURL, err)
+		}
+		Broker = nb
+		Rooms = nb.Rooms()
+	case "memory":
+		Broker = broker.NewMemory()
+		Rooms = broker.NewMemoryRooms()
+	default:
+		BrokerKind = "redis"
+		Broker = &broker.RedisPubSub{Client: Conn}
+		Rooms = broker.NewRedisRooms(Conn)
+	}
+	controller.MemberJoined = announceJoin
+	go monitorBroker()
+	return nil
+}
+
+// publish sends data to the server through the broker, msgType labels the published count
+func publish(serverId, msgType string, data []byte) {
+	if err := Broker.Publish(ctx, serverId, data); err != nil {
+		fmt.Println(err)
+		return
+	}
+	metrics.MessagesPublished.WithLabelValues(msgType).Inc()
+}
+
+// PubSub implements the subscriber side of the broker
+// Implementation:
+// 1. Subscribes to the server-specific channel
+// 2. Continuously listens for incoming messages
+// 3. Forwards received messages to broadcast channel
+// 4. Resubscribes with exponential backoff when subscribing fails or the subscription ends,
+// the server is degraded in the meantime
+// Note: SERVERID is used as the subscription channel
+func PubSub() {
+	fmt.Println(SERVERID)
+	attempt := 0
+	for {
+		msgs, err := Broker.Subscribe(ctx, SERVERID)
+		if err != nil {
+			subscriptionUp.set(err)
+			log.Println("subscribe failed: ", err)
+			time.Sleep(backoff(attempt))
+			attempt++
+			continue
+		}
+		subscriptionUp.set(nil)
+		attempt = 0
+		for msg := range msgs {
+			enqueue(msg)
+		}
+		subscriptionUp.set(errors.New("subscription ended"))
+		log.Println("subscription to " + SERVERID + " ended, resubscribing")
+		time.Sleep(backoff(attempt))
+		attempt++
+	}
+}
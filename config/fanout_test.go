@@ -0,0 +1,91 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/naman1402/distributed-chat-app/metrics"
+	"github.com/naman1402/distributed-chat-app/repository"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPrivateFanOut(t *testing.T) {
+	testServer(t, []string{"alice", "bob"}, nil)
+	alice, bob := connect(t, "alice"), connect(t, "bob")
+
+	send(t, alice, Message{Message: "hi", Receiver: "bob", ClientId: "c1"})
+	ack := receive(t, alice, AckEvent)
+	got := receive(t, bob, "")
+	if got.Id != ack.Id || got.Message != "hi" || got.Sender != "alice" || got.Seq != 1 {
+		t.Fatalf("bob received %+v, ack %+v", got, ack)
+	}
+	if unread := receive(t, bob, UnreadEvent); unread.Conversation != "dm:alice" || unread.Unread != 1 {
+		t.Fatalf("unread event %+v", unread)
+	}
+	send(t, bob, Message{Message: "hello", Receiver: "alice"})
+	if got := receive(t, alice, ""); got.Message != "hello" || got.Seq != 2 {
+		t.Fatalf("alice received %+v", got)
+	}
+	// the sender gets the ack only, not its own message
+	silent(t, alice, UnreadEvent)
+}
+
+func TestGroupFanOut(t *testing.T) {
+	testServer(t, []string{"alice", "bob", "carol", "dave"}, map[string][]string{
+		"room1": {"alice", "bob", "carol"},
+		"room2": {"dave"},
+	})
+	alice, bob, dave := connect(t, "alice"), connect(t, "bob"), connect(t, "dave")
+
+	// published once on the room, delivered to every member connected here, sender included;
+	// carol is offline and not counted among the local members
+	send(t, alice, Message{Message: "hi all", Group: true, GroupName: "room1"})
+	gotAlice, gotBob := receive(t, alice, ""), receive(t, bob, "")
+	for _, got := range []Message{gotAlice, gotBob} {
+		if got.Message != "hi all" || got.GroupName != "room1" || got.Sender != "alice" || got.Seq != 1 {
+			t.Fatalf("received %+v", got)
+		}
+	}
+	if unread := receive(t, bob, UnreadEvent); unread.Conversation != "group:room1" || unread.Unread != 1 {
+		t.Fatalf("unread event of bob %+v", unread)
+	}
+	if logged, _ := repository.Default.Log("group:room1", 0, 10); len(logged) != 1 {
+		t.Fatalf("logged %d messages, want 1", len(logged))
+	}
+	// dave is connected but not a member
+	silent(t, dave)
+}
+
+func TestOfflineDrops(t *testing.T) {
+	mr := testServer(t, []string{"alice", "bob", "carol"}, nil)
+	alice := connect(t, "alice")
+	dropped := func() float64 {
+		return testutil.ToFloat64(metrics.MessagesDroppedOffline.WithLabelValues("private"))
+	}
+
+	tests := []struct {
+		name     string
+		receiver string
+		setup    func()
+	}{
+		// no route: nothing is published
+		{"receiver without route", "bob", func() {}},
+		// a route left behind on this server without session: dropped by Send
+		{"route without session", "carol", func() { mr.Set("route:carol", "S1") }},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			before := dropped()
+			send(t, alice, Message{Message: "hi", Receiver: tt.receiver, ClientId: "c" + string(rune('1'+i))})
+			ack := receive(t, alice, AckEvent)
+			waitFor(t, "the drop", func() bool { return dropped() == before+1 })
+			// the message is stored, and counted unread, for when the receiver connects
+			if m, err := repository.Default.GetMessage(ack.Id); err != nil || m.Id != ack.Id {
+				t.Fatalf("message %s not stored", ack.Id)
+			}
+			if unread, _ := unreadCounts(tt.receiver, "dm:alice"); unread != 1 {
+				t.Fatalf("unread %d, want 1", unread)
+			}
+		})
+	}
+}
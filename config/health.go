@@ -0,0 +1,218 @@
+package config
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/naman1402/distributed-chat-app/controller"
+)
+
+// reconnect timings
+const (
+	// backoffBase is the first retry delay, doubled on every failed attempt
+	backoffBase = 200 * time.Millisecond
+	// backoffMax caps the retry delay
+	backoffMax = 30 * time.Second
+	// stateCheckEvery is how often a healthy state store is pinged
+	stateCheckEvery = 5 * time.Second
+	// storageCheckEvery is how often a healthy storage backend is pinged
+	storageCheckEvery = 5 * time.Second
+	// brokerCheckEvery is how often a healthy broker and room subscription are pinged
+	brokerCheckEvery = 5 * time.Second
+)
+
+// dependency is the last known state of something the server needs to be ready
+// it embeds the up flag, err and since describe the last failure and change
+type dependency struct {
+	atomic.Bool
+	mu    sync.Mutex
+	err   string
+	since time.Time
+}
+
+// set records the result of a check, it reports whether the dependency went up or down
+func (d *dependency) set(err error) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	changed := d.Swap(err == nil) != (err == nil) || d.since.IsZero()
+	if changed {
+		d.since = time.Now()
+	}
+	if err != nil {
+		d.err = err.Error()
+	}
+	return changed
+}
+
+// detail describes the dependency for the readiness check
+func (d *dependency) detail() gin.H {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res := gin.H{"status": "up", "since": d.since}
+	if !d.Load() {
+		res["status"] = "down"
+		res["error"] = d.err
+	}
+	return res
+}
+
+var (
+	// stateUp is false while the state store does not answer pings
+	// it holds sequence numbers, retries, routes and unread counts whatever the broker
+	stateUp dependency
+	// brokerUp is false while the connection of the configured broker fails
+	brokerUp dependency
+	// subscriptionUp is false while this server is not subscribed to its broker channel
+	subscriptionUp dependency
+	// roomsUp is false while the connection of the room subscription fails
+	roomsUp dependency
+	// storageUp is false while the storage backend does not answer pings
+	storageUp dependency
+)
+
+// Degraded reports whether the server currently cannot send or receive messages
+func Degraded() bool {
+	return !stateUp.Load() || !brokerUp.Load() || !subscriptionUp.Load() || !roomsUp.Load()
+}
+
+// Ready reports whether the server should be sent traffic: every dependency is up
+// and it is not shutting down
+func Ready() bool {
+	return !Degraded() && storageUp.Load() && !Draining()
+}
+
+// backoff returns the delay before retry number attempt (0 based): exponential with jitter
+func backoff(attempt int) time.Duration {
+	d := backoffMax
+	if attempt < 16 {
+		d = min(backoffBase<<attempt, backoffMax)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// monitorState keeps stateUp current
+// pings every stateCheckEvery while the store is up, and with exponential backoff while it is down
+// (the Redis client re-dials on its own, the ping only detects when it succeeds again)
+func monitorState() {
+	attempt := 0
+	for {
+		err := State.Ping(ctx)
+		changed := stateUp.set(err)
+		if err != nil {
+			if changed {
+				log.Println(StateKind+" state unavailable, entering degraded mode: ", err)
+			}
+			time.Sleep(backoff(attempt))
+			attempt++
+			continue
+		}
+		if changed {
+			log.Println(StateKind + " state available")
+		}
+		attempt = 0
+		time.Sleep(stateCheckEvery)
+	}
+}
+
+// monitorBroker keeps brokerUp and roomsUp current for the broker selected by SetupBroker,
+// the same way monitorState does for the state store
+// a subscription survives a reconnect on its own (NATS, Redis pub/sub), the ping detects that
+// it receives nothing in the meantime
+func monitorBroker() {
+	attempt := 0
+	for {
+		brokerErr := Broker.Ping(ctx)
+		if brokerUp.set(brokerErr) {
+			logState(BrokerKind+" broker", brokerErr)
+		}
+		roomsErr := Rooms.Ping(ctx)
+		if roomsUp.set(roomsErr) {
+			logState("room subscription", roomsErr)
+		}
+		if brokerErr != nil || roomsErr != nil {
+			time.Sleep(backoff(attempt))
+			attempt++
+			continue
+		}
+		attempt = 0
+		time.Sleep(brokerCheckEvery)
+	}
+}
+
+// logState logs a dependency going up or down
+func logState(name string, err error) {
+	if err != nil {
+		log.Println(name+" unavailable, entering degraded mode: ", err)
+		return
+	}
+	log.Println(name + " available")
+}
+
+// MonitorStorage keeps storageUp current, the same way monitorState does for the state store
+// repository.Setup must run first
+func MonitorStorage() {
+	attempt := 0
+	for {
+		err := controller.PingStorage()
+		changed := storageUp.set(err)
+		if err != nil {
+			if changed {
+				log.Println("storage unavailable: ", err)
+			}
+			time.Sleep(backoff(attempt))
+			attempt++
+			continue
+		}
+		if changed && attempt > 0 {
+			log.Println("storage available again")
+		}
+		attempt = 0
+		time.Sleep(storageCheckEvery)
+	}
+}
+
+// Liveness reports that the process serves requests, it does not depend on anything else:
+// restarting the server would not bring a failed dependency back
+func Liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "started_at": startedAt})
+}
+
+// Readiness reports ready, or 503 with status not_ready (or draining while shutting down),
+// with the state of every dependency:
+// storage, state and broker (with their kind) and the server and rooms subscriptions (up or
+// down, since when, and the last error while down) and shutdown (running or draining)
+func Readiness(c *gin.Context) {
+	brokerDetail := brokerUp.detail()
+	brokerDetail["kind"] = BrokerKind
+	stateDetail := stateUp.detail()
+	stateDetail["kind"] = StateKind
+	res := gin.H{
+		"status": "ready",
+		"checks": gin.H{
+			"storage": storageUp.detail(),
+			"state":   stateDetail,
+			"broker":  brokerDetail,
+			"subscriptions": gin.H{
+				"server": subscriptionUp.detail(),
+				"rooms":  roomsUp.detail(),
+			},
+			"shutdown": gin.H{"status": "running"},
+		},
+	}
+	if Draining() {
+		res["status"] = "draining"
+		res["checks"].(gin.H)["shutdown"] = gin.H{"status": "draining"}
+	} else if !Ready() {
+		res["status"] = "not_ready"
+	}
+	if res["status"] != "ready" {
+		c.JSON(http.StatusServiceUnavailable, res)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
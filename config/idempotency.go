@@ -0,0 +1,43 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dedupeWindow is how long a client message id is remembered, retries after it create a new message
+const dedupeWindow = 24 * time.Hour
+
+// claimClientId registers the client message id of a new message for dedupeWindow
+// returns the id and seq of the original message when the id was already used
+func claimClientId(sender, clientId, messageId string) (string, int64, error) {
+	return State.ClaimClientId(ctx, sender, clientId, messageId, dedupeWindow)
+}
+
+// recordClientSeq adds the sequence number to a claimed id, so duplicate acks can echo it
+func recordClientSeq(sender, clientId, messageId string, seq int64) {
+	if err := State.RecordClientSeq(ctx, sender, clientId, messageId, seq); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// releaseClientId forgets a claimed id when the message could not be sent, so a retry goes through
+func releaseClientId(sender, clientId string) {
+	if err := State.ReleaseClientId(ctx, sender, clientId); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// ack confirms to the sender that the message identified by clientId was accepted
+// duplicate is set when a retry was recognised and not sent again
+func ack(s *session, clientId, serverId string, seq int64, duplicate bool) {
+	data, err := json.Marshal(Message{Id: serverId, Type: AckEvent, ClientId: clientId, Seq: seq, Duplicate: duplicate})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	s.write(websocket.TextMessage, data)
+}
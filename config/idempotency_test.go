@@ -0,0 +1,65 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/naman1402/distributed-chat-app/model"
+	"github.com/naman1402/distributed-chat-app/repository"
+)
+
+func TestClaimClientId(t *testing.T) {
+	mr := testServer(t, nil, nil)
+
+	if id, seq, err := claimClientId("alice", "c1", "m1"); err != nil || id != "" || seq != 0 {
+		t.Fatalf("first claim: %q %d %v", id, seq, err)
+	}
+	if ttl := mr.TTL("client_msg:alice:c1"); ttl != dedupeWindow {
+		t.Fatalf("ttl %s, want %s", ttl, dedupeWindow)
+	}
+	recordClientSeq("alice", "c1", "m1", 4)
+	if id, seq, _ := claimClientId("alice", "c1", "m2"); id != "m1" || seq != 4 {
+		t.Fatalf("duplicate: %q %d, want m1 4", id, seq)
+	}
+	// recording the seq keeps the ttl, the id is forgotten after the window
+	if ttl := mr.TTL("client_msg:alice:c1"); ttl != dedupeWindow {
+		t.Fatalf("ttl after recording the seq %s, want %s", ttl, dedupeWindow)
+	}
+	mr.FastForward(dedupeWindow)
+	if id, _, _ := claimClientId("alice", "c1", "m3"); id != "" {
+		t.Fatalf("claimed after the window: got %q", id)
+	}
+}
+
+func TestRetryAfterFailedSend(t *testing.T) {
+	mr := testServer(t, []string{"alice", "bob"}, nil)
+	alice := connect(t, "alice")
+
+	// a counter behind the log makes the save fail on a taken seq
+	logged := model.ChatMessage{Id: "m1", Message: "hi", Sender: "alice", Receiver: "bob", Seq: 1}
+	if err := repository.Default.SavePrivate("dm:alice:bob", logged); err != nil {
+		t.Fatal(err)
+	}
+	mr.Set("seq:dm:alice:bob", "0")
+	send(t, alice, Message{Message: "hello", Receiver: "bob", ClientId: "c1"})
+	alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := alice.ReadMessage()
+	reply := map[string]interface{}{}
+	json.Unmarshal(data, &reply)
+	if err != nil || reply["message"] != "Failed to send message" {
+		t.Fatalf("got %s %v, want the failure", data, err)
+	}
+	alice.SetReadDeadline(time.Time{})
+	if mr.Exists("client_msg:alice:c1") {
+		t.Fatal("client id kept after the failed send")
+	}
+
+	// the retry is a new message, then a duplicate
+	for _, duplicate := range []bool{false, true} {
+		send(t, alice, Message{Message: "hello", Receiver: "bob", ClientId: "c1"})
+		if ack := receive(t, alice, AckEvent); ack.Seq != 2 || ack.Duplicate != duplicate {
+			t.Fatalf("ack %+v, want seq 2 and duplicate %v", ack, duplicate)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/naman1402/distributed-chat-app/controller"
+)
+
+// default and maximum number of conversations returned by Inbox
+const (
+	inboxPageSize    = 20
+	inboxMaxPageSize = 100
+)
+
+// updateInbox moves the message's conversation to the top of every user's inbox
+func updateInbox(res Message, users []string) {
+	for _, user := range users {
+		controller.UpdateInbox(user, conversationKey(res, user), res.Id, res.Message, res.Sender, res.Group)
+	}
+}
+
+// Inbox lists the user's conversations sorted by last activity, with preview and unread counts
+// the user is the logged in user (uid cookie)
+// query params: before (last_message_id of the last entry already seen), limit
+func Inbox(c *gin.Context) {
+	user, ok := controller.CurrentUser(c)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(inboxPageSize)))
+	if err != nil || limit < 1 || limit > inboxMaxPageSize {
+		limit = inboxPageSize
+	}
+	entries := controller.GetInbox(user, c.Query("before"), limit)
+	for i := range entries {
+		entries[i].Unread, entries[i].Mentions = unreadCounts(user, entries[i].Conversation)
+	}
+	next := ""
+	if len(entries) > 0 && len(entries) == limit {
+		next = entries[len(entries)-1].LastMessageId
+	}
+	c.JSON(http.StatusOK, gin.H{"conversations": entries, "next": next})
+}
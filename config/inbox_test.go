@@ -0,0 +1,84 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/naman1402/distributed-chat-app/model"
+)
+
+func TestInbox(t *testing.T) {
+	testServer(t, []string{"alice", "bob", "carol"}, map[string][]string{"room1": {"alice", "bob", "carol"}})
+	alice, bob, carol := connect(t, "alice"), connect(t, "bob"), connect(t, "carol")
+
+	// sent one after the other, each acked before the next
+	sent := []struct {
+		conn *websocket.Conn
+		m    Message
+	}{
+		{alice, Message{Message: "first", Receiver: "bob"}},
+		{carol, Message{Message: "room news", Group: true, GroupName: "room1"}},
+		{carol, Message{Message: "hey bob", Receiver: "bob"}},
+		{alice, Message{Message: "latest", Receiver: "bob"}},
+	}
+	for i, s := range sent {
+		s.m.ClientId = "c" + string(rune('1'+i))
+		send(t, s.conn, s.m)
+		receive(t, s.conn, AckEvent)
+	}
+	// bob read the room
+	send(t, bob, Message{Type: ReadEvent, Group: true, GroupName: "room1", LastRead: "zzzzzzzzzzzzzzzzzzzzzzzzzzz"})
+	waitFor(t, "the read marker", func() bool {
+		unread, _ := unreadCounts("bob", "group:room1")
+		return unread == 0
+	})
+
+	type page struct {
+		Conversations []model.InboxEntry `json:"conversations"`
+		Next          string             `json:"next"`
+	}
+	tests := []struct {
+		name  string
+		user  string
+		query string
+		// conversations expected in order, with their unread count
+		conversations []string
+		unread        []int64
+		more          bool
+	}{
+		{"most recent first", "bob", "", []string{"dm:alice", "dm:carol", "group:room1"}, []int64{2, 1, 0}, false},
+		{"first page", "bob", "?limit=2", []string{"dm:alice", "dm:carol"}, []int64{2, 1}, true},
+		{"sender's inbox", "carol", "", []string{"dm:bob", "group:room1"}, []int64{0, 0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := page{}
+			getAs(t, Inbox, tt.user, "/inbox"+tt.query, &res)
+			conversations, unread := []string{}, []int64{}
+			for _, e := range res.Conversations {
+				conversations = append(conversations, e.Conversation)
+				unread = append(unread, e.Unread)
+			}
+			if !reflect.DeepEqual(conversations, tt.conversations) || !reflect.DeepEqual(unread, tt.unread) {
+				t.Fatalf("conversations %v unread %v, want %v %v", conversations, unread, tt.conversations, tt.unread)
+			}
+			if (res.Next != "") != tt.more {
+				t.Fatalf("next %q", res.Next)
+			}
+		})
+	}
+
+	// the next page starts after the cursor, the latest message gives the preview
+	first := page{}
+	getAs(t, Inbox, "bob", "/inbox?limit=2", &first)
+	top := first.Conversations[0]
+	if top.Sender != "alice" || top.Preview != "latest" {
+		t.Fatalf("top entry %+v", top)
+	}
+	rest := page{}
+	getAs(t, Inbox, "bob", "/inbox?limit=2&before="+first.Next, &rest)
+	if len(rest.Conversations) != 1 || rest.Conversations[0].Conversation != "group:room1" || rest.Next != "" {
+		t.Fatalf("second page %+v", rest)
+	}
+}
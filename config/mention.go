@@ -0,0 +1,52 @@
+package config
+
+import (
+	"regexp"
+	"strings"
+)
+
+// RoomMention is the keyword that mentions every member of the room
+const RoomMention = "room"
+
+// mentionPattern matches @username tokens, usernames are letters, digits, '_', '.' and '-'
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([\w.-]+)`)
+
+// parseMentions extracts the mentions of a group message
+// Implementation:
+// 1. Finds every @token in the message text
+// 2. @room sets the room flag
+// 3. @username is kept only if the user is a member of the room
+// 4. Duplicates are removed, order of first appearance is preserved
+func parseMentions(text string, members []string) ([]string, bool) {
+	isMember := make(map[string]bool, len(members))
+	for _, member := range members {
+		isMember[member] = true
+	}
+	mentions := []string{}
+	seen := make(map[string]bool)
+	room := false
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		// trailing punctuation is not part of the username ("@bob." / "@bob-")
+		name := strings.TrimRight(match[1], ".-")
+		if name == RoomMention {
+			room = true
+			continue
+		}
+		if !isMember[name] || seen[name] {
+			continue
+		}
+		seen[name] = true
+		mentions = append(mentions, name)
+	}
+	return mentions, room
+}
+
+// isMentioned reports whether user is in the list of mentions
+func isMentioned(mentions []string, user string) bool {
+	for _, mention := range mentions {
+		if mention == user {
+			return true
+		}
+	}
+	return false
+}
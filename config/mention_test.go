@@ -0,0 +1,49 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	members := []string{"alice", "bob", "carol.d", "dave-e", "erin_f"}
+	tests := []struct {
+		name     string
+		text     string
+		mentions []string
+		room     bool
+	}{
+		{"no mention", "hello everyone", []string{}, false},
+		{"single member", "hi @bob", []string{"bob"}, false},
+		{"start of the text", "@alice look", []string{"alice"}, false},
+		{"trailing punctuation", "thanks @bob. and @alice, @carol.d!", []string{"bob", "alice", "carol.d"}, false},
+		{"trailing dash", "ping @dave-e- now", []string{"dave-e"}, false},
+		{"inside parentheses", "(@erin_f)", []string{"erin_f"}, false},
+		{"email address", "write to bob@example.com", []string{}, false},
+		{"double at", "@@bob", []string{}, false},
+		{"duplicates keep first order", "@bob @alice @bob @alice", []string{"bob", "alice"}, false},
+		{"non member", "@mallory @bob", []string{"bob"}, false},
+		{"room", "@room meeting now", []string{}, true},
+		{"room with punctuation and members", "@room. @alice", []string{"alice"}, true},
+		{"room inside a word", "chat@room", []string{}, false},
+		{"username prefix is not a mention", "@bobby", []string{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mentions, room := parseMentions(tt.text, members)
+			if !reflect.DeepEqual(mentions, tt.mentions) || room != tt.room {
+				t.Fatalf("parseMentions(%q) = %v, %v, want %v, %v", tt.text, mentions, room, tt.mentions, tt.room)
+			}
+		})
+	}
+}
+
+func TestIsMentioned(t *testing.T) {
+	mentions := []string{"alice", "bob"}
+	if !isMentioned(mentions, "bob") {
+		t.Fatal("bob is mentioned")
+	}
+	if isMentioned(mentions, "carol") || isMentioned(nil, "bob") {
+		t.Fatal("not mentioned")
+	}
+}
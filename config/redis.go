@@ -1,11 +1,13 @@
-// Package config implements Redis configuration and pub/sub mechanisms
-// for distributed message handling across multiple server instances
+// Package config implements Redis configuration and the message broker
+// used for distributed message handling across multiple server instances
 package config
 
 import (
 	"context"
-	"fmt"
+	"crypto/tls"
 
+	"github.com/naman1402/distributed-chat-app/metrics"
+	"github.com/naman1402/distributed-chat-app/settings"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -15,47 +17,53 @@ var (
 	ctx = context.Background()
 
 	// Conn represents the main Redis client instance
-	// Used globally for all Redis operations including pub/sub
-	Conn redis.Client
+	// Used by the Redis state store and the Redis brokers, nil when neither is configured
+	// a single node, Sentinel or Cluster client depending on the configured mode
+	Conn redis.UniversalClient
 )
 
-// NPool initializes and configures the Redis connection pool
-// Implementation:
-// 1. Creates new Redis client with server configuration
-// 2. Verifies connection with ping
-// 3. Sets global Redis client instance
-// Panics if connection fails
-func NPool() {
-
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     "redis:6379",
-		Password: "",
-		DB:       0,
-	})
-	_, err := rdb.Ping(ctx).Result()
-	if err != nil {
-		panic(err)
+// redisOptions converts the Redis settings to client options
+// zero pool sizes and timeouts keep the go-redis defaults
+func redisOptions(cfg settings.Redis) *redis.UniversalOptions {
+	opts := &redis.UniversalOptions{
+		Addrs:            cfg.Addrs,
+		Username:         cfg.Username,
+		Password:         cfg.Password,
+		SentinelUsername: cfg.SentinelUsername,
+		SentinelPassword: cfg.SentinelPassword,
+		DB:               cfg.DB,
+		PoolSize:         cfg.PoolSize,
+		MinIdleConns:     cfg.MinIdleConns,
+		DialTimeout:      cfg.DialTimeout.Duration,
+		ReadTimeout:      cfg.ReadTimeout.Duration,
+		WriteTimeout:     cfg.WriteTimeout.Duration,
+		PoolTimeout:      cfg.PoolTimeout.Duration,
+	}
+	if cfg.Mode == "sentinel" {
+		opts.MasterName = cfg.MasterName
+	}
+	if cfg.TLS {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: cfg.TLSServerName}
 	}
-	Conn = *rdb
+	return opts
 }
 
-// PubSub implements Redis publish/subscribe pattern
-// Implementation:
-// 1. Creates subscription to server-specific channel
-// 2. Continuously listens for incoming messages
-// 3. Forwards received messages to broadcast channel
-// 4. Handles connection errors
-// Note: SERVERID is used as the subscription channel
-func PubSub() {
-	SERVERID := ""
-	fmt.Println(SERVERID)
-	subscriber := Conn.Subscribe(ctx, SERVERID)
-	for {
-		msg, err := subscriber.ReceiveMessage(ctx)
-		if err != nil {
-			panic(err)
-		}
-		broadcast <- msg
+// newRedisClient creates the client for the mode
+// NewUniversalClient only picks a cluster client for several addresses, so cluster mode
+// creates it directly to also work with a single seed node
+func newRedisClient(opts *redis.UniversalOptions, mode string) redis.UniversalClient {
+	if mode == "cluster" {
+		return redis.NewClusterClient(opts.Cluster())
 	}
+	return redis.NewUniversalClient(opts)
+}
 
+// NPool initializes and configures the Redis connection pool
+// Implementation:
+// 1. Creates the single node, Sentinel failover or Cluster client for cfg.Mode
+// 2. Sets global Redis client instance
+// The client connects lazily, the state and broker monitors report whether Redis answers
+func NPool(cfg settings.Redis) {
+	Conn = newRedisClient(redisOptions(cfg), cfg.Mode)
+	Conn.AddHook(metrics.RedisHook{})
 }
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/naman1402/distributed-chat-app/controller"
+	"github.com/naman1402/distributed-chat-app/settings"
+	"github.com/naman1402/distributed-chat-app/state"
+)
+
+// registry keeps track of the live servers, in the state store
+// every server holds a lease (its ServerInfo, expiring after the lease) renewed every
+// heartbeat, and is listed; the store also lists the users it routes. Every server also runs
+// a reaper looking for listed servers whose lease expired: their routes are deleted, their
+// users marked offline and the server unlisted.
+
+// ServerInfo is the lease of a server, as listed by Servers
+type ServerInfo = state.ServerInfo
+
+var (
+	// serverHeartbeat is the interval at which the lease is renewed
+	serverHeartbeat = 10 * time.Second
+	// serverLease is how long a server is considered alive after its last heartbeat
+	serverLease = 30 * time.Second
+	// reapEvery is the interval at which expired servers are looked for
+	reapEvery = 15 * time.Second
+	// startedAt is when this server started
+	startedAt = time.Now()
+)
+
+// SetupRegistry registers the server and starts the heartbeat and the reaper, SetupState must run first
+func SetupRegistry(cfg settings.Registry) {
+	serverHeartbeat = cfg.Heartbeat.Duration
+	serverLease = cfg.Lease.Duration
+	reapEvery = cfg.ReapInterval.Duration
+	if err := register(); err != nil {
+		log.Println("server not registered: ", err)
+	}
+	go heartbeat()
+	go reapServers()
+}
+
+// register writes the lease of this server and lists it
+func register() error {
+	info := ServerInfo{Id: SERVERID, Connections: len(localUsers()), StartedAt: startedAt, Heartbeat: time.Now()}
+	return State.Register(ctx, info, serverLease)
+}
+
+// heartbeat renews the lease every serverHeartbeat
+func heartbeat() {
+	ticker := time.NewTicker(serverHeartbeat)
+	defer ticker.Stop()
+	for range ticker.C {
+		// the lease is removed by Drain, it must not be written back
+		if Draining() {
+			return
+		}
+		if err := register(); err != nil {
+			log.Println("heartbeat failed: ", err)
+		}
+	}
+}
+
+// reapServers reaps the listed servers whose lease expired, every reapEvery
+func reapServers() {
+	ticker := time.NewTicker(reapEvery)
+	defer ticker.Stop()
+	for range ticker.C {
+		reapExpired()
+	}
+}
+
+// reapExpired reaps every listed server other than this one whose lease expired
+func reapExpired() {
+	serverIds, err := State.Listed(ctx)
+	if err != nil {
+		return
+	}
+	for _, serverId := range serverIds {
+		if serverId == SERVERID {
+			continue
+		}
+		if alive, err := State.Alive(ctx, serverId); err != nil || alive {
+			continue
+		}
+		reapServer(serverId)
+	}
+}
+
+// reapServer cleans up after a server whose lease expired
+// Implementation:
+// 1. Takes the server's reaping lock, so a single reaper handles it
+// 2. Deletes the routes still pointing at the server and announces the change
+// 3. Marks its users offline in the repository mapping
+// 4. Unlists the server, unless it renewed its lease in the meantime
+func reapServer(serverId string) {
+	locked, err := State.LockReap(ctx, serverId, SERVERID, serverLease)
+	if err != nil || !locked {
+		return
+	}
+	defer State.UnlockReap(ctx, serverId)
+
+	users, err := State.ServerUsers(ctx, serverId)
+	if err != nil {
+		log.Println("reaping "+serverId+" failed: ", err)
+		return
+	}
+	for _, user := range users {
+		released, err := State.ReleaseRoute(ctx, user, serverId)
+		if err != nil {
+			log.Println("reaping "+serverId+" failed: ", err)
+			return
+		}
+		if released {
+			invalidateRoute(user)
+		}
+		controller.ClearUser(user, serverId)
+	}
+	if alive, err := State.Alive(ctx, serverId); err != nil || alive {
+		return
+	}
+	if err := State.Unlist(ctx, serverId); err != nil {
+		log.Println("reaping "+serverId+" failed: ", err)
+		return
+	}
+	log.Printf("server %s expired, cleaned up after its %d users", serverId, len(users))
+}
+
+// Servers lists the live servers with their connection counts, sorted by id
+func Servers(c *gin.Context) {
+	servers, err := State.Servers(ctx)
+	if err != nil {
+		controller.RespondError(c, http.StatusServiceUnavailable, "server registry unavailable")
+		return
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Id < servers[j].Id })
+	c.JSON(http.StatusOK, gin.H{"servers": servers})
+}
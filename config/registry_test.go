@@ -0,0 +1,117 @@
+package config
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/naman1402/distributed-chat-app/controller"
+	"github.com/naman1402/distributed-chat-app/repository"
+	"github.com/naman1402/distributed-chat-app/state"
+)
+
+// registryStores set the state store of the test server, advance moves its clock forward
+var registryStores = []struct {
+	name string
+	open func(t *testing.T) (advance func(time.Duration))
+}{
+	{"redis", func(t *testing.T) func(time.Duration) {
+		return testServer(t, []string{"bob", "carol"}, nil).FastForward
+	}},
+	{"memory", func(t *testing.T) func(time.Duration) {
+		testServer(t, []string{"bob", "carol"}, nil)
+		m := state.NewMemory()
+		now := time.Now()
+		m.Now = func() time.Time { return now }
+		State = m
+		return func(d time.Duration) { now = now.Add(d) }
+	}},
+}
+
+func TestReapExpired(t *testing.T) {
+	for _, store := range registryStores {
+		t.Run(store.name, func(t *testing.T) {
+			advance := store.open(t)
+			serverLease = 30 * time.Second
+			if err := register(); err != nil {
+				t.Fatal(err)
+			}
+			// S2 holds bob, carol moved on to S3 since
+			State.Register(ctx, ServerInfo{Id: "S2"}, serverLease)
+			for user, serverId := range map[string]string{"bob": "S2", "carol": "S2"} {
+				State.ClaimRoute(ctx, user, serverId, routeTTL)
+				controller.SetUser(user, serverId)
+			}
+			State.ClaimRoute(ctx, "carol", "S3", routeTTL)
+			controller.SetUser("carol", "S3")
+			listed := func() []string {
+				serverIds, err := State.Listed(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sort.Strings(serverIds)
+				return serverIds
+			}
+
+			// S2 is within its lease
+			advance(20 * time.Second)
+			reapExpired()
+			if got := listed(); !reflect.DeepEqual(got, []string{"S1", "S2"}) {
+				t.Fatalf("listed %v before the lease expired", got)
+			}
+
+			// S1 renews, S2 does not; S1 never reaps itself
+			register()
+			advance(20 * time.Second)
+			reapExpired()
+			if got := listed(); !reflect.DeepEqual(got, []string{"S1"}) {
+				t.Fatalf("listed %v, want S2 reaped", got)
+			}
+			routes, _ := State.GetRoutes(ctx, []string{"bob", "carol"})
+			if !reflect.DeepEqual(routes, map[string]string{"carol": "S3"}) {
+				t.Fatalf("routes %v, want bob released and carol kept on S3", routes)
+			}
+			for user, want := range map[string]string{"bob": "", "carol": "S3"} {
+				if got, _ := repository.Default.GetServer(user); got != want {
+					t.Fatalf("mapping of %s %q, want %q", user, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReapLock(t *testing.T) {
+	for _, store := range registryStores {
+		t.Run(store.name, func(t *testing.T) {
+			advance := store.open(t)
+			serverLease = 30 * time.Second
+			State.Register(ctx, ServerInfo{Id: "S2"}, serverLease)
+			State.ClaimRoute(ctx, "bob", "S2", routeTTL)
+			advance(31 * time.Second)
+
+			// another server is reaping S2: it is left alone until the lock expires
+			if locked, _ := State.LockReap(ctx, "S2", "S9", serverLease); !locked {
+				t.Fatal("lock not taken")
+			}
+			reapExpired()
+			if routes, _ := State.GetRoutes(ctx, []string{"bob"}); routes["bob"] != "S2" {
+				t.Fatalf("route of bob %q while another server reaps", routes["bob"])
+			}
+			advance(serverLease)
+			reapExpired()
+			if routes, _ := State.GetRoutes(ctx, []string{"bob"}); len(routes) != 0 {
+				t.Fatalf("routes %v after the lock expired", routes)
+			}
+
+			// a server renewing its lease during the reap keeps its listing
+			State.Register(ctx, ServerInfo{Id: "S4"}, serverLease)
+			advance(31 * time.Second)
+			State.Register(ctx, ServerInfo{Id: "S4"}, serverLease)
+			reapServer("S4")
+			if serverIds, _ := State.Listed(ctx); !reflect.DeepEqual(serverIds, []string{"S4"}) {
+				t.Fatalf("listed %v, want S4 kept", serverIds)
+			}
+		})
+	}
+}
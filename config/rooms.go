@@ -0,0 +1,128 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/naman1402/distributed-chat-app/broker"
+	"github.com/naman1402/distributed-chat-app/controller"
+	"github.com/naman1402/distributed-chat-app/metrics"
+)
+
+// RoomJoinedEvent tells the server a user is connected to that the user joined a room,
+// so it subscribes to the room; it is handled by the server and not sent to the client
+const RoomJoinedEvent = "room_joined"
+
+var (
+	// roomMembers maps a room to its members connected to this server
+	// the server is subscribed to exactly the rooms in this map
+	roomMembers = make(map[string]map[string]bool)
+	// memberRooms maps a connected user to the rooms it is counted in
+	memberRooms = make(map[string]map[string]bool)
+	roomsMu     sync.Mutex
+)
+
+// RoomPubSub forwards the payloads of the subscribed rooms to the broadcast channel
+func RoomPubSub() {
+	for msg := range Rooms.Messages() {
+		enqueue(broker.Delivery{Data: msg})
+	}
+}
+
+// publishRoom sends data to every server with members of the room online
+func publishRoom(room string, data []byte) {
+	if err := Rooms.Publish(ctx, room, data); err != nil {
+		fmt.Println(err)
+		return
+	}
+	metrics.MessagesPublished.WithLabelValues("group").Inc()
+}
+
+// enterRooms counts a user connecting to this server in all of its rooms
+func enterRooms(user string) error {
+	return enterRoom(user, controller.GetRoomsOfUser(user)...)
+}
+
+// enterRoom adds the user to the local members of the rooms, subscribing to the rooms
+// that had no local member yet
+// if the subscription fails nothing is recorded and the error is returned, the user would
+// not receive the messages of those rooms
+func enterRoom(user string, rooms ...string) error {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	joined := []string{}
+	for _, room := range rooms {
+		if roomMembers[room] == nil {
+			joined = append(joined, room)
+		}
+	}
+	if len(joined) > 0 {
+		if err := Rooms.Join(ctx, joined...); err != nil {
+			return err
+		}
+	}
+	for _, room := range rooms {
+		if roomMembers[room] == nil {
+			roomMembers[room] = make(map[string]bool)
+		}
+		roomMembers[room][user] = true
+		if memberRooms[user] == nil {
+			memberRooms[user] = make(map[string]bool)
+		}
+		memberRooms[user][room] = true
+	}
+	return nil
+}
+
+// leaveRooms removes a disconnected user from the local members of its rooms,
+// unsubscribing from the rooms left without local member
+func leaveRooms(user string) {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	left := []string{}
+	for room := range memberRooms[user] {
+		delete(roomMembers[room], user)
+		if len(roomMembers[room]) == 0 {
+			delete(roomMembers, room)
+			left = append(left, room)
+		}
+	}
+	delete(memberRooms, user)
+	if len(left) > 0 {
+		if err := Rooms.Leave(ctx, left...); err != nil {
+			log.Println("room unsubscription failed: ", err)
+		}
+	}
+}
+
+// localMembers returns the members of the room connected to this server
+func localMembers(room string) []string {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	members := make([]string, 0, len(roomMembers[room]))
+	for member := range roomMembers[room] {
+		members = append(members, member)
+	}
+	return members
+}
+
+// announceJoin tells the server the user is connected to, if any, about the new room
+func announceJoin(room, user string) {
+	notify(Message{Type: RoomJoinedEvent, Receiver: user, Group: true, GroupName: room})
+}
+
+// roomJoined subscribes to a room joined by a user connected to this server
+// if the subscription fails the connection is closed, the client reconnects and its rooms
+// are subscribed again
+func roomJoined(event Message) {
+	s := getSession(event.Receiver)
+	if s == nil {
+		return
+	}
+	if err := enterRoom(event.Receiver, event.GroupName); err != nil {
+		log.Println("room subscription failed: ", err)
+		closeSession(ctx, s, websocket.CloseTryAgainLater, "room subscription failed, reconnect")
+	}
+}
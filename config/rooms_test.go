@@ -0,0 +1,154 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/naman1402/distributed-chat-app/broker"
+	"github.com/naman1402/distributed-chat-app/metrics"
+	"github.com/naman1402/distributed-chat-app/repository"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// failingRooms fails Join while fail is set
+type failingRooms struct {
+	broker.Rooms
+	fail atomic.Bool
+}
+
+func (f *failingRooms) Join(ctx context.Context, rooms ...string) error {
+	if f.fail.Load() {
+		return errors.New("rooms unavailable")
+	}
+	return f.Rooms.Join(ctx, rooms...)
+}
+
+// failRooms wraps the room subscription of the test server until the test ends, it must be
+// called before the connections of the test are opened
+func failRooms(t *testing.T) *failingRooms {
+	f := &failingRooms{Rooms: Rooms}
+	Rooms = f
+	t.Cleanup(func() { Rooms = f.Rooms })
+	return f
+}
+
+// sortedLocalMembers returns the local members of the room, sorted
+func sortedLocalMembers(room string) []string {
+	members := localMembers(room)
+	sort.Strings(members)
+	return members
+}
+
+// closedWith reads conn until its close frame and checks the code
+func closedWith(t *testing.T, conn *websocket.Conn, code int) {
+	t.Helper()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, code) {
+			t.Fatalf("got %v after %s, want close %d", err, data, code)
+		}
+		return
+	}
+}
+
+func TestEnterRoomsJoinFails(t *testing.T) {
+	mr := testServer(t, []string{"alice"}, map[string][]string{"room1": {"alice"}})
+	f := failRooms(t)
+	f.fail.Store(true)
+
+	closedWith(t, dial(t, "alice"), websocket.CloseNormalClosure)
+	waitFor(t, "the session to end", func() bool { return getSession("alice") == nil })
+	if mr.Exists("route:alice") {
+		t.Fatal("route kept after the failed connection")
+	}
+	if members := localMembers("room1"); len(members) != 0 {
+		t.Fatalf("local members %v after a failed subscription", members)
+	}
+
+	// the next connection subscribes
+	f.fail.Store(false)
+	connect(t, "alice")
+	if members := sortedLocalMembers("room1"); !reflect.DeepEqual(members, []string{"alice"}) {
+		t.Fatalf("local members %v", members)
+	}
+}
+
+func TestRoomJoinedFails(t *testing.T) {
+	testServer(t, []string{"alice", "bob"}, map[string][]string{"room1": {"alice"}})
+	// wrapped first so it is restored once every connection ended
+	f := failRooms(t)
+	alice, bob := connect(t, "alice"), connect(t, "bob")
+
+	// bob joins room1, subscribed already for alice, and room2 that needs a subscription
+	if err := repository.Default.AddMember("room1", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.Default.CreateRoom("id-room2", "room2"); err != nil {
+		t.Fatal(err)
+	}
+	repository.Default.AddMember("room2", "bob")
+	// the subscription of room2 fails: bob is disconnected to subscribe again
+	f.fail.Store(true)
+	event, _ := json.Marshal(Message{Type: RoomJoinedEvent, Receiver: "bob", Group: true, GroupName: "room2"})
+	dispatch(event)
+	closedWith(t, bob, websocket.CloseTryAgainLater)
+	waitFor(t, "the session to end", func() bool { return getSession("bob") == nil })
+	if members := localMembers("room2"); len(members) != 0 {
+		t.Fatalf("room2 local members %v after a failed subscription", members)
+	}
+
+	f.fail.Store(false)
+	connect(t, "bob")
+	for room, want := range map[string][]string{"room1": {"alice", "bob"}, "room2": {"bob"}} {
+		if members := sortedLocalMembers(room); !reflect.DeepEqual(members, want) {
+			t.Fatalf("%s local members %v, want %v", room, members, want)
+		}
+	}
+	silent(t, alice)
+}
+
+func TestRoomFanOutLocalMembers(t *testing.T) {
+	testServer(t, []string{"alice", "bob", "carol", "dave"}, map[string][]string{
+		"room1": {"alice", "bob", "carol"},
+		"room2": {"dave"},
+	})
+	alice, bob, dave := connect(t, "alice"), connect(t, "bob"), connect(t, "dave")
+	if members := sortedLocalMembers("room1"); !reflect.DeepEqual(members, []string{"alice", "bob"}) {
+		t.Fatalf("local members %v, want alice and bob", members)
+	}
+	dropped := func() float64 {
+		return testutil.ToFloat64(metrics.MessagesDroppedOffline.WithLabelValues("group"))
+	}
+	before := dropped()
+
+	send(t, alice, Message{Message: "one", Group: true, GroupName: "room1"})
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		if got := receive(t, conn, ""); got.Message != "one" {
+			t.Fatalf("received %+v", got)
+		}
+	}
+
+	// once bob disconnects only alice is left here
+	bob.Close()
+	waitFor(t, "bob to leave room1", func() bool {
+		return reflect.DeepEqual(sortedLocalMembers("room1"), []string{"alice"})
+	})
+	send(t, alice, Message{Message: "two", Group: true, GroupName: "room1"})
+	if got := receive(t, alice, ""); got.Message != "two" {
+		t.Fatalf("received %+v", got)
+	}
+	// members connected elsewhere or offline are not counted as drops here
+	if dropped() != before {
+		t.Fatalf("%v group messages dropped, want none", dropped()-before)
+	}
+	silent(t, dave)
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/naman1402/distributed-chat-app/controller"
+	"github.com/naman1402/distributed-chat-app/settings"
+)
+
+// routing keeps track of the server each connected user is on
+// The state store holds user -> serverId, set on connect, deleted on disconnect and renewed
+// by the owning server every heartbeat, so the routes of a crashed server expire on their own.
+// Lookups go through an in-process LRU, entries are dropped when the route changes
+// (route invalidations of the store) and after the cache TTL in any case.
+// The store also lists the users routed to each server, see reapServer.
+// The repository mapping is still written on connect, it is only read while the store is down.
+
+var (
+	// routeTTL is how long a route lives without heartbeat
+	routeTTL = 90 * time.Second
+	// routeHeartbeat is the interval at which the routes of local users are renewed
+	routeHeartbeat = 30 * time.Second
+	// routeCache maps user -> serverId, "" for users without a route (offline)
+	routeCache = expirable.NewLRU[string, string](10000, nil, 30*time.Second)
+	// routeCacheLive is false while invalidations are not received, the cache is bypassed then
+	routeCacheLive atomic.Bool
+)
+
+// SetupRouting applies the routing settings and starts the heartbeat and the
+// invalidation listener, SetupState must run first
+func SetupRouting(cfg settings.Routing) {
+	routeTTL = cfg.TTL.Duration
+	routeHeartbeat = cfg.Heartbeat.Duration
+	routeCache = expirable.NewLRU[string, string](cfg.CacheSize, nil, cfg.CacheTTL.Duration)
+	go renewRoutes()
+	go watchRoutes(ctx)
+}
+
+// claimRoute points the user's route at this server, a new connection always wins
+func claimRoute(user string) {
+	if err := State.ClaimRoute(ctx, user, SERVERID, routeTTL); err != nil {
+		log.Println("route not stored for "+user+": ", err)
+		return
+	}
+	invalidateRoute(user)
+}
+
+// releaseRoute removes the user's route unless the user already reconnected elsewhere
+func releaseRoute(user string) {
+	released, err := State.ReleaseRoute(ctx, user, SERVERID)
+	if err != nil {
+		log.Println("route not released for "+user+": ", err)
+		return
+	}
+	if released {
+		invalidateRoute(user)
+	}
+}
+
+// invalidateRoute drops the user's cached route on every server
+func invalidateRoute(user string) {
+	routeCache.Remove(user)
+	if err := State.InvalidateRoute(ctx, user); err != nil {
+		log.Println("route invalidation not sent: ", err)
+	}
+}
+
+// lookupRoute returns the server the user is connected to, "" if offline
+func lookupRoute(user string) string {
+	return lookupRoutes([]string{user})[user]
+}
+
+// lookupRoutes returns the server of every connected user, offline users are left out
+// Implementation:
+// 1. Takes the routes found in the local cache (if invalidations are being received)
+// 2. Reads the others from the state store and caches them, a missing route means offline
+// 3. If the store cannot answer, they are looked up in the repository
+func lookupRoutes(users []string) map[string]string {
+	routes := make(map[string]string, len(users))
+	useCache := routeCacheLive.Load()
+	missing := []string{}
+	for _, user := range users {
+		if serverId, ok := routeCache.Get(user); ok && useCache {
+			if serverId != "" {
+				routes[user] = serverId
+			}
+			continue
+		}
+		missing = append(missing, user)
+	}
+	if len(missing) == 0 {
+		return routes
+	}
+
+	found, err := State.GetRoutes(ctx, missing)
+	if err != nil {
+		for user, serverId := range controller.GetServerIds(missing) {
+			routes[user] = serverId
+		}
+		return routes
+	}
+	for _, user := range missing {
+		serverId := found[user]
+		if useCache {
+			routeCache.Add(user, serverId)
+		}
+		if serverId != "" {
+			routes[user] = serverId
+		}
+	}
+	return routes
+}
+
+// renewRoutes renews the routes of the users connected to this server every heartbeat
+func renewRoutes() {
+	ticker := time.NewTicker(routeHeartbeat)
+	defer ticker.Stop()
+	for range ticker.C {
+		if Draining() {
+			return
+		}
+		// also lists the users again in case this server was reaped while the store was unreachable
+		if err := State.RenewRoutes(ctx, SERVERID, localUsers(), routeTTL); err != nil {
+			log.Println("routes not renewed: ", err)
+		}
+	}
+}
+
+// localUsers lists the users with a session on this server
+func localUsers() []string {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	users := make([]string, 0, len(sessions))
+	for user := range sessions {
+		users = append(users, user)
+	}
+	return users
+}
+
+// watchRoutes applies route invalidations to the local cache until ctx ends
+// the cache is bypassed while not subscribed and emptied on every (re)subscription,
+// since invalidations may have been missed in the meantime
+func watchRoutes(ctx context.Context) {
+	attempt := 0
+	for ctx.Err() == nil {
+		users, err := State.RouteInvalidations(ctx)
+		if err != nil {
+			log.Println("route invalidations unavailable: ", err)
+			time.Sleep(backoff(attempt))
+			attempt++
+			continue
+		}
+		routeCache.Purge()
+		routeCacheLive.Store(true)
+		attempt = 0
+		for user := range users {
+			routeCache.Remove(user)
+		}
+		routeCacheLive.Store(false)
+		if ctx.Err() == nil {
+			time.Sleep(backoff(attempt))
+			attempt++
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/naman1402/distributed-chat-app/controller"
+)
+
+// watchTestRoutes gives the test an empty route cache kept up to date by watchRoutes,
+// stopped at cleanup
+func watchTestRoutes(t *testing.T) {
+	routeCache = expirable.NewLRU[string, string](100, nil, time.Minute)
+	watchCtx, cancel := context.WithCancel(ctx)
+	go watchRoutes(watchCtx)
+	waitFor(t, "the route invalidations", routeCacheLive.Load)
+	t.Cleanup(func() {
+		cancel()
+		waitFor(t, "watchRoutes to stop", func() bool { return !routeCacheLive.Load() })
+	})
+}
+
+func TestLookupRouteCache(t *testing.T) {
+	mr := testServer(t, []string{"alice", "bob"}, nil)
+	watchTestRoutes(t)
+
+	mr.Set("route:alice", "S2")
+	if got := lookupRoute("alice"); got != "S2" {
+		t.Fatalf("alice on %q, want S2", got)
+	}
+	// routes and offline users are served from the cache until invalidated
+	mr.Set("route:alice", "S3")
+	lookupRoute("bob")
+	mr.Set("route:bob", "S2")
+	if got := lookupRoutes([]string{"alice", "bob"}); len(got) != 1 || got["alice"] != "S2" {
+		t.Fatalf("cached routes %v, want alice on S2 and bob offline", got)
+	}
+
+	for user, want := range map[string]string{"alice": "S3", "bob": "S2"} {
+		// as done by the server the user connected to
+		if err := State.InvalidateRoute(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the invalidation of "+user, func() bool { return lookupRoute(user) == want })
+	}
+
+	// claiming a route here drops the cached one at once
+	connect(t, "alice")
+	if got := lookupRoute("alice"); got != "S1" {
+		t.Fatalf("alice on %q after connecting here, want S1", got)
+	}
+}
+
+func TestLookupRouteWithoutInvalidations(t *testing.T) {
+	mr := testServer(t, []string{"alice"}, nil)
+	routeCache = expirable.NewLRU[string, string](100, nil, time.Minute)
+	routeCacheLive.Store(false)
+
+	// without invalidations every lookup reads the store and nothing is cached
+	mr.Set("route:alice", "S2")
+	lookupRoute("alice")
+	mr.Set("route:alice", "S3")
+	if got := lookupRoute("alice"); got != "S3" {
+		t.Fatalf("alice on %q, want S3", got)
+	}
+	if routeCache.Len() != 0 {
+		t.Fatalf("%d routes cached while invalidations are not received", routeCache.Len())
+	}
+}
+
+func TestLookupRouteFallback(t *testing.T) {
+	mr := testServer(t, []string{"alice", "bob"}, nil)
+	routeCache = expirable.NewLRU[string, string](100, nil, time.Minute)
+	routeCacheLive.Store(false)
+	controller.SetUser("alice", "S2")
+	mr.Set("route:alice", "S3")
+
+	// while the store is down the repository mapping is used
+	mr.Close()
+	routes := lookupRoutes([]string{"alice", "bob"})
+	if len(routes) != 1 || routes["alice"] != "S2" {
+		t.Fatalf("routes %v, want alice on S2 from the repository", routes)
+	}
+}
@@ -0,0 +1,17 @@
+package config
+
+import (
+	"github.com/naman1402/distributed-chat-app/controller"
+)
+
+// nextSeq assigns the next sequence number of the conversation through the state store
+// Implementation:
+// 1. The store holds the last assigned number of every conversation (seq:{conversation} in Redis)
+// 2. A missing counter (new conversation, or the store lost its data) is seeded from the
+// highest number in the conversation log, so numbers never go back
+// 3. Allocation is atomic (INCR with Redis), every server gets a distinct, increasing number
+func nextSeq(conversation string) (int64, error) {
+	return State.NextSeq(ctx, conversation, func() (int64, error) {
+		return controller.GetMaxSeq(conversation)
+	})
+}
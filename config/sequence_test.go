@@ -0,0 +1,99 @@
+package config
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/naman1402/distributed-chat-app/model"
+	"github.com/naman1402/distributed-chat-app/repository"
+)
+
+func TestNextSeqSeed(t *testing.T) {
+	mr := testServer(t, nil, nil)
+	for seq := int64(1); seq <= 5; seq++ {
+		m := model.ChatMessage{Id: "m" + string(rune('0'+seq)), Message: "hi", Sender: "alice", GroupName: "room1", Seq: seq}
+		if err := repository.Default.SaveGroup("group:room1", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a conversation without counter continues after its log
+	for want := int64(6); want <= 7; want++ {
+		if got, err := nextSeq("group:room1"); err != nil || got != want {
+			t.Fatalf("nextSeq = %d, %v, want %d", got, err, want)
+		}
+	}
+	// a lost counter is seeded again, numbers already taken but not logged are reused
+	mr.Del("seq:group:room1")
+	if got, _ := nextSeq("group:room1"); got != 6 {
+		t.Fatalf("after losing the counter: %d, want 6", got)
+	}
+	if got, _ := nextSeq("dm:alice:bob"); got != 1 {
+		t.Fatalf("new conversation: %d, want 1", got)
+	}
+}
+
+func TestNextSeqConcurrent(t *testing.T) {
+	testServer(t, nil, nil)
+	const n = 50
+	seqs := make([]int64, n)
+	var wg sync.WaitGroup
+	for i := range seqs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			seq, err := nextSeq("group:room1")
+			if err != nil {
+				t.Error(err)
+			}
+			seqs[i] = seq
+		}()
+	}
+	wg.Wait()
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for i, seq := range seqs {
+		if seq != int64(i+1) {
+			t.Fatalf("numbers %v, want 1 to %d once each", seqs, n)
+		}
+	}
+}
+
+// TestSeqOnlyForAcceptedMessages checks that rejected messages and retries take no number
+func TestSeqOnlyForAcceptedMessages(t *testing.T) {
+	testServer(t, []string{"alice", "bob"}, map[string][]string{"room1": {"bob"}})
+	alice := connect(t, "alice")
+	next := func() map[string]interface{} {
+		alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := alice.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := map[string]interface{}{}
+		json.Unmarshal(data, &frame)
+		return frame
+	}
+
+	send(t, alice, Message{Message: "", Receiver: "bob"})
+	send(t, alice, Message{Message: "hi", Group: true, GroupName: "room1"})
+	send(t, alice, Message{Message: "one", Receiver: "bob", ClientId: "c1"})
+	send(t, alice, Message{Message: "one", Receiver: "bob", ClientId: "c1"})
+	send(t, alice, Message{Message: "two", Receiver: "bob", ClientId: "c2"})
+	for _, reply := range []string{"invalid", "not a member"} {
+		if frame := next(); frame["type"] == AckEvent {
+			t.Fatalf("%s message acked: %v", reply, frame)
+		}
+	}
+	want := []struct {
+		clientId  string
+		seq       float64
+		duplicate interface{}
+	}{{"c1", 1, nil}, {"c1", 1, true}, {"c2", 2, nil}}
+	for _, w := range want {
+		frame := next()
+		if frame["type"] != AckEvent || frame["client_id"] != w.clientId || frame["seq"] != w.seq || frame["duplicate"] != w.duplicate {
+			t.Fatalf("got %v, want the ack of %s with seq %v", frame, w.clientId, w.seq)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/naman1402/distributed-chat-app/broker"
+	"github.com/naman1402/distributed-chat-app/repository"
+	"github.com/naman1402/distributed-chat-app/search"
+	"github.com/naman1402/distributed-chat-app/settings"
+	"github.com/naman1402/distributed-chat-app/state"
+	"github.com/redis/go-redis/v9"
+)
+
+// deliveryOnce starts the delivery goroutines of the test server, they run until the tests end
+var deliveryOnce sync.Once
+
+// keptBroker and keptRooms record Close instead of closing, the delivery goroutines of the test
+// server outlive a Drain
+type keptBroker struct {
+	broker.Broker
+	closed atomic.Bool
+}
+
+func (k *keptBroker) Close() error {
+	k.closed.Store(true)
+	return nil
+}
+
+type keptRooms struct {
+	broker.Rooms
+	closed atomic.Bool
+}
+
+func (k *keptRooms) Close() error {
+	k.closed.Store(true)
+	return nil
+}
+
+// testBroker and testRooms are the broker and room subscription of the test server
+var (
+	testBroker = &keptBroker{Broker: broker.NewMemory()}
+	testRooms  = &keptRooms{Rooms: broker.NewMemoryRooms()}
+)
+
+// testServer makes this package server S1 with the memory broker, a fresh repository and search index and
+// a state store in miniredis, returned for inspection
+// Users and rooms (name -> members) are created in the repository
+func testServer(t *testing.T, users []string, rooms map[string][]string) *miniredis.Miniredis {
+	deliveryOnce.Do(func() {
+		SERVERID = "S1"
+		limits = settings.Default().Limits
+		Broker = testBroker
+		Rooms = testRooms
+		go PubSub()
+		go RoomPubSub()
+		go Send()
+	})
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	State = state.Redis{Client: client}
+	for _, dep := range []*dependency{&stateUp, &brokerUp, &roomsUp} {
+		dep.set(nil)
+	}
+	testBroker.closed.Store(false)
+	testRooms.closed.Store(false)
+
+	repository.Default = repository.NewMemory()
+	search.Engine = search.NewMemoryIndex()
+	for _, user := range users {
+		if err := repository.Default.CreateUser("id-"+user, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for room, members := range rooms {
+		if err := repository.Default.CreateRoom("id-"+room, room); err != nil {
+			t.Fatal(err)
+		}
+		for _, member := range members {
+			if err := repository.Default.AddMember(room, member); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// PubSub subscribes in the background, nothing can be delivered before
+	waitFor(t, "the server subscription", subscriptionUp.Load)
+	return mr
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// dial opens a websocket connection of the user to the test server, as WSHandler does once
+// the user is authenticated; the connection is closed and its session ended at cleanup
+func dial(t *testing.T, user string) *websocket.Conn {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		s, err := NewClient(user, conn)
+		if err != nil {
+			CloseWS("Room subscription failed - please reconnect", conn)
+			return
+		}
+		ReceiveMessage(s, user)
+	}))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		// the session is ended (route, rooms) once the handler returns
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the connection of " + user + " did not end")
+		}
+		srv.Close()
+	})
+	return conn
+}
+
+// connect dials and waits until the connection is set up
+func connect(t *testing.T, user string) *websocket.Conn {
+	conn := dial(t, user)
+	// "ok" is written once the route is claimed and the rooms are entered
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "ok" {
+		t.Fatalf("%s not connected: %q %v", user, data, err)
+	}
+	return conn
+}
+
+// send writes the message as the client does
+func send(t *testing.T, conn *websocket.Conn, m Message) {
+	t.Helper()
+	if err := conn.WriteJSON(m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive reads until a message of the given type ("" for chat messages), skipping others
+// errors sent back to the client fail the test
+func receive(t *testing.T, conn *websocket.Conn, kind string) Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("no %q message: %v", kind, err)
+		}
+		if strings.Contains(string(data), `"message"`) {
+			t.Fatalf("error received: %s", data)
+		}
+		m := Message{}
+		if err := json.Unmarshal(data, &m); err == nil && m.Type == kind {
+			return m
+		}
+	}
+}
+
+// silent checks that nothing but the given types is written to conn for a short while
+// a read that timed out breaks the connection, so this is the last read of conn
+func silent(t *testing.T, conn *websocket.Conn, allowed ...string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		m := Message{}
+		json.Unmarshal(data, &m)
+		ok := false
+		for _, kind := range allowed {
+			ok = ok || m.Type == kind
+		}
+		if !ok {
+			t.Fatalf("unexpected message %s", data)
+		}
+	}
+}
+
+// getAs calls the handler with a GET of target by the logged in user and decodes the JSON reply into res
+func getAs(t *testing.T, handler gin.HandlerFunc, user, target string, res interface{}) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, target, nil)
+	c.Request.AddCookie(&http.Cookie{Name: "uid", Value: "id-" + user})
+	handler(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d %s", target, w.Code, w.Body)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,229 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/naman1402/distributed-chat-app/controller"
+	"github.com/naman1402/distributed-chat-app/metrics"
+	"github.com/naman1402/distributed-chat-app/model"
+)
+
+// maxReplay is the number of messages replayed per conversation and resume request
+// clients missing more send another resume from the last seq they received
+const maxReplay = 500
+
+// ResumePoint is the last message a client saw in a conversation
+// Conversation: "group:{room}" or "dm:{user}", as in unread events
+// Seq or Id: last seen sequence number, or last seen message id
+type ResumePoint struct {
+	Conversation string `json:"conversation"`
+	Seq          int64  `json:"seq,omitempty"`
+	Id           string `json:"id,omitempty"`
+}
+
+// session tracks the delivery state of a connected user
+// while replaying, live messages for the user are queued in pending instead of written,
+// replayed remembers which sequence numbers were replayed so their queued live copy is
+// dropped, it is emptied once the replay is done
+// mu guards the delivery state, writeMu serializes every write to the connection (see write)
+type session struct {
+	mu        sync.Mutex
+	writeMu   sync.Mutex
+	conn      *websocket.Conn
+	replaying bool
+	pending   []Message
+	replayed  map[string]map[int64]bool
+}
+
+var (
+	// sessions maps userId to the session of its current connection
+	sessions   = make(map[string]*session)
+	sessionsMu sync.RWMutex
+)
+
+// newSession replaces the session of the user with one bound to conn
+func newSession(userId string, conn *websocket.Conn) *session {
+	s := &session{conn: conn, replayed: make(map[string]map[int64]bool)}
+	sessionsMu.Lock()
+	sessions[userId] = s
+	sessionsMu.Unlock()
+	return s
+}
+
+// write sends one message on the session's connection
+// the connection supports a single concurrent writer, the read loop (acks, errors, replays)
+// and Send (deliveries) both write, so every write goes through here
+func (s *session) write(messageType int, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteMessage(messageType, data)
+}
+
+// endSession removes the user's session and route if they still belong to conn
+func endSession(userId string, conn *websocket.Conn) {
+	sessionsMu.Lock()
+	ended := false
+	if s := sessions[userId]; s != nil && s.conn == conn {
+		delete(sessions, userId)
+		ended = true
+	}
+	sessionsMu.Unlock()
+	if ended {
+		releaseRoute(userId)
+		leaveRooms(userId)
+	}
+}
+
+func getSession(userId string) *session {
+	sessionsMu.RLock()
+	defer sessionsMu.RUnlock()
+	return sessions[userId]
+}
+
+// deliver writes the message to the user's connection through its session
+// 1. During a replay the message is queued and written once the replay is done
+// 2. Otherwise the message (and its unread counts) is written
+func deliver(s *session, user string, m Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replaying {
+		s.pending = append(s.pending, m)
+		return nil
+	}
+	return writeMessage(s, user, m)
+}
+
+// wasReplayed reports whether the chat message was already sent by a replay, caller holds mu
+func (s *session) wasReplayed(m Message) bool {
+	if m.Type != "" {
+		return false
+	}
+	return s.replayed[controller.ConversationId(m.Sender, m.Receiver, m.GroupName)][m.Seq]
+}
+
+// writeMessage sends the message, chat messages are followed by the conversation's unread counts
+func writeMessage(s *session, user string, m Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	if err := s.write(websocket.TextMessage, data); err != nil {
+		return err
+	}
+	metrics.MessagesDelivered.WithLabelValues(messageType(m)).Inc()
+	if m.SentAt > 0 {
+		metrics.DeliveryLatency.WithLabelValues(messageType(m)).Observe(time.Since(time.UnixMilli(m.SentAt)).Seconds())
+	}
+	if m.Type == "" {
+		sendUnread(s, user, m)
+	}
+	return nil
+}
+
+// resume replays what the user missed and then switches back to live delivery
+// Implementation:
+// 1. Marks the session as replaying, live messages are queued from now on
+// 2. For each resume point the conversation log is read from the point's seq (or the seq
+// of the point's message id), for conversations the user participates in
+// 3. Replayed messages are written in seq order followed by a resumed event with the last seq
+// 4. Queued live messages are written, except those the replay already sent
+// 5. The replayed numbers are forgotten, so the session does not grow with every resume;
+// a live copy still arriving after that is written again (clients dedupe by seq)
+func resume(s *session, userId string, points []ResumePoint) {
+	s.mu.Lock()
+	s.replaying = true
+	s.mu.Unlock()
+
+	for _, point := range points {
+		replayConversation(s, userId, point)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	flushPending(s, userId)
+	s.replayed = make(map[string]map[int64]bool)
+	s.replaying = false
+}
+
+// flushPending writes the live messages queued during a replay, except those the replay
+// already sent, caller holds mu
+func flushPending(s *session, userId string) {
+	for _, m := range s.pending {
+		if s.wasReplayed(m) {
+			continue
+		}
+		if err := writeMessage(s, userId, m); err != nil {
+			fmt.Println(err)
+			break
+		}
+	}
+	s.pending = nil
+}
+
+// replayConversation writes the messages of one conversation after the resume point
+func replayConversation(s *session, userId string, point ResumePoint) {
+	conversation := controller.SharedConversation(userId, point.Conversation)
+	if !controller.IsConversationParticipant(userId, conversation) {
+		b, _ := json.Marshal(ErrMessage{Field: "conversation", Message: "cannot resume " + point.Conversation})
+		s.write(websocket.TextMessage, b)
+		return
+	}
+	after := point.Seq
+	if after == 0 && point.Id != "" {
+		after = controller.GetMessage(point.Id).Seq
+	}
+	records, err := controller.GetConversationLog(conversation, after, maxReplay)
+	if err != nil {
+		fmt.Println(err)
+	}
+	last := after
+	for _, record := range records {
+		m := fromRecord(record)
+		data, err := json.Marshal(m)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if err := s.write(websocket.TextMessage, data); err != nil {
+			fmt.Println(err)
+			return
+		}
+		s.mu.Lock()
+		if s.replayed[conversation] == nil {
+			s.replayed[conversation] = make(map[int64]bool)
+		}
+		s.replayed[conversation][m.Seq] = true
+		s.mu.Unlock()
+		last = m.Seq
+	}
+	data, _ := json.Marshal(Message{Type: ResumedEvent, Receiver: userId, Conversation: point.Conversation, Seq: last})
+	s.write(websocket.TextMessage, data)
+}
+
+// fromRecord converts a stored message back to the form it was delivered in
+func fromRecord(record model.ChatMessage) Message {
+	m := Message{
+		Id:          record.Id,
+		Message:     record.Message,
+		Sender:      record.Sender,
+		Receiver:    record.Receiver,
+		Group:       record.GroupName != "",
+		GroupName:   record.GroupName,
+		ReplyTo:     record.ReplyTo,
+		ThreadId:    record.ThreadId,
+		Mentions:    record.Mentions,
+		MentionRoom: record.MentionRoom,
+		Seq:         record.Seq,
+	}
+	for _, id := range record.Attachments {
+		if a := controller.GetAttachment(id); a.Id != "" {
+			m.Attachments = append(m.Attachments, controller.WithThumbnailUrl(a))
+		}
+	}
+	return m
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/naman1402/distributed-chat-app/model"
+	"github.com/naman1402/distributed-chat-app/repository"
+)
+
+// dmMessage is the seq-th message of alice to bob
+func dmMessage(seq int64) Message {
+	return Message{Id: "m" + string(rune('0'+seq)), Message: "hi", Sender: "alice", Receiver: "bob", Seq: seq}
+}
+
+func TestResumeDuringDelivery(t *testing.T) {
+	testServer(t, []string{"alice", "bob"}, nil)
+	for seq := int64(1); seq <= 3; seq++ {
+		if err := repository.Default.SavePrivate("dm:alice:bob", dmMessage(seq).record()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bob := connect(t, "bob")
+	s := getSession("bob")
+
+	// live copies arriving while the replay runs: 3 is also replayed, 4 is not logged yet
+	s.mu.Lock()
+	s.replaying = true
+	s.mu.Unlock()
+	for _, seq := range []int64{3, 4} {
+		if err := deliver(s, "bob", dmMessage(seq)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resume(s, "bob", []ResumePoint{{Conversation: "dm:alice", Seq: 1}})
+
+	for _, want := range []int64{2, 3} {
+		if got := receive(t, bob, ""); got.Seq != want {
+			t.Fatalf("replayed seq %d, want %d", got.Seq, want)
+		}
+	}
+	if done := receive(t, bob, ResumedEvent); done.Conversation != "dm:alice" || done.Seq != 3 {
+		t.Fatalf("resumed event %+v", done)
+	}
+	// the live copy of 3 is dropped, 4 follows the replay
+	if got := receive(t, bob, ""); got.Seq != 4 {
+		t.Fatalf("live seq %d after the replay, want 4", got.Seq)
+	}
+
+	s.mu.Lock()
+	replaying, pending, replayed := s.replaying, len(s.pending), len(s.replayed)
+	s.mu.Unlock()
+	if replaying || pending != 0 || replayed != 0 {
+		t.Fatalf("after the replay: replaying %v, %d pending, %d replayed conversations", replaying, pending, replayed)
+	}
+	// live delivery goes on as before the resume
+	deliver(s, "bob", dmMessage(5))
+	if got := receive(t, bob, ""); got.Seq != 5 {
+		t.Fatalf("live seq %d, want 5", got.Seq)
+	}
+}
+
+func TestResumeOtherConversation(t *testing.T) {
+	testServer(t, []string{"alice", "bob", "carol"}, nil)
+	if err := repository.Default.SavePrivate("dm:alice:bob", model.ChatMessage{Id: "m1", Message: "hi", Sender: "alice", Receiver: "bob", Seq: 1}); err != nil {
+		t.Fatal(err)
+	}
+	carol := connect(t, "carol")
+	s := getSession("carol")
+
+	// "dm:alice" of carol is the conversation of carol and alice, empty
+	resume(s, "carol", []ResumePoint{{Conversation: "dm:alice"}})
+	if done := receive(t, carol, ResumedEvent); done.Seq != 0 {
+		t.Fatalf("resumed event %+v, want nothing replayed", done)
+	}
+	silent(t, carol)
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/naman1402/distributed-chat-app/controller"
+)
+
+// draining is true once the server is shutting down, no new WebSocket connection is accepted
+var draining atomic.Bool
+
+// Draining reports whether the server is shutting down
+func Draining() bool {
+	return draining.Load()
+}
+
+// flushEvery is how often Drain checks that the received payloads were delivered
+const flushEvery = 10 * time.Millisecond
+
+// Drain closes every WebSocket connection and unregisters the server, within the deadline of ctx
+// Implementation:
+// 1. Stops accepting upgrades and chat messages from the clients, reports draining on /health,
+// the heartbeats stop renewing
+// 2. Flushes the outbound queues: waits until Send delivered the payloads received from the
+// broker, then writes the live messages sessions queued during a replay
+// 3. Sends each client a 1012 (service restart) close frame at a random time within jitter
+// 4. Releases the routes, rooms and mappings of the users, also those not closed in time
+// 5. Removes the server from the registry and closes the broker
+// The jitter keeps the clients from all reconnecting to the other servers at once, and the
+// close frame is written under the session lock, after the messages being delivered.
+func Drain(ctx context.Context, jitter time.Duration) {
+	draining.Store(true)
+	flushBroadcast(ctx)
+
+	sessionsMu.RLock()
+	closing := make(map[string]*session, len(sessions))
+	for user, s := range sessions {
+		closing[user] = s
+	}
+	sessionsMu.RUnlock()
+	log.Printf("draining %d connections", len(closing))
+	for user, s := range closing {
+		s.mu.Lock()
+		flushPending(s, user)
+		s.mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range closing {
+		wg.Add(1)
+		go func(s *session) {
+			defer wg.Done()
+			if jitter > 0 {
+				select {
+				case <-time.After(time.Duration(rand.Int63n(int64(jitter)))):
+				case <-ctx.Done():
+				}
+			}
+			closeSession(ctx, s, websocket.CloseServiceRestart, "server shutting down, reconnect")
+		}(s)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("drain deadline reached, closing the remaining connections")
+	}
+
+	for user, s := range closing {
+		s.conn.Close()
+		endSession(user, s.conn)
+		controller.ClearUser(user, SERVERID)
+	}
+	deregister()
+	if err := Rooms.Close(); err != nil {
+		log.Println(err)
+	}
+	if err := Broker.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+// flushBroadcast waits until Send handled every payload received so far, or until the
+// deadline of ctx. Payloads keep arriving until the server leaves the registry, those
+// received later are delivered while the close frames are sent
+func flushBroadcast(ctx context.Context) {
+	target := received.Load()
+	ticker := time.NewTicker(flushEvery)
+	defer ticker.Stop()
+	for delivered.Load() < target {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Printf("drain deadline reached, %d received payloads not delivered", target-delivered.Load())
+			return
+		}
+	}
+}
+
+// closeSession sends the client a close frame with code and text and closes its connection
+func closeSession(ctx context.Context, s *session, code int, text string) {
+	deadline := time.Now().Add(time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	cm := websocket.FormatCloseMessage(code, text)
+	s.mu.Lock()
+	err := s.conn.WriteControl(websocket.CloseMessage, cm, deadline)
+	s.mu.Unlock()
+	if err != nil {
+		log.Println(err)
+	}
+	s.conn.Close()
+}
+
+// deregister removes the lease and the user list of this server and unlists it
+func deregister() {
+	if err := State.Deregister(ctx, SERVERID); err != nil {
+		log.Println("server not unregistered: ", err)
+	}
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/naman1402/distributed-chat-app/broker"
+	"github.com/naman1402/distributed-chat-app/state"
+)
+
+// deregisterSpy records what was left of the sessions and the broker when the server was deregistered
+type deregisterSpy struct {
+	state.Store
+	sessionsLeft int
+	brokerClosed bool
+	deregistered bool
+}
+
+func (d *deregisterSpy) Deregister(ctx context.Context, serverId string) error {
+	d.sessionsLeft = len(localUsers())
+	d.brokerClosed = testBroker.closed.Load() || testRooms.closed.Load()
+	d.deregistered = true
+	return d.Store.Deregister(ctx, serverId)
+}
+
+func TestDrainOrder(t *testing.T) {
+	testServer(t, []string{"alice", "bob"}, nil)
+	t.Cleanup(func() { draining.Store(false) })
+	spy := &deregisterSpy{Store: State}
+	State = spy
+	if err := register(); err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := connect(t, "alice"), connect(t, "bob")
+
+	// a payload received for alice and a live message queued for bob during a replay
+	s := getSession("bob")
+	s.mu.Lock()
+	s.replaying = true
+	s.pending = append(s.pending, Message{Id: "m2", Message: "queued", Sender: "alice", Receiver: "bob", Seq: 2})
+	s.mu.Unlock()
+	data, _ := json.Marshal(Message{Id: "m1", Message: "received", Sender: "bob", Receiver: "alice", Seq: 1})
+	enqueue(broker.Delivery{Data: data})
+
+	drainCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	Drain(drainCtx, 0)
+
+	// both are written before the close frame
+	for conn, want := range map[*websocket.Conn]string{alice: "received", bob: "queued"} {
+		if got := receive(t, conn, ""); got.Message != want {
+			t.Fatalf("got %+v before the close frame, want %q", got, want)
+		}
+		closedWith(t, conn, websocket.CloseServiceRestart)
+	}
+	if !spy.deregistered || spy.sessionsLeft != 0 || spy.brokerClosed {
+		t.Fatalf("deregistered %v with %d sessions left, broker closed %v, want after every session ended and before the broker closed",
+			spy.deregistered, spy.sessionsLeft, spy.brokerClosed)
+	}
+	if alive, _ := State.Alive(ctx, SERVERID); alive {
+		t.Fatal("lease kept after Drain")
+	}
+	if routes, _ := State.GetRoutes(ctx, []string{"alice", "bob"}); len(routes) != 0 {
+		t.Fatalf("routes %v kept after Drain", routes)
+	}
+	if !testBroker.closed.Load() || !testRooms.closed.Load() {
+		t.Fatal("broker or rooms left open after Drain")
+	}
+	if !Draining() {
+		t.Fatal("not draining")
+	}
+}
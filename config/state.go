@@ -0,0 +1,30 @@
+package config
+
+import (
+	"github.com/naman1402/distributed-chat-app/settings"
+	"github.com/naman1402/distributed-chat-app/state"
+)
+
+// State holds the sequence numbers, client ids, unread ids, routes and server leases
+// shared by the servers, see SetupState
+var State state.Store
+
+// StateKind is the store selected by SetupState: redis or memory
+var StateKind string
+
+// SetupState selects the store of the shared state
+// - "memory" storage backend: in process, for a single server that runs without Redis
+// - any other backend: Redis, NPool must run first
+// Starts the monitor of the store for the readiness check, the server is degraded while
+// the store does not answer
+func SetupState(cfg settings.Storage) {
+	if cfg.Backend == "memory" {
+		StateKind = "memory"
+		State = state.NewMemory()
+	} else {
+		StateKind = "redis"
+		State = state.Redis{Client: Conn}
+	}
+	stateUp.set(State.Ping(ctx))
+	go monitorState()
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/naman1402/distributed-chat-app/model"
+	"github.com/naman1402/distributed-chat-app/repository"
+)
+
+// threadRepository sets a fresh in-memory repository with room1 (alice, bob), room2 (alice),
+// a root message of alice in each room, a private message of alice to bob and a reply of bob
+// to the room1 root
+func threadRepository(t *testing.T) {
+	repository.Default = repository.NewMemory()
+	rooms := map[string][]string{"room1": {"alice", "bob"}, "room2": {"alice"}}
+	for room, members := range rooms {
+		if err := repository.Default.CreateRoom("id-"+room, room); err != nil {
+			t.Fatal(err)
+		}
+		for _, member := range members {
+			if err := repository.Default.AddMember(room, member); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	messages := []model.ChatMessage{
+		{Id: "root1", Message: "hello", Sender: "alice", GroupName: "room1", Seq: 1},
+		{Id: "root2", Message: "hello", Sender: "alice", GroupName: "room2", Seq: 1},
+		{Id: "reply1", Message: "hi", Sender: "bob", GroupName: "room1", ReplyTo: "root1", ThreadId: "root1", Seq: 2},
+	}
+	for _, m := range messages {
+		if err := repository.Default.SaveGroup("group:"+m.GroupName, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repository.Default.SaveReply("root1", messages[2]); err != nil {
+		t.Fatal(err)
+	}
+	dm := model.ChatMessage{Id: "dm1", Message: "psst", Sender: "alice", Receiver: "bob", Seq: 1}
+	if err := repository.Default.SavePrivate("dm:alice:bob", dm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveThread(t *testing.T) {
+	tests := []struct {
+		name string
+		res  Message
+		// thread is the expected thread id, an empty thread expects an error on field
+		thread string
+		field  string
+	}{
+		{"reply to a root", Message{Sender: "bob", Group: true, GroupName: "room1", ReplyTo: "root1"}, "root1", ""},
+		{"reply to a reply joins the root thread", Message{Sender: "alice", Group: true, GroupName: "room1", ReplyTo: "reply1"}, "root1", ""},
+		{"private reply from the receiver", Message{Sender: "bob", Receiver: "alice", ReplyTo: "dm1"}, "dm1", ""},
+		{"unknown parent", Message{Sender: "bob", Group: true, GroupName: "room1", ReplyTo: "nope"}, "", "reply_to"},
+		{"parent in another room", Message{Sender: "alice", Group: true, GroupName: "room1", ReplyTo: "root2"}, "", "reply_to"},
+		{"group parent from a private message", Message{Sender: "bob", Receiver: "alice", ReplyTo: "root1"}, "", "reply_to"},
+		{"private parent from a group", Message{Sender: "bob", Group: true, GroupName: "room1", ReplyTo: "dm1"}, "", "reply_to"},
+		{"private parent of other users", Message{Sender: "bob", Receiver: "carol", ReplyTo: "dm1"}, "", "reply_to"},
+		{"sender not a member", Message{Sender: "bob", Group: true, GroupName: "room2", ReplyTo: "root2"}, "", "group_name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			threadRepository(t)
+			res := tt.res
+			errMsg := resolveThread(&res)
+			if tt.field != "" {
+				if errMsg == nil || errMsg.Field != tt.field {
+					t.Fatalf("got %v, want an error on %s", errMsg, tt.field)
+				}
+				if res.ThreadId != "" {
+					t.Fatalf("thread id %q set on a rejected reply", res.ThreadId)
+				}
+				return
+			}
+			if errMsg != nil {
+				t.Fatal(errMsg)
+			}
+			if res.ThreadId != tt.thread {
+				t.Fatalf("thread id %q, want %q", res.ThreadId, tt.thread)
+			}
+		})
+	}
+}
+
+func TestResolveThreadSubscribesRootAuthor(t *testing.T) {
+	threadRepository(t)
+	// first reply: the author of the root follows the thread
+	res := Message{Sender: "bob", Receiver: "alice", ReplyTo: "dm1"}
+	if errMsg := resolveThread(&res); errMsg != nil {
+		t.Fatal(errMsg)
+	}
+	subscribers, _ := repository.Default.Subscribers("dm1")
+	if !reflect.DeepEqual(subscribers, []string{"alice"}) {
+		t.Fatalf("subscribers %v, want [alice]", subscribers)
+	}
+
+	// once the thread has replies the author is not subscribed again, an unsubscribe sticks
+	if err := repository.Default.Unsubscribe("root1", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	res = Message{Sender: "bob", Group: true, GroupName: "room1", ReplyTo: "root1"}
+	if errMsg := resolveThread(&res); errMsg != nil {
+		t.Fatal(errMsg)
+	}
+	subscribers, _ = repository.Default.Subscribers("root1")
+	if len(subscribers) != 0 {
+		t.Fatalf("subscribers %v, want none", subscribers)
+	}
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/naman1402/distributed-chat-app/controller"
+)
+
+// maxTrackedUnread caps the unread ids kept per conversation, clients show "999+" past it
+const maxTrackedUnread = 1000
+
+// Unread tracking lives in the state store so every server sees the same counts, see
+// state.Unread; the last-read marker itself is persisted in the repository (last_read)
+
+// conversationKey identifies a conversation from the point of view of user
+// group chats: "group:{room}", private chats: "dm:{other user}"
+func conversationKey(m Message, user string) string {
+	if m.Group {
+		return "group:" + m.GroupName
+	}
+	if m.Sender == user {
+		return "dm:" + m.Receiver
+	}
+	return "dm:" + m.Sender
+}
+
+// trackUnread records a new message as unread for the recipient
+// 1. Adds the id to the conversation's unread set (and mention set when mentioned)
+// 2. Trims the sets to the newest maxTrackedUnread ids
+// 3. Registers the conversation for the recipient
+func trackUnread(user string, m Message, mentioned bool) {
+	if err := State.TrackUnread(ctx, user, conversationKey(m, user), m.Id, mentioned, maxTrackedUnread); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// unreadCounts returns the number of unread messages and unread mentions in the conversation
+func unreadCounts(user, conversation string) (int64, int64) {
+	unread, mentions, err := State.UnreadCounts(ctx, user, conversation)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return unread, mentions
+}
+
+// MarkRead moves the last-read marker of the conversation to messageId
+// everything up to and including messageId stops counting as unread
+// the user's connection receives the updated counts
+func MarkRead(user, conversation, messageId string) {
+	if err := State.MarkRead(ctx, user, conversation, messageId); err != nil {
+		fmt.Println(err)
+	}
+	controller.SetLastRead(user, conversation, messageId)
+	unread, mentions := unreadCounts(user, conversation)
+	notify(Message{
+		Type:         UnreadEvent,
+		Receiver:     user,
+		Conversation: conversation,
+		LastRead:     messageId,
+		Unread:       unread,
+		MentionCount: mentions,
+	})
+}
+
+// sendUnread writes the current counts of the message's conversation to the recipient's connection
+func sendUnread(s *session, user string, m Message) {
+	conversation := conversationKey(m, user)
+	unread, mentions := unreadCounts(user, conversation)
+	event := Message{
+		Type:         UnreadEvent,
+		Receiver:     user,
+		Conversation: conversation,
+		Unread:       unread,
+		MentionCount: mentions,
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	s.write(websocket.TextMessage, data)
+}
+
+// Conversations lists the user's conversations with last-read marker, unread and mention counts
+// the user is the logged in user (uid cookie)
+func Conversations(c *gin.Context) {
+	user, ok := controller.CurrentUser(c)
+	if !ok {
+		return
+	}
+	conversations, err := State.Conversations(ctx, user)
+	if err != nil {
+		controller.RespondInternal(c, "failed to load conversations", err)
+		return
+	}
+	lastRead := controller.GetLastRead(user)
+	res := []gin.H{}
+	for _, conversation := range conversations {
+		unread, mentions := unreadCounts(user, conversation)
+		res = append(res, gin.H{
+			"conversation": conversation,
+			"last_read":    lastRead[conversation],
+			"unread":       unread,
+			"mentions":     mentions,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"conversations": res})
+}
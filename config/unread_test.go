@@ -0,0 +1,104 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naman1402/distributed-chat-app/repository"
+)
+
+func TestUnreadAndLastRead(t *testing.T) {
+	mr := testServer(t, []string{"alice", "bob"}, map[string][]string{"room1": {"alice", "bob"}})
+	alice, bob := connect(t, "alice"), connect(t, "bob")
+
+	ids := []string{}
+	for i, text := range []string{"one", "two", "three"} {
+		send(t, alice, Message{Message: text, Receiver: "bob", ClientId: "c" + string(rune('1'+i))})
+		ids = append(ids, receive(t, alice, AckEvent).Id)
+		// every delivery is followed by the counts of the conversation
+		if unread := receive(t, bob, UnreadEvent); unread.Conversation != "dm:alice" || unread.Unread != int64(i+1) {
+			t.Fatalf("unread event %+v after %d messages", unread, i+1)
+		}
+	}
+	send(t, alice, Message{Message: "@bob look", Group: true, GroupName: "room1"})
+	send(t, alice, Message{Message: "no mention", Group: true, GroupName: "room1"})
+	// the events carry the counts when the message is delivered, the second message may
+	// already be counted in the first event
+	unread := receive(t, bob, UnreadEvent)
+	for unread.Conversation != "group:room1" || unread.Unread < 2 {
+		unread = receive(t, bob, UnreadEvent)
+	}
+	if unread.Unread != 2 || unread.MentionCount != 1 {
+		t.Fatalf("room unread event %+v, want 2 unread and 1 mention", unread)
+	}
+	if n, _ := mr.ZMembers("unread:bob:dm:alice"); len(n) != 3 {
+		t.Fatalf("unread set %v", n)
+	}
+
+	tests := []struct {
+		name         string
+		read         Message
+		conversation string
+		unread       int64
+		mentions     int64
+		// marker is the last-read marker stored for the conversation
+		marker string
+	}{
+		{"read up to a message", Message{Type: ReadEvent, Receiver: "alice", LastRead: ids[1]}, "dm:alice", 1, 0, ids[1]},
+		{"read a whole room", Message{Type: ReadEvent, Group: true, GroupName: "room1", LastRead: "zzzzzzzzzzzzzzzzzzzzzzzzzzz"}, "group:room1", 0, 0, "zzzzzzzzzzzzzzzzzzzzzzzzzzz"},
+		{"an older marker moves the marker, not the counts", Message{Type: ReadEvent, Receiver: "alice", LastRead: ids[0]}, "dm:alice", 1, 0, ids[0]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			send(t, bob, tt.read)
+			conversation := tt.conversation
+			got := receive(t, bob, UnreadEvent)
+			for got.LastRead == "" {
+				got = receive(t, bob, UnreadEvent)
+			}
+			if got.Conversation != conversation || got.LastRead != tt.read.LastRead || got.Unread != tt.unread || got.MentionCount != tt.mentions {
+				t.Fatalf("unread event %+v, want %d unread and %d mentions", got, tt.unread, tt.mentions)
+			}
+			if markers, _ := repository.Default.LastRead("bob"); markers[conversation] != tt.marker {
+				t.Fatalf("marker %q, want %q", markers[conversation], tt.marker)
+			}
+		})
+	}
+
+	// a read marker without last_read is rejected
+	send(t, bob, Message{Type: ReadEvent, Receiver: "alice"})
+	bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, data, err := bob.ReadMessage(); err != nil || !strings.Contains(string(data), `"field":"last_read"`) {
+		t.Fatalf("got %s %v, want the last_read error", data, err)
+	}
+
+	var res struct {
+		Conversations []struct {
+			Conversation string `json:"conversation"`
+			LastRead     string `json:"last_read"`
+			Unread       int64  `json:"unread"`
+			Mentions     int64  `json:"mentions"`
+		} `json:"conversations"`
+	}
+	getAs(t, Conversations, "bob", "/conversations", &res)
+	byConversation := map[string]int64{}
+	for _, c := range res.Conversations {
+		byConversation[c.Conversation] = c.Unread
+	}
+	if len(res.Conversations) != 2 || byConversation["dm:alice"] != 1 || byConversation["group:room1"] != 0 {
+		t.Fatalf("conversations %+v", res.Conversations)
+	}
+}
+
+// TestNewMessageIdOrder checks that ids sort in the order they were given, also within a second
+func TestNewMessageIdOrder(t *testing.T) {
+	last := ""
+	for i := 0; i < 1000; i++ {
+		id := newMessageId().String()
+		if id <= last {
+			t.Fatalf("id %s given after %s", id, last)
+		}
+		last = id
+	}
+}
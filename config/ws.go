@@ -7,13 +7,19 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	validation "github.com/go-ozzo/ozzo-validation"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/naman1402/distributed-chat-app/broker"
 	"github.com/naman1402/distributed-chat-app/controller"
-	"github.com/redis/go-redis/v9"
+	"github.com/naman1402/distributed-chat-app/metrics"
+	"github.com/naman1402/distributed-chat-app/model"
+	"github.com/naman1402/distributed-chat-app/settings"
 	"github.com/segmentio/ksuid"
 )
 
@@ -24,44 +30,126 @@ import (
 // Receiver: UserID of recipient (for private messages)
 // Group: Flag indicating if message is for group chat
 // GroupName: Name of the group for group messages
-// GroupMembers: List of users in the group
-// ServerId: ID of server handling the message
+// Type: Empty for chat messages, event name for notifications (always delivered to Receiver)
+// ReplyTo: Id of the message being replied to
+// ThreadId: Id of the root message of the thread the reply belongs to
+// ReplyCount: Number of replies in the thread after this message was saved
+// Mentions: Room members mentioned with @username (group messages, set by the server)
+// MentionRoom: Set when the message contains @room
+// Conversation: Conversation key of unread events ("group:{room}" or "dm:{user}")
+// LastRead: Id of the last read message (read requests and unread events)
+// Unread, MentionCount: Unread messages and unread mentions in Conversation
+// Attachments: Completed uploads of the sender, clients send ids, the server fills the metadata
+// Seq: Position of the message in its conversation, increasing by one per message, assigned at send time
+// Resume: Last seen message per conversation, sent by reconnecting clients
+// ClientId: Optional id chosen by the sender, retries with the same id are not sent twice
+// Duplicate: Set on acks of retries that were recognised
+// SentAt: When the sender's server accepted the message, in unix milliseconds
 type Message struct {
 	Id           string
-	Message      string   `json:"msg"`
-	Sender       string   `json:"sender"`
-	Receiver     string   `json:"receiver,omitempty"`
-	Group        bool     `json:"is_group"`
-	GroupName    string   `json:"group_name,omitempty"`
-	GroupMembers []string `json:"group_members,omitempty"`
-	ServerId     string   `json:"server_id,omitempty"`
+	Type         string             `json:"type,omitempty"`
+	Message      string             `json:"msg"`
+	Sender       string             `json:"sender"`
+	Receiver     string             `json:"receiver,omitempty"`
+	Group        bool               `json:"is_group"`
+	GroupName    string             `json:"group_name,omitempty"`
+	ReplyTo      string             `json:"reply_to,omitempty"`
+	ThreadId     string             `json:"thread_id,omitempty"`
+	ReplyCount   int                `json:"reply_count,omitempty"`
+	Mentions     []string           `json:"mentions,omitempty"`
+	MentionRoom  bool               `json:"mention_room,omitempty"`
+	Conversation string             `json:"conversation,omitempty"`
+	LastRead     string             `json:"last_read,omitempty"`
+	Unread       int64              `json:"unread,omitempty"`
+	MentionCount int64              `json:"mention_count,omitempty"`
+	Attachments  []model.Attachment `json:"attachments,omitempty"`
+	Seq          int64              `json:"seq,omitempty"`
+	Resume       []ResumePoint      `json:"resume,omitempty"`
+	ClientId     string             `json:"client_id,omitempty"`
+	Duplicate    bool               `json:"duplicate,omitempty"`
+	SentAt       int64              `json:"sent_at,omitempty"`
 }
 
-// ErrMessage defines the structure for error messages
-type ErrMessage struct {
-	Field   string `json:"field"`
-	Message string `json:"message"`
-}
+// event types carried in Message.Type
+const (
+	// ThreadReplyEvent notifies thread subscribers of a new reply
+	ThreadReplyEvent = "thread_reply"
+	// MentionEvent notifies a room member that they were mentioned
+	MentionEvent = "mention"
+	// UnreadEvent carries the unread and mention counts of a conversation
+	UnreadEvent = "unread"
+	// ReadEvent is sent by clients to move their last-read marker
+	ReadEvent = "read"
+	// ResumeEvent is sent by reconnecting clients to replay what they missed
+	ResumeEvent = "resume"
+	// ResumedEvent ends the replay of a conversation, Seq is the last replayed message
+	ResumedEvent = "resumed"
+	// AckEvent confirms a message sent with a client_id, Id is the server id
+	AckEvent = "ack"
+)
+
+// ErrMessage defines the structure for error messages, shared with the HTTP error responses
+type ErrMessage = model.FieldError
+
+// broadcastBuffer is the number of received payloads queued for Send, see the broadcast_backlog metric
+const broadcastBuffer = 1024
 
 // Global connection management variables
 var (
-	// broadcast acts as a message queue for Redis pub/sub messages
-	broadcast = make(chan *redis.Message)
+	// broadcast acts as a message queue for payloads received from the broker
+	broadcast = make(chan broker.Delivery, broadcastBuffer)
+	// received and delivered count the payloads put on broadcast and handled by Send,
+	// Drain compares them to wait for the payloads received before it started
+	received, delivered atomic.Int64
 
-	// clients maintains mapping of active user connections
-	// key: userId, value: websocket connection
-	clients = make(map[string]*websocket.Conn)
-
-	// upgrader configures WebSocket connection parameters
-	upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-	}
+	// upgrader configures WebSocket connection parameters, buffer sizes are set by Setup
+	upgrader = websocket.Upgrader{}
 
 	// SERVERID uniquely identifies this server instance in the distributed system
-	SERVERID string = ""
+	// it names the broker channel the server receives its messages on
+	SERVERID string
+
+	// limits bounds the messages clients can send, see Message.Validate
+	limits settings.Limits
+
+	// lastMessageId is the last id given by newMessageId
+	lastMessageId   ksuid.KSUID
+	lastMessageIdMu sync.Mutex
 )
 
+// newMessageId returns a message id greater than every id given before by this server
+// ksuids of the same second sort at random, unread tracking and read markers need ids to
+// sort in send order, so an id not above the last one is replaced by the one after it
+func newMessageId() ksuid.KSUID {
+	lastMessageIdMu.Lock()
+	defer lastMessageIdMu.Unlock()
+	id := ksuid.New()
+	if ksuid.Compare(id, lastMessageId) <= 0 {
+		id = lastMessageId.Next()
+	}
+	lastMessageId = id
+	return id
+}
+
+// Setup applies the server, WebSocket and limit settings, it must run before the
+// broker subscription and the WebSocket handler are started
+func Setup(server settings.Server, ws settings.WebSocket, l settings.Limits) {
+	SERVERID = server.ServerId
+	upgrader.ReadBufferSize = ws.ReadBufferSize
+	upgrader.WriteBufferSize = ws.WriteBufferSize
+	limits = l
+	model.MaxRoomNameLength = l.MaxGroupNameLength
+
+	metrics.GaugeFunc("websocket_connections", "WebSocket connections open on this server.", func() float64 {
+		sessionsMu.RLock()
+		defer sessionsMu.RUnlock()
+		return float64(len(sessions))
+	})
+	metrics.GaugeFunc("broadcast_backlog", "Payloads received from the broker and not yet delivered.", func() float64 {
+		return float64(len(broadcast))
+	})
+}
+
 // WSHandler establishes and manages WebSocket connections
 // 1. Extracts user ID from request
 // 2. Upgrades HTTP connection to WebSocket
@@ -73,6 +161,11 @@ var (
 //   - c: Gin context containing user information
 func WSHandler(w http.ResponseWriter, r *http.Request, c *gin.Context) {
 	userId := c.Query("id")
+	// while draining clients are sent elsewhere by the load balancer
+	if Draining() {
+		controller.RespondError(c, http.StatusServiceUnavailable, "server shutting down")
+		return
+	}
 	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
 	// upgrades to a websocket connection
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -86,8 +179,13 @@ func WSHandler(w http.ResponseWriter, r *http.Request, c *gin.Context) {
 		return
 	}
 	// Initializes client connection
-	NewClient(userId, conn)
-	ReceiveMessage(conn, userId)
+	s, err := NewClient(userId, conn)
+	if err != nil {
+		log.Println("room subscription failed: ", err)
+		CloseWS("Room subscription failed - please reconnect", conn)
+		return
+	}
+	ReceiveMessage(s, userId)
 }
 
 // ReceiveMessage processes incoming WebSocket messages
@@ -98,8 +196,9 @@ func WSHandler(w http.ResponseWriter, r *http.Request, c *gin.Context) {
 // 4. Routes messages to appropriate handlers (group/private)
 // 5. Persists messages to database
 // 6. Publishes to Redis for cross-server communication
-func ReceiveMessage(conn *websocket.Conn, userID string) {
-
+// Replies (errors, acks, replays) go through the session, as deliveries from Send do
+func ReceiveMessage(s *session, userID string) {
+	conn := s.conn
 	for {
 		_, msg, errCon := conn.ReadMessage()
 		if errCon != nil {
@@ -109,62 +208,166 @@ func ReceiveMessage(conn *websocket.Conn, userID string) {
 		var res Message
 		if err := json.Unmarshal(msg, &res); err != nil {
 			log.Println("error: " + err.Error())
-			MsgFailed(conn)
+			MsgFailed(s)
 			continue
 		}
-		id := ksuid.New()
+		id := newMessageId()
 		res.Id = id.String()
 		res.Sender = userID
+		res.SentAt = time.Now().UnixMilli()
+		// clients send chat messages, read markers and resume requests
+		if res.Type != ReadEvent && res.Type != ResumeEvent {
+			res.Type = ""
+		}
+		metrics.MessagesReceived.WithLabelValues(messageType(res)).Inc()
+		// read markers are not chat messages: {"type":"read","is_group":..,"group_name"/"receiver":..,"last_read":id}
+		if res.Type == ReadEvent {
+			if res.LastRead == "" {
+				b, _ := json.Marshal(ErrMessage{Field: "last_read", Message: "last_read is required"})
+				s.write(websocket.TextMessage, b)
+				continue
+			}
+			MarkRead(userID, conversationKey(res, userID), res.LastRead)
+			continue
+		}
+		// {"type":"resume","resume":[{"conversation":"group:room1","seq":41}]} replays missed messages
+		if res.Type == ResumeEvent {
+			resume(s, userID, res.Resume)
+			continue
+		}
+		// fields owned by the server are never taken from the client
+		res.Type, res.ThreadId, res.ReplyCount = "", "", 0
+		res.Mentions, res.MentionRoom = nil, false
+		res.Conversation, res.LastRead, res.Unread, res.MentionCount = "", "", 0, 0
+		res.Seq, res.Resume, res.Duplicate = 0, nil, false
 		err := res.Validate()
 		if err != nil {
 			b, _ := json.Marshal(err)
-			conn.WriteMessage(websocket.TextMessage, b)
+			s.write(websocket.TextMessage, b)
+			continue
+		}
+		// nothing is accepted while shutting down, the client retries on the server it reconnects to
+		if Draining() {
+			b, _ := json.Marshal(ErrMessage{Field: "server", Message: "server shutting down, please reconnect and retry"})
+			s.write(websocket.TextMessage, b)
+			continue
+		}
+		// nothing is saved while the broker is unavailable, the client is told to retry
+		if Degraded() {
+			b, _ := json.Marshal(ErrMessage{Field: "server", Message: "messaging is temporarily unavailable, please retry"})
+			s.write(websocket.TextMessage, b)
+			continue
+		}
+		// only members of a room can post in it, checked before anything is threaded or saved
+		if res.Group && !controller.IsRoomMember(res.GroupName, res.Sender) {
+			b, _ := json.Marshal(notMember)
+			s.write(websocket.TextMessage, b)
+			continue
+		}
+		if len(res.Attachments) > 0 {
+			if errMsg := resolveAttachments(&res); errMsg != nil {
+				b, _ := json.Marshal(errMsg)
+				s.write(websocket.TextMessage, b)
+				continue
+			}
+		}
+		// replies are attached to the thread of their parent, which must be in the same conversation
+		if res.ReplyTo != "" {
+			if errMsg := resolveThread(&res); errMsg != nil {
+				b, _ := json.Marshal(errMsg)
+				s.write(websocket.TextMessage, b)
+				continue
+			}
+		}
+		// retries carrying an already used client_id are acked with the original ids and dropped
+		clientId := res.ClientId
+		res.ClientId = ""
+		if clientId != "" {
+			originalId, originalSeq, err := claimClientId(res.Sender, clientId, res.Id)
+			if err != nil {
+				log.Println("dedupe error: ", err)
+				MsgFailed(s)
+				continue
+			}
+			if originalId != "" {
+				ack(s, clientId, originalId, originalSeq, true)
+				continue
+			}
+		}
+		// ordering: every message of a conversation gets the next sequence number, taken only now
+		// that the message is accepted; a failed save below leaves a gap (see README)
+		seq, err := nextSeq(controller.ConversationId(res.Sender, res.Receiver, res.GroupName))
+		if err != nil {
+			log.Println("sequence error: ", err)
+			failSend(s, res.Sender, clientId)
 			continue
 		}
+		res.Seq = seq
+		if clientId != "" {
+			recordClientSeq(res.Sender, clientId, res.Id, seq)
+		}
 
-		// saves the message in db and get members of the groupname
-		// for all members stored their serverid to member mapping
-		// using loop, iterate through all servers and publish the message on redis client
+		// saves the message in db and get members of the groupname (mentions, inbox, unread counts)
+		// and publishes it on the room's channel
 		if res.Group {
-			controller.SaveMessageGroupChat(res.Id, res.Message, res.Sender, res.GroupName)
 			members := controller.GetMembersFromRoom(res.GroupName)
-			servers := make(map[string][]string)
-			for _, member := range members {
-				serverId := controller.GetServerId(member)
-				servers[serverId] = append(servers[serverId], member)
+			res.Mentions, res.MentionRoom = parseMentions(res.Message, members)
+			if err := controller.SaveMessageGroupChat(res.record()); err != nil {
+				log.Println("save error: ", err)
+				failSend(s, res.Sender, clientId)
+				continue
 			}
-
-			for key, element := range servers {
-				res.ServerId = key
-				res.GroupMembers = element
-				jsonData, err := json.Marshal(res)
-				if err != nil {
-					fmt.Println(err)
-					return
+			saveThreadReply(&res)
+			updateInbox(res, members)
+			for _, member := range members {
+				if member != res.Sender {
+					trackUnread(member, res, res.MentionRoom || isMentioned(res.Mentions, member))
 				}
-				fmt.Println("redis key ", key)
-				//////////////////////////////////////////////////////
-				// used to send messages to a specified Redis channel//
-				/////////////////////////////////////////////////////
-				// ctx is the context for the operaion, key is the name of Redis channel(serverid) to which the message will be published
-				// jsonData is message we want to send
-				Conn.Publish(ctx, key, jsonData)
+			}
+			jsonData, err := json.Marshal(res)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			// published once on the room's channel, every server with members of the room
+			// online receives it and delivers it to them
+			publishRoom(res.GroupName, jsonData)
+			notifyThread(res)
+			notifyMentions(res, members)
+			if clientId != "" {
+				ack(s, clientId, res.Id, res.Seq, false)
 			}
 			continue
 		}
 		// logic to execute private chat, publishing message on redis Client
-		controller.SaveMessagePrivateChat(res.Id, res.Message, res.Sender, res.Receiver)
-		serverId := controller.GetServerId(res.Receiver)
+		if err := controller.SaveMessagePrivateChat(res.record()); err != nil {
+			log.Println("save error: ", err)
+			failSend(s, res.Sender, clientId)
+			continue
+		}
+		saveThreadReply(&res)
+		updateInbox(res, []string{res.Sender, res.Receiver})
+		trackUnread(res.Receiver, res, false)
+		serverId := lookupRoute(res.Receiver)
 		jsonData, err := json.Marshal(res)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
-		Conn.Publish(ctx, serverId, jsonData)
+		if serverId != "" {
+			publish(serverId, messageType(res), jsonData)
+		} else {
+			metrics.MessagesDroppedOffline.WithLabelValues(messageType(res)).Inc()
+		}
+		notifyThread(res)
+		if clientId != "" {
+			ack(s, clientId, res.Id, res.Seq, false)
+		}
 	}
 
+	endSession(userID, conn)
 	cm := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "connection closing")
-	if err := conn.WriteMessage(websocket.CloseMessage, cm); err != nil {
+	if err := s.write(websocket.CloseMessage, cm); err != nil {
 		fmt.Println(err)
 		return
 	}
@@ -172,16 +375,35 @@ func ReceiveMessage(conn *websocket.Conn, userID string) {
 	conn.Close()
 }
 
-// stores the user in db, id -> conn mapping, sends ack message ok to newly connected client
+// failSend tells the client its message was not sent and releases its client id,
+// so that a retry is not taken for a duplicate
+func failSend(s *session, sender, clientId string) {
+	if clientId != "" {
+		releaseClientId(sender, clientId)
+	}
+	MsgFailed(s)
+}
+
+// stores the user in db, starts its session, sends ack message ok to newly connected client
 // NewClient registers a new WebSocket client connection
-// 1. Records user-server mapping in database
-// 2. Stores WebSocket connection in memory
+// 1. Records user-server mapping in database (durable copy) and the route in Redis
+// 2. Starts a delivery session holding the connection (also used to resume after
+// reconnecting) and subscribes to the user's rooms
 // 3. Sends connection acknowledgment
-func NewClient(userId string, conn *websocket.Conn) {
+// If the rooms cannot be subscribed the session, route and mapping are removed again and
+// the error is returned, the caller closes the connection
+func NewClient(userId string, conn *websocket.Conn) (*session, error) {
 
 	controller.SetUser(userId, SERVERID)
-	clients[userId] = conn
-	clients[userId].WriteMessage(websocket.TextMessage, []byte("ok"))
+	s := newSession(userId, conn)
+	claimRoute(userId)
+	if err := enterRooms(userId); err != nil {
+		endSession(userId, conn)
+		controller.ClearUser(userId, SERVERID)
+		return nil, err
+	}
+	s.write(websocket.TextMessage, []byte("ok"))
+	return s, nil
 }
 
 /*
@@ -194,47 +416,70 @@ send private message(json) to recevier conn
 // Send implements the message distribution system
 // 1. Listens to Redis broadcast channel
 // 2. Deserializes incoming messages
-// 3. Routes to group/private message handlers
+// 3. Routes to group/private message handlers, room_joined events update the room subscriptions
 // 4. Handles offline user scenarios
+// 5. Acknowledges the payload to the broker once handled, see broker.Delivery
 func Send() {
 	for {
 
-		msg := <-broadcast
-		message := Message{}
-		err := json.Unmarshal([]byte(msg.Payload), &message)
-		if err != nil {
-			panic(err)
-		}
-		if message.Group {
-			groupMessage(message)
-			continue
-		}
-		client := clients[message.Receiver]
-		if client == nil {
-			fmt.Println("Reciever offline")
-			continue
-		}
-		privateMessage(message, client)
+		d := <-broadcast
+		dispatch(d.Data)
+		d.Ack()
+		delivered.Add(1)
 	}
 }
 
+// enqueue puts a payload received from the broker on broadcast for Send
+func enqueue(d broker.Delivery) {
+	received.Add(1)
+	broadcast <- d
+}
+
+// dispatch delivers one payload received from the broker to the users connected here
+func dispatch(msg []byte) {
+	message := Message{}
+	err := json.Unmarshal(msg, &message)
+	if err != nil {
+		// a payload no server can read, it is dropped (and acknowledged) so Send keeps going
+		log.Println("malformed broker payload: ", err)
+		return
+	}
+	if message.Group && message.Type == "" {
+		groupMessage(message)
+		return
+	}
+	if message.Type == RoomJoinedEvent {
+		roomJoined(message)
+		return
+	}
+	s := getSession(message.Receiver)
+	if s == nil {
+		fmt.Println("Reciever offline")
+		metrics.MessagesDroppedOffline.WithLabelValues(messageType(message)).Inc()
+		return
+	}
+	privateMessage(message, s)
+}
+
 /*
 *
 declares empty message, loop for all member. get their connection (client) and check if connection is online or not
-sets attributes of response message, use marshal to convert res into json data and sends using client(conn).WriteMessage to member
-after sending, remove receiver from clients and close respective connection
+sets attributes of response message, use marshal to convert res into json data and sends it through the member's session
+if sending fails, close the member's connection, its read loop ends the session
 */
 // groupMessage implements group chat message distribution
 // 1. Creates a new message instance for each recipient
 // 2. Checks recipient connection status
-// 3. Delivers message to all online group members
+// 3. Delivers message to the group members connected to this server (held back while they resume)
 // 4. Handles connection failures and cleanup
+// 5. Pushes the room's updated unread counts to each member
 func groupMessage(message Message) {
 	res := Message{}
-	for _, member := range message.GroupMembers {
-		client := clients[member]
-		if client == nil {
+	for _, member := range localMembers(message.GroupName) {
+		s := getSession(member)
+		if s == nil {
 			fmt.Println("Reciever offline")
+			metrics.MessagesDroppedOffline.WithLabelValues(messageType(message)).Inc()
 			continue
 		}
 
@@ -243,40 +488,201 @@ func groupMessage(message Message) {
 		res.Message = message.Message
 		res.Group = message.Group
 		res.GroupName = message.GroupName
-		data, err := json.Marshal(res)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+		res.ReplyTo = message.ReplyTo
+		res.ThreadId = message.ThreadId
+		res.ReplyCount = message.ReplyCount
+		res.Mentions = message.Mentions
+		res.MentionRoom = message.MentionRoom
+		res.Attachments = message.Attachments
+		res.Seq = message.Seq
+		res.SentAt = message.SentAt
 		// send message using websocket connection
-		err = client.WriteMessage(websocket.TextMessage, []byte(data))
-		if err != nil {
-			delete(clients, message.Receiver)
-			client.Close()
+		if err := deliver(s, member, res); err != nil {
+			s.conn.Close()
 		}
 	}
 }
 
 /*
 *
-directly to specific user, marshal data into jsonData and send using client.WriteMessage()
+directly to specific user, marshal data into jsonData and send it through the user's session
 */
 // privateMessage handles one-to-one message delivery
 // 1. Serializes message to JSON
-// 2. Delivers to recipient's WebSocket connection
+// 2. Delivers to recipient's WebSocket connection (held back while it resumes)
 // 3. Handles connection errors and cleanup
-func privateMessage(message Message, client *websocket.Conn) {
-	jsonData, err := json.Marshal(message)
+// 4. Pushes the conversation's updated unread counts
+func privateMessage(message Message, s *session) {
+	// TO WRITE MESSAGE we send message using websocket connection
+	if err := deliver(s, message.Receiver, message); err != nil {
+		s.conn.Close()
+	}
+}
+
+// resolveAttachments replaces the attachment ids sent by the client with their metadata
+// every attachment must be a completed upload of the sender for this conversation
+func resolveAttachments(res *Message) *ErrMessage {
+	conversation := controller.ConversationId(res.Sender, res.Receiver, res.GroupName)
+	for i, attachment := range res.Attachments {
+		a := controller.GetAttachment(attachment.Id)
+		if a.Id == "" || !a.Complete || a.Uploader != res.Sender || a.Conversation != conversation {
+			return &ErrMessage{Field: "attachments", Message: "attachment " + attachment.Id + " is not available"}
+		}
+		res.Attachments[i] = controller.WithThumbnailUrl(a)
+	}
+	return nil
+}
+
+// record converts the message to its stored form
+func (m Message) record() model.ChatMessage {
+	attachments := []string{}
+	for _, attachment := range m.Attachments {
+		attachments = append(attachments, attachment.Id)
+	}
+	return model.ChatMessage{
+		Id:          m.Id,
+		Message:     m.Message,
+		Sender:      m.Sender,
+		Receiver:    m.Receiver,
+		GroupName:   m.GroupName,
+		ReplyTo:     m.ReplyTo,
+		ThreadId:    m.ThreadId,
+		Mentions:    m.Mentions,
+		MentionRoom: m.MentionRoom,
+		Attachments: attachments,
+		Seq:         m.Seq,
+	}
+}
+
+// notMember is sent back for group messages and replies from users who did not join the room
+var notMember = ErrMessage{Field: "group_name", Message: "not a member of the room"}
+
+// resolveThread validates the parent of a reply and sets the thread id
+// 1. Sender of a group reply must be a member of the room
+// 2. Parent must exist in private_chat or group_chat
+// 3. Parent must belong to the same conversation (same room, or same pair of users)
+// 4. Thread id is the parent's thread id, or the parent itself when it is the root
+// The author of the root is subscribed when the first reply arrives
+func resolveThread(res *Message) *ErrMessage {
+	if res.Group && !controller.IsRoomMember(res.GroupName, res.Sender) {
+		return &notMember
+	}
+	parent := controller.GetMessage(res.ReplyTo)
+	if parent.Id == "" {
+		return &ErrMessage{Field: "reply_to", Message: "parent message not found"}
+	}
+	sameConversation := parent.GroupName == res.GroupName
+	if !res.Group {
+		sameConversation = parent.GroupName == "" &&
+			((parent.Sender == res.Sender && parent.Receiver == res.Receiver) ||
+				(parent.Sender == res.Receiver && parent.Receiver == res.Sender))
+	}
+	if !sameConversation {
+		return &ErrMessage{Field: "reply_to", Message: "parent message belongs to another conversation"}
+	}
+	res.ThreadId = parent.ThreadId
+	if res.ThreadId == "" {
+		res.ThreadId = parent.Id
+		if controller.GetReplyCount(parent.Id) == 0 {
+			controller.SubscribeThread(parent.Id, parent.Sender)
+		}
+	}
+	return nil
+}
+
+// saveThreadReply stores a reply in its thread and sets the updated reply count on the message
+func saveThreadReply(res *Message) {
+	if res.ThreadId == "" {
+		return
+	}
+	controller.SaveThreadReply(res.ThreadId, res.Id, res.Message, res.Sender, res.ReplyTo)
+	res.ReplyCount = controller.GetReplyCount(res.ThreadId)
+}
+
+// notifyThread sends a thread_reply event to every subscriber of the thread except the sender
+// events go through the same server routing as private messages
+func notifyThread(res Message) {
+	if res.ThreadId == "" {
+		return
+	}
+	for _, subscriber := range controller.GetThreadSubscribers(res.ThreadId) {
+		if subscriber == res.Sender {
+			continue
+		}
+		event := Message{
+			Id:         res.Id,
+			Type:       ThreadReplyEvent,
+			Message:    res.Message,
+			Sender:     res.Sender,
+			Receiver:   subscriber,
+			Group:      res.Group,
+			GroupName:  res.GroupName,
+			ReplyTo:    res.ReplyTo,
+			ThreadId:   res.ThreadId,
+			ReplyCount: res.ReplyCount,
+			Seq:        res.Seq,
+			SentAt:     res.SentAt,
+		}
+		notify(event)
+	}
+}
+
+// notifyMentions stores the message in the mentions inbox of every mentioned member
+// and sends them a mention event, @room targets every member of the room
+// the sender is never notified about their own message
+func notifyMentions(res Message, members []string) {
+	targets := res.Mentions
+	if res.MentionRoom {
+		targets = members
+	}
+	for _, member := range targets {
+		if member == res.Sender {
+			continue
+		}
+		controller.SaveMention(member, res.Id, res.Message, res.Sender, res.GroupName)
+		event := Message{
+			Id:          res.Id,
+			Type:        MentionEvent,
+			Message:     res.Message,
+			Sender:      res.Sender,
+			Receiver:    member,
+			Group:       true,
+			GroupName:   res.GroupName,
+			ThreadId:    res.ThreadId,
+			Mentions:    res.Mentions,
+			MentionRoom: res.MentionRoom,
+			Seq:         res.Seq,
+			SentAt:      res.SentAt,
+		}
+		notify(event)
+	}
+}
+
+// notify publishes an event on the redis channel of the server the receiver is connected to
+func notify(event Message) {
+	serverId := lookupRoute(event.Receiver)
+	if serverId == "" {
+		metrics.MessagesDroppedOffline.WithLabelValues(messageType(event)).Inc()
+		return
+	}
+	jsonData, err := json.Marshal(event)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	// TO WRITE MESSAGE we send message using websocket connection
-	err = client.WriteMessage(websocket.TextMessage, []byte(jsonData))
-	if err != nil {
-		delete(clients, message.Receiver)
-		client.Close()
+	publish(serverId, messageType(event), jsonData)
+}
+
+// messageType is the type label of the message in metrics: the event name,
+// or group or private for chat messages
+func messageType(m Message) string {
+	if m.Type != "" {
+		return m.Type
+	}
+	if m.Group {
+		return "group"
 	}
+	return "private"
 }
 
 // CloseWS performs graceful WebSocket connection termination
@@ -292,10 +698,10 @@ func CloseWS(msg string, conn *websocket.Conn) {
 
 // MsgFailed notifies client of message delivery failure
 // Sends standardized error JSON response
-func MsgFailed(conn *websocket.Conn) {
+func MsgFailed(s *session) {
 
 	msg := `{"message": "Failed to send message"}`
-	if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+	if err := s.write(websocket.TextMessage, []byte(msg)); err != nil {
 		fmt.Println(err)
 		return
 	}
@@ -303,21 +709,35 @@ func MsgFailed(conn *websocket.Conn) {
 
 // Validate implements message validation rules
 // Validates:
-// - Message content: Required, non-empty, length 1-1000 chars
+// - Message content: Required, non-empty, at most MaxMessageLength chars (may be empty when attachments are sent)
 // - Group flag: Must be non-nil
-// - Group name: Length 1-25 chars when present
+// - Group name: At most MaxGroupNameLength chars when present
+// - Client id: Length 1-64 chars when present
+// - Attachments: At most MaxAttachments
 func (m Message) Validate() error {
+	msgRules := []validation.Rule{
+		validation.Required.Error("msg field is required"),
+		validation.NotNil.Error("msg field cannot be empty"),
+		validation.Length(1, limits.MaxMessageLength).Error(fmt.Sprintf("character length should be between 1 and %d", limits.MaxMessageLength)),
+	}
+	if len(m.Attachments) > 0 {
+		msgRules = []validation.Rule{
+			validation.Length(0, limits.MaxMessageLength).Error(fmt.Sprintf("character length should be at most %d", limits.MaxMessageLength)),
+		}
+	}
 	return validation.ValidateStruct(&m,
-		validation.Field(&m.Message,
-			validation.Required.Error("msg field is required"),
-			validation.NotNil.Error("msg field cannot be empty"),
-			validation.Length(1, 1000).Error("character length should be between 1 and 1000"),
-		),
+		validation.Field(&m.Message, msgRules...),
 		validation.Field(&m.Group,
 			validation.NotNil.Error("is_group field cannot be empty"),
 		),
 		validation.Field(&m.GroupName,
-			validation.Length(1, 25).Error("character length should be between 1 and 25"),
+			validation.Length(1, limits.MaxGroupNameLength).Error(fmt.Sprintf("character length should be between 1 and %d", limits.MaxGroupNameLength)),
+		),
+		validation.Field(&m.ClientId,
+			validation.Length(1, 64).Error("character length should be between 1 and 64"),
+		),
+		validation.Field(&m.Attachments,
+			validation.Length(0, limits.MaxAttachments).Error(fmt.Sprintf("at most %d attachments per message", limits.MaxAttachments)),
 		),
 	)
 }
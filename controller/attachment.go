@@ -0,0 +1,457 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/naman1402/distributed-chat-app/blob"
+	"github.com/naman1402/distributed-chat-app/media"
+	"github.com/naman1402/distributed-chat-app/model"
+	"github.com/naman1402/distributed-chat-app/repository"
+	"github.com/naman1402/distributed-chat-app/search"
+	"github.com/naman1402/distributed-chat-app/settings"
+	"github.com/segmentio/ksuid"
+)
+
+// upload and download limits
+const (
+	// MaxAttachmentSize is the largest file that can be attached to a message
+	MaxAttachmentSize = 25 << 20
+	// maxChunkSize is the largest body accepted by a single PATCH
+	maxChunkSize = 5 << 20
+	// linkExpiry is how long a download link stays valid
+	linkExpiry = 15 * time.Minute
+)
+
+// allowedMimeTypes lists the media types that can be uploaded, both declared and sniffed
+var allowedMimeTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"video/mp4":       true,
+	"audio/mpeg":      true,
+	"audio/wave":      true,
+	"application/pdf": true,
+	"application/zip": true,
+	"text/plain":      true,
+}
+
+// linkSecret signs download links, every server must share the attachment secret
+// for links to be valid behind the load balancer, see SetupAttachments
+var linkSecret []byte
+
+// SetupAttachments sets the key signing download links
+// without a configured secret a random key is used and links only work on this server
+func SetupAttachments(cfg settings.Attachments) {
+	if cfg.Secret != "" {
+		linkSecret = []byte(cfg.Secret)
+		return
+	}
+	log.Println("attachment secret not set, download links are only valid on this server")
+	linkSecret = make([]byte, 32)
+	rand.Read(linkSecret)
+}
+
+// ConversationId returns the conversation shared by the participants, see search.GroupConversation
+func ConversationId(sender, receiver, groupName string) string {
+	if groupName != "" {
+		return search.GroupConversation(groupName)
+	}
+	return search.PrivateConversation(sender, receiver)
+}
+
+// IsConversationParticipant checks username against a "group:{room}" or "dm:{user}:{user}" id
+func IsConversationParticipant(username, conversation string) bool {
+	if room, ok := strings.CutPrefix(conversation, "group:"); ok {
+		return IsRoomMember(room, username)
+	}
+	users := strings.Split(strings.TrimPrefix(conversation, "dm:"), ":")
+	return len(users) == 2 && (users[0] == username || users[1] == username)
+}
+
+// GetAttachment loads an attachment, Id is "" if it does not exist
+func GetAttachment(id string) model.Attachment {
+	a, err := repository.Default.GetAttachment(id)
+	if err != nil {
+		return model.Attachment{}
+	}
+	return a
+}
+
+// baseMimeType strips parameters ("text/plain; charset=utf-8" -> "text/plain")
+func baseMimeType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// chunkKey orders chunk blobs of an upload by offset
+func chunkKey(id string, offset int64) string {
+	return fmt.Sprintf("uploads/%s/%020d", id, offset)
+}
+
+// CreateUpload starts a resumable upload
+// Implementation:
+// 1. Validates filename, declared size and MIME type against the limits
+// 2. Checks the uploader is a participant of the target conversation
+// 3. Stores the upload state with offset 0
+// Response: 201 with the attachment id and the maximum chunk size
+func CreateUpload(c *gin.Context) {
+	username, ok := CurrentUser(c)
+	if !ok {
+		return
+	}
+	req := model.UploadReq{}
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.Filename == "" || len(req.Filename) > 255 {
+		respondError(c, http.StatusBadRequest, "invalid upload", model.FieldError{Field: "filename", Message: "character length should be between 1 and 255"})
+		return
+	}
+	if req.Size < 1 || req.Size > MaxAttachmentSize {
+		respondError(c, http.StatusRequestEntityTooLarge, "invalid upload", model.FieldError{Field: "size", Message: fmt.Sprintf("size should be between 1 and %d bytes", MaxAttachmentSize)})
+		return
+	}
+	mimeType := baseMimeType(req.MimeType)
+	if !allowedMimeTypes[mimeType] {
+		respondError(c, http.StatusUnsupportedMediaType, "invalid upload", model.FieldError{Field: "mime_type", Message: "file type not allowed"})
+		return
+	}
+	conversation := ConversationId(username, req.Receiver, req.GroupName)
+	if (req.GroupName == "" && req.Receiver == "") || !IsConversationParticipant(username, conversation) {
+		respondError(c, http.StatusForbidden, "not a participant of this conversation")
+		return
+	}
+	id := ksuid.New().String()
+	a := model.Attachment{Id: id, Filename: req.Filename, MimeType: mimeType, Size: req.Size, Uploader: username, Conversation: conversation}
+	if err := repository.Default.CreateAttachment(a); err != nil {
+		respondInternal(c, "failed to create upload", err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"id": id, "offset": 0, "chunk_size": maxChunkSize})
+}
+
+// UploadStatus reports how many bytes of the upload were received (HEAD, tus style)
+// headers: Upload-Offset, Upload-Length
+func UploadStatus(c *gin.Context) {
+	username, ok := CurrentUser(c)
+	if !ok {
+		return
+	}
+	a := GetAttachment(c.Param("attachment_id"))
+	if a.Id == "" || a.Uploader != username {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(a.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(a.Size, 10))
+	c.Status(http.StatusOK)
+}
+
+// UploadChunk appends the request body to the upload (PATCH, tus style)
+// Implementation:
+// 1. Upload-Offset header must match the stored offset, otherwise 409 with the current offset
+// 2. The chunk is stored as its own blob so any server can accept the next one
+// 3. The offset is moved only if it did not change (a lightweight transaction on Cassandra),
+// a concurrent PATCH loses with 409
+// 4. After the last chunk the blob is assembled, its content type sniffed and the upload completed
+// 5. If completing failed on the blob store, a PATCH at the declared size with an empty body
+// completes it again; content that cannot be accepted discards the chunks and resets the offset
+func UploadChunk(c *gin.Context) {
+	username, ok := CurrentUser(c)
+	if !ok {
+		return
+	}
+	a := GetAttachment(c.Param("attachment_id"))
+	if a.Id == "" || a.Uploader != username {
+		respondError(c, http.StatusNotFound, "upload not found")
+		return
+	}
+	if a.Complete {
+		respondOffsetConflict(c, "upload already complete", a.Offset)
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset != a.Offset {
+		respondOffsetConflict(c, "offset mismatch", a.Offset)
+		return
+	}
+	chunk, err := io.ReadAll(io.LimitReader(c.Request.Body, maxChunkSize+1))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "failed to read chunk")
+		return
+	}
+	// every byte was received but completing failed: the retry carries no data
+	retry := offset == a.Size
+	if (len(chunk) == 0 && !retry) || len(chunk) > maxChunkSize || offset+int64(len(chunk)) > a.Size {
+		respondError(c, http.StatusRequestEntityTooLarge, "chunk exceeds the chunk size or the declared size")
+		return
+	}
+	ctx := c.Request.Context()
+	next := offset
+	if !retry {
+		key := chunkKey(a.Id, offset)
+		if err := blob.Default.Put(ctx, key, bytes.NewReader(chunk), int64(len(chunk)), "application/octet-stream"); err != nil {
+			respondInternal(c, "failed to store chunk", err)
+			return
+		}
+		next = offset + int64(len(chunk))
+		applied, current, err := repository.Default.AdvanceUpload(a.Id, offset, next)
+		// the losing request leaves the chunk in place: it was written under the same key
+		// by the same uploader, so it holds the same bytes as the winner's
+		if err != nil || !applied {
+			respondOffsetConflict(c, "offset mismatch", current)
+			return
+		}
+		if next < a.Size {
+			c.JSON(http.StatusOK, gin.H{"id": a.Id, "offset": next, "complete": false})
+			return
+		}
+	}
+	a.Offset = next
+	if err := completeUpload(ctx, &a); err != nil {
+		var rejected rejectedUpload
+		if !errors.As(err, &rejected) {
+			// the chunks are kept, the client completes the upload again
+			respondInternal(c, "failed to complete upload", err)
+			return
+		}
+		fmt.Println(err)
+		discardUpload(ctx, a)
+		respondError(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": a.Id, "offset": next, "complete": true, "mime_type": a.MimeType})
+}
+
+// rejectedUpload is a completion failure caused by the content of the upload, completing
+// it again cannot succeed
+type rejectedUpload struct {
+	reason string
+}
+
+func (e rejectedUpload) Error() string {
+	return e.reason
+}
+
+// discardUpload deletes the chunks of a rejected upload and moves its offset back to 0,
+// the client can upload other content under the same id
+func discardUpload(ctx context.Context, a model.Attachment) {
+	for offset := int64(0); offset < a.Size; {
+		key := chunkKey(a.Id, offset)
+		r, err := blob.Default.Get(ctx, key)
+		if err != nil {
+			break
+		}
+		n, err := io.Copy(io.Discard, r)
+		r.Close()
+		if err != nil || n == 0 {
+			break
+		}
+		if err := blob.Default.Delete(ctx, key); err != nil {
+			fmt.Println(err)
+		}
+		offset += n
+	}
+	if _, _, err := repository.Default.AdvanceUpload(a.Id, a.Size, 0); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// respondOffsetConflict aborts with 409 and the current offset of the upload, in the
+// Upload-Offset header and the offset field of the error, so the client can resume from it
+func respondOffsetConflict(c *gin.Context, msg string, offset int64) {
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.AbortWithStatusJSON(http.StatusConflict, struct {
+		model.ErrorResponse
+		Offset int64 `json:"offset"`
+	}{model.ErrorResponse{Error: msg}, offset})
+}
+
+// completeUpload assembles the chunks into the final blob and marks the attachment complete
+// the sniffed content type must be allowed too, the declared type is only trusted
+// when sniffing cannot tell (application/octet-stream)
+// images are processed in memory first: location metadata is stripped and a thumbnail stored
+func completeUpload(ctx context.Context, a *model.Attachment) error {
+	keys := []string{}
+	var image bytes.Buffer
+	for offset := int64(0); offset < a.Size; {
+		key := chunkKey(a.Id, offset)
+		r, err := blob.Default.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		offset += int64(len(data))
+		if len(keys) == 1 {
+			if sniffed := baseMimeType(http.DetectContentType(data)); sniffed != "application/octet-stream" {
+				if !allowedMimeTypes[sniffed] {
+					return rejectedUpload{fmt.Sprintf("file type %s not allowed", sniffed)}
+				}
+				a.MimeType = sniffed
+			}
+		}
+		if media.IsImage(a.MimeType) {
+			image.Write(data)
+		}
+	}
+	a.Key = "attachments/" + a.Id
+	if media.IsImage(a.MimeType) {
+		if err := storeImage(ctx, a, image.Bytes()); err != nil {
+			return err
+		}
+	} else {
+		readers := make([]io.Reader, 0, len(keys))
+		for _, key := range keys {
+			r, err := blob.Default.Get(ctx, key)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			readers = append(readers, r)
+		}
+		if err := blob.Default.Put(ctx, a.Key, io.MultiReader(readers...), a.Size, a.MimeType); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		blob.Default.Delete(ctx, key)
+	}
+	a.Complete = true
+	return repository.Default.CompleteAttachment(*a)
+}
+
+// storeImage stores the image without its location metadata, along with its thumbnail
+func storeImage(ctx context.Context, a *model.Attachment, data []byte) error {
+	img, err := media.Process(data, a.MimeType)
+	if err != nil {
+		return rejectedUpload{"invalid image: " + err.Error()}
+	}
+	a.Size = int64(len(img.Data))
+	if err := blob.Default.Put(ctx, a.Key, bytes.NewReader(img.Data), a.Size, a.MimeType); err != nil {
+		return err
+	}
+	a.Width, a.Height = img.Width, img.Height
+	a.ThumbnailKey = "thumbnails/" + a.Id
+	a.ThumbWidth, a.ThumbHeight, a.ThumbMime = img.ThumbWidth, img.ThumbHeight, img.ThumbnailMime
+	return blob.Default.Put(ctx, a.ThumbnailKey, bytes.NewReader(img.Thumbnail), int64(len(img.Thumbnail)), img.ThumbnailMime)
+}
+
+// kinds of signed links, a signature for one kind cannot be used for the other
+const (
+	fileLink      = "download"
+	thumbnailLink = "thumbnail"
+)
+
+// signLink returns the signature of a link of the given kind for the attachment expiring at expires
+func signLink(kind, id string, expires int64) string {
+	mac := hmac.New(sha256.New, linkSecret)
+	fmt.Fprintf(mac, "%s:%s:%d", kind, id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedURL returns the path of a signed link of the given kind valid for linkExpiry
+func signedURL(kind, id string) (string, int64) {
+	expires := time.Now().Add(linkExpiry).Unix()
+	return fmt.Sprintf("/attachments/%s/%s?expires=%d&sig=%s", id, kind, expires, signLink(kind, id, expires)), expires
+}
+
+// WithThumbnailUrl sets a signed thumbnail link on image attachments
+// the link is not bound to a user, so it can be sent to every recipient of a message
+func WithThumbnailUrl(a model.Attachment) model.Attachment {
+	if a.ThumbnailKey != "" {
+		a.ThumbnailUrl, _ = signedURL(thumbnailLink, a.Id)
+	}
+	return a
+}
+
+// AttachmentLink returns a signed, short-lived download link for a participant of the conversation
+// the requesting user is the logged in user (uid cookie)
+func AttachmentLink(c *gin.Context) {
+	username, ok := CurrentUser(c)
+	if !ok {
+		return
+	}
+	a := GetAttachment(c.Param("attachment_id"))
+	if a.Id == "" || !a.Complete {
+		respondError(c, http.StatusNotFound, "attachment not found")
+		return
+	}
+	if !IsConversationParticipant(username, a.Conversation) {
+		respondError(c, http.StatusForbidden, "not a participant of this conversation")
+		return
+	}
+	url, expires := signedURL(fileLink, a.Id)
+	c.JSON(http.StatusOK, gin.H{"url": url, "expires": expires, "attachment": WithThumbnailUrl(a)})
+}
+
+// DownloadAttachment serves a signed file link
+func DownloadAttachment(c *gin.Context) {
+	serveSigned(c, fileLink)
+}
+
+// DownloadThumbnail serves a signed thumbnail link
+func DownloadThumbnail(c *gin.Context) {
+	serveSigned(c, thumbnailLink)
+}
+
+// serveSigned checks the signature of the link and serves the file or thumbnail
+// redirects to the blob store when it can serve the file directly (presigned S3 url),
+// streams the file otherwise
+func serveSigned(c *gin.Context, kind string) {
+	id := c.Param("attachment_id")
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires || !hmac.Equal([]byte(c.Query("sig")), []byte(signLink(kind, id, expires))) {
+		respondError(c, http.StatusForbidden, "invalid or expired link")
+		return
+	}
+	a := GetAttachment(id)
+	key, mimeType, size := a.Key, a.MimeType, a.Size
+	if kind == thumbnailLink {
+		key, mimeType, size = a.ThumbnailKey, a.ThumbMime, -1
+	}
+	if a.Id == "" || !a.Complete || key == "" {
+		respondError(c, http.StatusNotFound, "attachment not found")
+		return
+	}
+	ctx := c.Request.Context()
+	if url, err := blob.Default.URL(ctx, key, time.Until(time.Unix(expires, 0))); err == nil && url != "" {
+		c.Redirect(http.StatusFound, url)
+		return
+	}
+	r, err := blob.Default.Get(ctx, key)
+	if err != nil {
+		fmt.Println(err)
+		respondError(c, http.StatusNotFound, "attachment not found")
+		return
+	}
+	defer r.Close()
+	headers := map[string]string{}
+	if kind == fileLink {
+		headers["Content-Disposition"] = mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})
+	}
+	c.DataFromReader(http.StatusOK, size, mimeType, r, headers)
+}
@@ -0,0 +1,284 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/naman1402/distributed-chat-app/blob"
+	"github.com/naman1402/distributed-chat-app/repository"
+	"github.com/naman1402/distributed-chat-app/settings"
+)
+
+// uploadServer serves the attachment endpoints over a fresh in-memory repository with
+// alice and bob signed up, and store as the blob store
+func uploadServer(t *testing.T, store blob.Store) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	repository.Default = repository.NewMemory()
+	for _, user := range []string{"alice", "bob"} {
+		if err := repository.Default.CreateUser("id-"+user, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blob.Default = store
+	SetupAttachments(settings.Attachments{Secret: "test"})
+	router := gin.New()
+	router.POST("/attachments", CreateUpload)
+	router.HEAD("/attachments/:attachment_id", UploadStatus)
+	router.PATCH("/attachments/:attachment_id", UploadChunk)
+	router.GET("/attachments/:attachment_id/link", AttachmentLink)
+	router.GET("/attachments/:attachment_id/download", DownloadAttachment)
+	return router
+}
+
+// call sends a request as user (uid cookie) and decodes the JSON response into res if not nil
+func call(t *testing.T, router *gin.Engine, user, method, path string, body io.Reader, headers map[string]string, res interface{}) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	req.AddCookie(&http.Cookie{Name: "uid", Value: "id-" + user})
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if res != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), res); err != nil {
+			t.Fatalf("%s %s: %d %s", method, path, w.Code, w.Body.String())
+		}
+	}
+	return w
+}
+
+func TestResumableUploadLocal(t *testing.T) {
+	store, err := blob.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResumableUpload(t, store)
+}
+
+// runs against the S3-compatible server in S3_TEST_ENDPOINT, see blob.TestS3Store
+func TestResumableUploadS3(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT not set")
+	}
+	accessKey, secretKey := os.Getenv("S3_TEST_ACCESS_KEY"), os.Getenv("S3_TEST_SECRET_KEY")
+	if accessKey == "" {
+		accessKey, secretKey = "minioadmin", "minioadmin"
+	}
+	store, err := blob.NewS3Store(endpoint, fmt.Sprintf("upload-test-%d", time.Now().UnixNano()), accessKey, secretKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResumableUpload(t, store)
+}
+
+func testResumableUpload(t *testing.T, store blob.Store) {
+	router := uploadServer(t, store)
+	content := strings.Repeat("line of text\n", 500)
+	first, second := content[:4000], content[4000:]
+
+	created := struct {
+		Id     string `json:"id"`
+		Offset int64  `json:"offset"`
+	}{}
+	body := fmt.Sprintf(`{"receiver":"bob","filename":"notes.txt","mime_type":"text/plain","size":%d}`, len(content))
+	if w := call(t, router, "alice", http.MethodPost, "/attachments", strings.NewReader(body), nil, &created); w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body.String())
+	}
+	path := "/attachments/" + created.Id
+
+	chunk := func(user string, offset int, data string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		res := map[string]interface{}{}
+		w := call(t, router, user, http.MethodPatch, path, strings.NewReader(data), map[string]string{"Upload-Offset": strconv.Itoa(offset)}, &res)
+		return w, res
+	}
+
+	if w, _ := chunk("bob", 0, first); w.Code != http.StatusNotFound {
+		t.Fatalf("chunk from another user: got %d, want 404", w.Code)
+	}
+	if w, res := chunk("alice", 0, first); w.Code != http.StatusOK || res["complete"] != false {
+		t.Fatalf("first chunk: %d %v", w.Code, res)
+	}
+	// a client that lost the response retries from 0 and is told where to resume
+	w, res := chunk("alice", 0, first)
+	if w.Code != http.StatusConflict || res["offset"] != float64(len(first)) || res["error"] != "offset mismatch" {
+		t.Fatalf("stale offset: %d %v", w.Code, res)
+	}
+	if w.Header().Get("Upload-Offset") != strconv.Itoa(len(first)) {
+		t.Fatalf("stale offset: Upload-Offset %q, want %d", w.Header().Get("Upload-Offset"), len(first))
+	}
+	head := call(t, router, "alice", http.MethodHead, path, nil, nil, nil)
+	if head.Header().Get("Upload-Offset") != strconv.Itoa(len(first)) {
+		t.Fatalf("Upload-Offset %q, want %d", head.Header().Get("Upload-Offset"), len(first))
+	}
+	if w, res := chunk("alice", len(first), second); w.Code != http.StatusOK || res["complete"] != true || res["mime_type"] != "text/plain" {
+		t.Fatalf("last chunk: %d %v", w.Code, res)
+	}
+	if w, _ := chunk("alice", len(content), "more"); w.Code != http.StatusConflict {
+		t.Fatalf("chunk after completion: got %d, want 409", w.Code)
+	}
+
+	// the chunks are replaced by the assembled blob
+	a := GetAttachment(created.Id)
+	if !a.Complete || a.Key == "" {
+		t.Fatalf("attachment not completed: %+v", a)
+	}
+	for _, offset := range []int64{0, int64(len(first))} {
+		if _, err := store.Get(context.Background(), chunkKey(created.Id, offset)); !errors.Is(err, blob.ErrNotFound) {
+			t.Fatalf("chunk at %d not deleted: %v", offset, err)
+		}
+	}
+
+	link := struct {
+		Url string `json:"url"`
+	}{}
+	if w := call(t, router, "bob", http.MethodGet, path+"/link", nil, nil, &link); w.Code != http.StatusOK {
+		t.Fatalf("link: %d %s", w.Code, w.Body.String())
+	}
+	if got := download(t, router, link.Url); got != content {
+		t.Fatalf("downloaded %d bytes, want %d", len(got), len(content))
+	}
+}
+
+// download fetches a signed link, following the redirect to the bucket for S3
+func download(t *testing.T, router *gin.Engine, url string) string {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	if w.Code == http.StatusFound || w.Code == http.StatusTemporaryRedirect {
+		res, err := http.Get(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var b bytes.Buffer
+		io.Copy(&b, res.Body)
+		return b.String()
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("download: %d %s", w.Code, w.Body.String())
+	}
+	return w.Body.String()
+}
+
+// failingStore fails the writes of the keys starting with prefix while failing is set
+type failingStore struct {
+	blob.Store
+	prefix  string
+	failing bool
+}
+
+func (s *failingStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if s.failing && strings.HasPrefix(key, s.prefix) {
+		return errors.New("store unavailable")
+	}
+	return s.Store.Put(ctx, key, r, size, contentType)
+}
+
+// startUpload creates an upload of size bytes from alice to bob and returns its path
+func startUpload(t *testing.T, router *gin.Engine, size int) string {
+	created := struct {
+		Id string `json:"id"`
+	}{}
+	body := fmt.Sprintf(`{"receiver":"bob","filename":"notes.txt","mime_type":"text/plain","size":%d}`, size)
+	if w := call(t, router, "alice", http.MethodPost, "/attachments", strings.NewReader(body), nil, &created); w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body.String())
+	}
+	return "/attachments/" + created.Id
+}
+
+// patch sends data at offset as alice
+func patch(t *testing.T, router *gin.Engine, path string, offset int, data string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	res := map[string]interface{}{}
+	w := call(t, router, "alice", http.MethodPatch, path, strings.NewReader(data), map[string]string{"Upload-Offset": strconv.Itoa(offset)}, &res)
+	return w, res
+}
+
+// a completion failing on the blob store keeps the chunks, completing again succeeds
+func TestUploadCompletionRetry(t *testing.T) {
+	local, err := blob.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &failingStore{Store: local, prefix: "attachments/", failing: true}
+	router := uploadServer(t, store)
+	content := "plain text notes\n"
+	path := startUpload(t, router, len(content))
+	id := strings.TrimPrefix(path, "/attachments/")
+
+	if w, res := patch(t, router, path, 0, content); w.Code != http.StatusInternalServerError {
+		t.Fatalf("last chunk with a failing store: %d %v", w.Code, res)
+	}
+	if a := GetAttachment(id); a.Complete || a.Offset != int64(len(content)) {
+		t.Fatalf("attachment after the failed completion: %+v", a)
+	}
+	// resending the last chunk is told every byte was received
+	if w, res := patch(t, router, path, 0, content); w.Code != http.StatusConflict || res["offset"] != float64(len(content)) {
+		t.Fatalf("resent chunk: %d %v", w.Code, res)
+	}
+	if w, res := patch(t, router, path, len(content), "more"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("data past the declared size: %d %v", w.Code, res)
+	}
+	if w, res := patch(t, router, path, len(content), ""); w.Code != http.StatusInternalServerError {
+		t.Fatalf("completion while the store still fails: %d %v", w.Code, res)
+	}
+
+	store.failing = false
+	if w, res := patch(t, router, path, len(content), ""); w.Code != http.StatusOK || res["complete"] != true || res["mime_type"] != "text/plain" {
+		t.Fatalf("completion retry: %d %v", w.Code, res)
+	}
+	if a := GetAttachment(id); !a.Complete {
+		t.Fatalf("attachment not completed: %+v", a)
+	}
+	if _, err := local.Get(context.Background(), chunkKey(id, 0)); !errors.Is(err, blob.ErrNotFound) {
+		t.Fatalf("chunk not deleted: %v", err)
+	}
+	if w, _ := patch(t, router, path, len(content), ""); w.Code != http.StatusConflict {
+		t.Fatalf("completion after completion: got %d, want 409", w.Code)
+	}
+}
+
+// content that is not allowed discards the chunks and lets the client upload again
+func TestUploadRejected(t *testing.T) {
+	store, err := blob.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := uploadServer(t, store)
+	html := "<html><body>" + strings.Repeat("x", 100) + "</body></html>"
+	first, second := html[:60], html[60:]
+	path := startUpload(t, router, len(html))
+	id := strings.TrimPrefix(path, "/attachments/")
+
+	if w, res := patch(t, router, path, 0, first); w.Code != http.StatusOK {
+		t.Fatalf("first chunk: %d %v", w.Code, res)
+	}
+	w, res := patch(t, router, path, len(first), second)
+	if w.Code != http.StatusUnprocessableEntity || res["error"] != "file type text/html not allowed" {
+		t.Fatalf("html upload: %d %v", w.Code, res)
+	}
+	for _, offset := range []int{0, len(first)} {
+		if _, err := store.Get(context.Background(), chunkKey(id, int64(offset))); !errors.Is(err, blob.ErrNotFound) {
+			t.Fatalf("chunk at %d not deleted: %v", offset, err)
+		}
+	}
+	if w, res := patch(t, router, path, len(html), ""); w.Code != http.StatusConflict || res["offset"] != float64(0) {
+		t.Fatalf("completion of a rejected upload: %d %v", w.Code, res)
+	}
+
+	text := strings.Repeat("y", len(html))
+	if w, res := patch(t, router, path, 0, text); w.Code != http.StatusOK || res["complete"] != true {
+		t.Fatalf("upload after the rejection: %d %v", w.Code, res)
+	}
+}
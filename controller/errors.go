@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/naman1402/distributed-chat-app/model"
+)
+
+// respondError aborts the request with the JSON error model, see model.ErrorResponse
+func respondError(c *gin.Context, status int, msg string, fields ...model.FieldError) {
+	c.AbortWithStatusJSON(status, model.ErrorResponse{Error: msg, Fields: fields})
+}
+
+// respondInvalid aborts with 400 and the field errors of a failed validation
+func respondInvalid(c *gin.Context, msg string, err error) {
+	respondError(c, http.StatusBadRequest, msg, model.FieldErrors(err)...)
+}
+
+// respondInternal logs the cause and aborts with 500, the cause is not sent to the client
+func respondInternal(c *gin.Context, msg string, err error) {
+	fmt.Println(err)
+	respondError(c, http.StatusInternalServerError, msg)
+}
+
+// RespondError is respondError for the handlers of other packages
+func RespondError(c *gin.Context, status int, msg string, fields ...model.FieldError) {
+	respondError(c, status, msg, fields...)
+}
+
+// RespondInternal is respondInternal for the handlers of other packages
+func RespondInternal(c *gin.Context, msg string, err error) {
+	respondInternal(c, msg, err)
+}
+
+// bindJSON decodes the request body into v, answering 400 if it is not valid JSON
+func bindJSON(c *gin.Context, v interface{}) bool {
+	if err := c.ShouldBindBodyWithJSON(v); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid request body")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,34 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/naman1402/distributed-chat-app/model"
+	"github.com/naman1402/distributed-chat-app/repository"
+)
+
+// previewLength is the number of characters of the last message kept in the inbox
+const previewLength = 100
+
+// UpdateInbox moves the conversation to the top of the user's inbox with the given message as preview
+// nothing changes if a newer message of the conversation is already there (ksuid order)
+func UpdateInbox(username, conversation, id, msg, sender string, isGroup bool) {
+	preview := []rune(msg)
+	if len(preview) > previewLength {
+		preview = preview[:previewLength]
+	}
+	e := model.InboxEntry{Conversation: conversation, LastMessageId: id, Sender: sender, Preview: string(preview), Group: isGroup}
+	if err := repository.Default.UpdateInbox(username, e); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// GetInbox returns up to limit conversations of the user, most recently active first,
+// with activity older than the given message id (empty before starts from the top)
+func GetInbox(username, before string, limit int) []model.InboxEntry {
+	entries, err := repository.Default.Inbox(username, before, limit)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return entries
+}
@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/naman1402/distributed-chat-app/model"
+	"github.com/naman1402/distributed-chat-app/repository"
+)
+
+// default and maximum number of mentions returned by GetMentionsInbox
+const (
+	mentionsPageSize    = 50
+	mentionsMaxPageSize = 200
+)
+
+// SaveMention adds the message to the mentions inbox of username
+func SaveMention(username, id, msg, sender, groupName string) {
+	m := model.ChatMessage{Id: id, Message: msg, Sender: sender, GroupName: groupName}
+	if err := repository.Default.SaveMention(username, m); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// GetMentions returns up to limit mentions of username, newest first, older than the given message id
+// an empty before starts from the newest mention
+func GetMentions(username, before string, limit int) []model.ChatMessage {
+	mentions, err := repository.Default.Mentions(username, before, limit)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return mentions
+}
+
+// GetMentionsInbox returns the messages the user was mentioned in
+// the user is the logged in user (uid cookie)
+// query params: before (last mention id already seen), limit
+func GetMentionsInbox(c *gin.Context) {
+	username, ok := CurrentUser(c)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(mentionsPageSize)))
+	if err != nil || limit < 1 || limit > mentionsMaxPageSize {
+		limit = mentionsPageSize
+	}
+	mentions := GetMentions(username, c.Query("before"), limit)
+	next := ""
+	if len(mentions) == limit {
+		next = mentions[len(mentions)-1].Id
+	}
+	c.JSON(http.StatusOK, gin.H{"mentions": mentions, "next": next})
+}
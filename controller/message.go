@@ -2,22 +2,69 @@ package controller
 
 import (
 	"fmt"
+	"time"
 
-	"github.com/naman1402/distributed-chat-app/database"
+	"github.com/naman1402/distributed-chat-app/model"
+	"github.com/naman1402/distributed-chat-app/repository"
+	"github.com/naman1402/distributed-chat-app/search"
 )
 
-func SaveMessagePrivateChat(id, msg, sender, reciever string) {
-	query := `INSERT INTO private_chat(id, msg, sender, reciever, timestamp) VALUES (?, ?, ?, ?, toTimeStamp(now()))`
-	err := database.ExecuteQuery(query, id, msg, sender, reciever)
-	if err != nil {
+// SaveMessagePrivateChat persists a one-to-one message with its conversation log entry
+// and indexes it for search, a message that could not be stored is not indexed
+func SaveMessagePrivateChat(m model.ChatMessage) error {
+	conversation := search.PrivateConversation(m.Sender, m.Receiver)
+	if err := repository.Default.SavePrivate(conversation, m); err != nil {
+		return err
+	}
+	indexMessage(m.Id, conversation, m.Sender, m.Message)
+	return nil
+}
+
+// SaveMessageGroupChat persists a room message with its conversation log entry
+// and indexes it for search, a message that could not be stored is not indexed
+func SaveMessageGroupChat(m model.ChatMessage) error {
+	conversation := search.GroupConversation(m.GroupName)
+	if err := repository.Default.SaveGroup(conversation, m); err != nil {
+		return err
+	}
+	indexMessage(m.Id, conversation, m.Sender, m.Message)
+	return nil
+}
+
+// GetMaxSeq returns the highest sequence number stored for the conversation, 0 if it has none
+func GetMaxSeq(conversation string) (int64, error) {
+	return repository.Default.MaxSeq(conversation)
+}
+
+// GetConversationLog returns up to limit messages of the conversation with a sequence number
+// greater than after, oldest first
+func GetConversationLog(conversation string, after int64, limit int) ([]model.ChatMessage, error) {
+	return repository.Default.Log(conversation, after, limit)
+}
+
+// indexMessage adds a saved message to the full-text index
+func indexMessage(id, conversation, sender, msg string) {
+	doc := search.Document{Id: id, Conversation: conversation, Sender: sender, Message: msg, Timestamp: time.Now()}
+	if err := search.Engine.Index(doc); err != nil {
 		fmt.Println(err)
 	}
 }
 
-func SaveMessageGroupChat(id, msg, sender, groupName string) {
-	query := `INSERT INTO group_chat(id, msg, sender, group, timestamp) VALUES (?, ?, ?, ?, toTimeStamp(now()))`
-	err := database.ExecuteQuery(query, id, msg, sender, groupName)
+// GetMessage looks the message up by id, private or group
+// returns an empty ChatMessage (Id == "") if it does not exist
+func GetMessage(id string) model.ChatMessage {
+	m, err := repository.Default.GetMessage(id)
 	if err != nil {
-		fmt.Println(err)
+		return model.ChatMessage{}
+	}
+	return m
+}
+
+// IsParticipant reports whether username belongs to the conversation the message was sent in
+// private messages: sender or receiver, group messages: member of the room
+func IsParticipant(username string, m model.ChatMessage) bool {
+	if m.GroupName != "" {
+		return IsRoomMember(m.GroupName, username)
 	}
+	return username == m.Sender || username == m.Receiver
 }
@@ -1,49 +1,104 @@
 package controller
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
-	"github.com/naman1402/distributed-chat-app/database"
 	"github.com/naman1402/distributed-chat-app/model"
+	"github.com/naman1402/distributed-chat-app/repository"
 	"github.com/segmentio/ksuid"
 )
 
+// MemberJoined is called after a user joined a room, it is set by the config package
+// to subscribe the server the user is connected to to the room
+var MemberJoined = func(room, username string) {}
+
 // context holds information about the upcoming HTTP request and provides method to handle the response
-// storing the context into newRoom (JSON format) and inserting into cassandra session by calling execute query from database package
+// storing the context into newRoom (JSON format) and saving it through the room repository
+// Response: 201 with the room id, 400 on invalid input, 409 if the name is taken
 func CreateRoom(c *gin.Context) {
 	newRoom := model.Room{}
-	if err := c.ShouldBindBodyWithJSON(&newRoom); err != nil {
-		fmt.Println(err)
+	if !bindJSON(c, &newRoom) {
+		return
+	}
+	if err := newRoom.Validate(); err != nil {
+		respondInvalid(c, "invalid room", err)
+		return
 	}
 	Id := ksuid.New()
-	query := `INSERT INTO room (id, room_name) VALUES (?, ?)`
-	database.ExecuteQuery(query, Id, newRoom.Name)
-	c.JSON(http.StatusOK, gin.H{"message": "done"})
+	err := repository.Default.CreateRoom(Id.String(), newRoom.Name)
+	if errors.Is(err, repository.ErrExists) {
+		respondError(c, http.StatusConflict, "room already exists", model.FieldError{Field: "name", Message: "room already exists"})
+		return
+	}
+	if err != nil {
+		respondInternal(c, "failed to create room", err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "done", "room_id": Id.String()})
 }
 
-// get room from context and execute query to add member into room_name (room and user name from context -> joiningRoom)
+// get room from context and add the user to the room's members (room and user name from context -> joiningRoom)
+// Response: 200, 400 on invalid input, 404 if the room or the user does not exist
 func JoinRoom(c *gin.Context) {
 	joiningRoom := model.Room{}
-	if err := c.ShouldBindBodyWithJSON(&joiningRoom); err != nil {
-		fmt.Println(err)
+	if !bindJSON(c, &joiningRoom) {
+		return
+	}
+	if err := joiningRoom.ValidateJoin(); err != nil {
+		respondInvalid(c, "invalid join request", err)
+		return
+	}
+	exists, err := repository.Default.RoomExists(joiningRoom.Name)
+	if err != nil {
+		respondInternal(c, "failed to join room", err)
+		return
+	}
+	if !exists {
+		respondError(c, http.StatusNotFound, "room not found")
+		return
+	}
+	if _, err := repository.Default.GetUser(joiningRoom.User); err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			respondError(c, http.StatusNotFound, "user not found")
+			return
+		}
+		respondInternal(c, "failed to join room", err)
+		return
 	}
-	query := `INSERT INTO room_members(room_name,username)VALUES(?,?)`
-	database.ExecuteQuery(query, joiningRoom.Name, joiningRoom.User)
+	if err := repository.Default.AddMember(joiningRoom.Name, joiningRoom.User); err != nil {
+		respondInternal(c, "failed to join room", err)
+		return
+	}
+	MemberJoined(joiningRoom.Name, joiningRoom.User)
 	c.JSON(http.StatusOK, gin.H{"message": "room joined"})
 }
 
-// data is iterator containing room members (collected by calling query directly through cassandra session)
-// in the for loop, we scan username from data and store it into members ([]string)
-// return the array containing members
+// returns the usernames of the room's members, empty if the room has none
 func GetMembersFromRoom(groupname string) []string {
-	var username string
-	members := []string{}
-	query := `SELECT username FROM room_members WHERE room_name = ?`
-	data := database.Connection.Session.Query(query, groupname).Iter()
-	for data.Scan(&username) {
-		members = append(members, username)
+	members, err := repository.Default.Members(groupname)
+	if err != nil {
+		fmt.Println(err)
 	}
 	return members
 }
+
+// GetRoomsOfUser returns the names of the rooms the user joined
+func GetRoomsOfUser(username string) []string {
+	rooms, err := repository.Default.Rooms(username)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return rooms
+}
+
+// checks room_members for a single (room_name, username) row
+func IsRoomMember(groupname, username string) bool {
+	member, err := repository.Default.IsMember(groupname, username)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return member
+}
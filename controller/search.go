@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/naman1402/distributed-chat-app/model"
+	"github.com/naman1402/distributed-chat-app/repository"
+	"github.com/naman1402/distributed-chat-app/search"
+)
+
+// default and maximum number of hits returned by SearchMessages
+const (
+	searchPageSize    = 20
+	searchMaxPageSize = 100
+)
+
+// GetConversations returns the search conversation ids of every conversation in the user's inbox
+// inbox keys "dm:{user}" are turned into the shared "dm:{user}:{user}" id
+func GetConversations(username string) []string {
+	keys, err := repository.Default.Conversations(username)
+	if err != nil {
+		fmt.Println(err)
+	}
+	conversations := []string{}
+	for _, key := range keys {
+		conversations = append(conversations, SharedConversation(username, key))
+	}
+	return conversations
+}
+
+// SharedConversation turns the user's conversation key ("group:{room}" or "dm:{user}")
+// into the id shared by all participants ("group:{room}" or "dm:{user}:{user}")
+func SharedConversation(username, key string) string {
+	if peer, ok := strings.CutPrefix(key, "dm:"); ok {
+		return search.PrivateConversation(username, peer)
+	}
+	return key
+}
+
+// SearchMessages runs a full-text query over the caller's own conversations
+// the caller is the logged in user (uid cookie)
+// query params: q (text), before (id of the last hit already seen), limit
+// hits are newest first and carry the message with matching terms wrapped in <mark>
+func SearchMessages(c *gin.Context) {
+	username, ok := CurrentUser(c)
+	if !ok {
+		return
+	}
+	text := c.Query("q")
+	if strings.TrimSpace(text) == "" {
+		respondError(c, http.StatusBadRequest, "q is required", model.FieldError{Field: "q", Message: "q is required"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(searchPageSize)))
+	if err != nil || limit < 1 || limit > searchMaxPageSize {
+		limit = searchPageSize
+	}
+	hits, err := search.Engine.Search(search.Query{
+		Text:          text,
+		Conversations: GetConversations(username),
+		Before:        c.Query("before"),
+		Limit:         limit,
+	})
+	if err != nil {
+		respondInternal(c, "search failed", err)
+		return
+	}
+	next := ""
+	if len(hits) == limit {
+		next = hits[len(hits)-1].Id
+	}
+	c.JSON(http.StatusOK, gin.H{"results": hits, "next": next})
+}
@@ -0,0 +1,141 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/naman1402/distributed-chat-app/model"
+	"github.com/naman1402/distributed-chat-app/repository"
+)
+
+// default and maximum number of replies returned by GetThread
+const (
+	threadPageSize    = 50
+	threadMaxPageSize = 200
+)
+
+// SaveThreadReply stores the reply under its thread, bumps the reply counter of the parent
+// and subscribes the sender to the thread
+func SaveThreadReply(threadId, id, msg, sender, replyTo string) {
+	reply := model.ChatMessage{Id: id, Message: msg, Sender: sender, ReplyTo: replyTo}
+	if err := repository.Default.SaveReply(threadId, reply); err != nil {
+		fmt.Println(err)
+	}
+	SubscribeThread(threadId, sender)
+}
+
+// GetReplyCount returns the number of replies posted in the thread anchored on threadId
+func GetReplyCount(threadId string) int {
+	replies, err := repository.Default.ReplyCount(threadId)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return replies
+}
+
+// GetThreadReplies returns up to limit replies of the thread posted after the given message id
+// an empty after starts from the first reply
+func GetThreadReplies(threadId, after string, limit int) []model.ChatMessage {
+	replies, err := repository.Default.Replies(threadId, after, limit)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return replies
+}
+
+func SubscribeThread(threadId, username string) {
+	if err := repository.Default.Subscribe(threadId, username); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func UnsubscribeThread(threadId, username string) {
+	if err := repository.Default.Unsubscribe(threadId, username); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// GetThreadSubscribers returns every user following the thread
+func GetThreadSubscribers(threadId string) []string {
+	subscribers, err := repository.Default.Subscribers(threadId)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return subscribers
+}
+
+// GetThread returns the parent message (with its reply count) and a page of replies
+// query params: after (last reply id already seen), limit
+// only participants of the conversation the parent was sent in can read the thread,
+// the requesting user is the logged in user (uid cookie)
+func GetThread(c *gin.Context) {
+	username, ok := CurrentUser(c)
+	if !ok {
+		return
+	}
+	threadId := c.Param("thread_id")
+	parent := GetMessage(threadId)
+	if parent.Id == "" {
+		respondError(c, http.StatusNotFound, "thread not found")
+		return
+	}
+	if !IsParticipant(username, parent) {
+		respondError(c, http.StatusForbidden, "not a participant of this conversation")
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(threadPageSize)))
+	if err != nil || limit < 1 || limit > threadMaxPageSize {
+		limit = threadPageSize
+	}
+	parent.ReplyCount = GetReplyCount(threadId)
+	replies := GetThreadReplies(threadId, c.Query("after"), limit)
+	next := ""
+	if len(replies) == limit {
+		next = replies[len(replies)-1].Id
+	}
+	c.JSON(http.StatusOK, gin.H{"parent": parent, "replies": replies, "next": next})
+}
+
+// SubscribeToThread lets the logged in user follow a thread of their conversations
+// to receive thread_reply notifications
+func SubscribeToThread(c *gin.Context) {
+	username, ok := CurrentUser(c)
+	if !ok {
+		return
+	}
+	sub := model.ThreadSubscription{}
+	if !bindJSON(c, &sub) {
+		return
+	}
+	parent := GetMessage(sub.ThreadId)
+	if parent.Id == "" {
+		respondError(c, http.StatusNotFound, "thread not found")
+		return
+	}
+	if !IsParticipant(username, parent) {
+		respondError(c, http.StatusForbidden, "not a participant of this conversation")
+		return
+	}
+	SubscribeThread(sub.ThreadId, username)
+	c.JSON(http.StatusOK, gin.H{"message": "subscribed"})
+}
+
+// UnsubscribeFromThread stops thread_reply notifications for the logged in user
+func UnsubscribeFromThread(c *gin.Context) {
+	username, ok := CurrentUser(c)
+	if !ok {
+		return
+	}
+	sub := model.ThreadSubscription{}
+	if !bindJSON(c, &sub) {
+		return
+	}
+	if sub.ThreadId == "" {
+		respondError(c, http.StatusBadRequest, "thread_id is required", model.FieldError{Field: "thread_id", Message: "thread_id is required"})
+		return
+	}
+	UnsubscribeThread(sub.ThreadId, username)
+	c.JSON(http.StatusOK, gin.H{"message": "unsubscribed"})
+}
@@ -0,0 +1,24 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/naman1402/distributed-chat-app/repository"
+)
+
+// SetLastRead stores the id of the last message the user has read in the conversation
+func SetLastRead(username, conversation, messageId string) {
+	if err := repository.Default.SetLastRead(username, conversation, messageId); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// GetLastRead returns the last-read marker of every conversation of the user
+// key: conversation, value: message id
+func GetLastRead(username string) map[string]string {
+	markers, err := repository.Default.LastRead(username)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return markers
+}
@@ -1,64 +1,135 @@
 package controller
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
-	"github.com/naman1402/distributed-chat-app/database"
 	"github.com/naman1402/distributed-chat-app/model"
+	"github.com/naman1402/distributed-chat-app/repository"
+	"github.com/naman1402/distributed-chat-app/settings"
 	"github.com/segmentio/ksuid"
 )
 
+// cookie configures the uid cookie set by LoginUser, see SetupCookie
+var cookie settings.Cookie
+
+func SetupCookie(cfg settings.Cookie) {
+	cookie = cfg
+}
+
+// CreateUser signs a user up
+// Response: 201 with the user id, 400 on invalid input, 409 if the username is taken
 func CreateUser(c *gin.Context) {
-	user := &model.User{}
-	if err := c.ShouldBindBodyWithJSON(&user); err != nil {
-		fmt.Println(err)
+	user := model.User{}
+	if !bindJSON(c, &user) {
+		return
+	}
+	if err := user.Validate(); err != nil {
+		respondInvalid(c, "invalid user", err)
+		return
 	}
 	Id := ksuid.New()
-	query := `INSERT INTO users(id, username) VALUES(?, ?)`
-	database.ExecuteQuery(query, Id.String(), user.Username)
-	c.JSON(http.StatusAccepted, gin.H{"message": "User created"})
+	err := repository.Default.CreateUser(Id.String(), user.Username)
+	if errors.Is(err, repository.ErrExists) {
+		respondError(c, http.StatusConflict, "username already taken", model.FieldError{Field: "username", Message: "username already taken"})
+		return
+	}
+	if err != nil {
+		respondInternal(c, "failed to create user", err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "User created", "id": Id.String()})
 }
 
 func LoginUser(c *gin.Context) {
 
 	// get user from context to know about the account details
-	user := &model.LoginReq{}
-	if err := c.ShouldBindJSON(&user); err != nil {
-		fmt.Println(err)
+	user := model.LoginReq{}
+	if !bindJSON(c, &user) {
+		return
 	}
-	// search for the account detail in db, and use database package function to check if user exist (using query)
-	// if ID is "", then it does not exist and return bad request http status
+	if err := user.Validate(); err != nil {
+		respondInvalid(c, "invalid login", err)
+		return
+	}
+	// search for the account detail through the user repository
+	// an unknown user gets 401, a storage failure 500
 	// else setcookies for successful login
-	query := `SELECT id, username FROM users WHERE username = ?`
-	ID, username := database.CheckIfExist(query, user.Id)
-	if ID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user"})
+	account, err := repository.Default.GetUser(user.Id)
+	if errors.Is(err, repository.ErrNotFound) {
+		respondError(c, http.StatusUnauthorized, "invalid user")
+		return
+	}
+	if err != nil {
+		respondInternal(c, "failed to log in", err)
 		return
 	}
-	c.SetCookie("uid", ID, 36000, "/", "localhost", false, true)
-	c.JSON(http.StatusAccepted, gin.H{"id": ID, "name": username})
+	c.SetCookie("uid", account.Id, cookie.MaxAge, "/", cookie.Domain, cookie.Secure, true)
+	c.JSON(http.StatusOK, gin.H{"id": account.Id, "name": account.Username})
+}
+
+// CurrentUser returns the username of the account in the uid cookie set by LoginUser
+// it answers 401 and returns false if the cookie is missing or names no account
+func CurrentUser(c *gin.Context) (string, bool) {
+	uid, err := c.Cookie("uid")
+	if err != nil || uid == "" {
+		respondError(c, http.StatusUnauthorized, "not logged in")
+		return "", false
+	}
+	account, err := repository.Default.GetUserById(uid)
+	if errors.Is(err, repository.ErrNotFound) {
+		respondError(c, http.StatusUnauthorized, "not logged in")
+		return "", false
+	}
+	if err != nil {
+		respondInternal(c, "failed to load user", err)
+		return "", false
+	}
+	return account.Username, true
 }
 
 func SetUser(userid, serverId string) {
-	query := `INSERT INTO user_mapping (username, server_id) VALUES (?, ?)`
-	err := database.ExecuteQuery(query, userid, serverId)
+	err := repository.Default.SetServer(userid, serverId)
 	if err != nil {
 		fmt.Print(err)
 	}
 }
 
+// ClearUser marks the user offline in the mapping if it is still routed to serverId
+func ClearUser(userid, serverId string) {
+	if err := repository.Default.ClearServer(userid, serverId); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// GetServerId returns the server the user is connected to, "" if unknown
 func GetServerId(userid string) string {
-	var serverid string
-	query := `SELECT server_id FROM user_mapping WHERE username = ?`
-	iter := database.Connection.Session.Query(query, userid).Iter()
-	iter.Scan(&serverid)
+	serverid, _ := repository.Default.GetServer(userid)
 	return serverid
 }
 
+// GetServerIds returns the server each user is connected to, in a single batched lookup
+// users without a known server map to ""
+func GetServerIds(userids []string) map[string]string {
+	servers, err := repository.Default.GetServers(userids)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return servers
+}
+
+// PingStorage checks that the storage backend answers
+func PingStorage() error {
+	return repository.Default.Ping()
+}
+
+// CheckIfUserExist returns the id and username of the account, both "" if it does not exist
 func CheckIfUserExist(userId string) (string, string) {
-	query := `SELECT id,username FROM users WHERE username = ?`
-	ID, username := database.CheckIfExist(query, userId)
-	return ID, username
+	user, err := repository.Default.GetUser(userId)
+	if err != nil {
+		return "", ""
+	}
+	return user.Id, user.Username
 }
@@ -2,8 +2,11 @@ package database
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/gocql/gocql"
+	"github.com/naman1402/distributed-chat-app/metrics"
+	"github.com/naman1402/distributed-chat-app/settings"
 )
 
 type DatabaseConnection struct {
@@ -12,12 +15,72 @@ type DatabaseConnection struct {
 
 var Connection DatabaseConnection
 
-func SetupConnection() {
+// speculative is applied to every idempotent query, NonSpeculativeExecution when disabled
+var speculative gocql.SpeculativeExecutionPolicy = &gocql.NonSpeculativeExecution{}
+
+// concurrency bounds the queries in flight of a ForEach
+var concurrency = 16
+
+// Statement is one query of a batch, see ExecuteBatch
+type Statement struct {
+	Query string
+	Args  []interface{}
+}
+
+// Implementation:
+// 1. Creates the cluster from the contact points, keyspace and consistency
+// 2. Routes each query to a replica owning its partition (token aware), falling back to
+// round robin over the local datacenter (or every host if none is configured)
+// 3. Retries failed queries with exponential backoff and, if enabled, races slow
+// idempotent queries against speculative executions on other hosts
+// 4. gocql prepares every query with bound values once per host and caches it by
+// statement text, queries must therefore be constant strings with ? placeholders
+func SetupConnection(cfg settings.Cassandra) {
 
 	// creating new cluster
-	cluster := gocql.NewCluster("cassandra:9042")
-	cluster.Keyspace = "chat"
-	cluster.Consistency = gocql.Quorum
+	cluster := gocql.NewCluster(cfg.Hosts...)
+	cluster.Keyspace = cfg.Keyspace
+	cluster.Consistency = gocql.ParseConsistency(cfg.Consistency)
+	if cfg.Username != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{Username: cfg.Username, Password: cfg.Password}
+	}
+	if cfg.Timeout.Duration > 0 {
+		cluster.Timeout = cfg.Timeout.Duration
+	}
+	if cfg.NumConns > 0 {
+		cluster.NumConns = cfg.NumConns
+	}
+	if cfg.MaxPreparedStmts > 0 {
+		cluster.MaxPreparedStmts = cfg.MaxPreparedStmts
+	}
+
+	// host selection: token aware on top of (dc aware) round robin
+	fallback := gocql.RoundRobinHostPolicy()
+	if cfg.LocalDC != "" {
+		fallback = gocql.DCAwareRoundRobinPolicy(cfg.LocalDC)
+	}
+	cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(fallback, gocql.ShuffleReplicas())
+
+	// retry and speculative execution policies
+	cluster.RetryPolicy = nil
+	if cfg.Retries > 0 {
+		cluster.RetryPolicy = &gocql.ExponentialBackoffRetryPolicy{
+			NumRetries: cfg.Retries,
+			Min:        cfg.RetryMinBackoff.Duration,
+			Max:        cfg.RetryMaxBackoff.Duration,
+		}
+	}
+	if cfg.Concurrency > 0 {
+		concurrency = cfg.Concurrency
+	}
+	if cfg.SpeculativeAttempts > 0 {
+		speculative = &gocql.SimpleSpeculativeExecution{NumAttempts: cfg.SpeculativeAttempts, TimeoutDelay: cfg.SpeculativeDelay.Duration}
+	}
+
+	// query and batch durations, see metrics.CassandraObserver
+	cluster.QueryObserver = metrics.CassandraObserver{}
+	cluster.BatchObserver = metrics.CassandraObserver{}
+
 	// creating a session from the configuration and storing the instance in state variable
 	cs, err := cluster.CreateSession()
 	Connection.Session = cs
@@ -30,30 +93,64 @@ func SetupConnection() {
 
 // state variables stores the session instance, this function takes the query and args
 // and pass it through the session and exec it, returns error
+// the query must be idempotent, see NonIdempotentQuery
 func ExecuteQuery(query string, args ...interface{}) error {
-	err := Connection.Session.Query(query, args...).Exec()
+	err := SelectQuery(query, args...).Exec()
 	return err
 }
 
 // creates Query from query and args, and returns it
+// the query is marked idempotent so it may be executed speculatively
 func SelectQuery(query string, args ...interface{}) *gocql.Query {
-	data := Connection.Session.Query(query, args...)
+	data := Connection.Session.Query(query, args...).Idempotent(true).SetSpeculativeExecutionPolicy(speculative)
 	return data
 }
 
-// creating mapping from string to interface{}
-// passing query and id as Query into session, and turn result into iterator(allows you to go through the results one row at a time, without loading everything into memory at once)
-// scan through every row of iterator, populates it with a row that is returned from cassandra.
-// In each iteration, it extracts the id and username from the current row, assigns them to variables (ID and username), and then resets the map m for the next row.
-func CheckIfExist(query string, id string) (string, string) {
-	var ID string
-	var username string
-	m := map[string]interface{}{}
-	iter := Connection.Session.Query(query, id).Iter()
-	for iter.MapScan(m) {
-		ID = m["id"].(string)
-		username = m["username"].(string)
-		m = map[string]interface{}{}
-	}
-	return ID, username
+// NonIdempotentQuery creates a query that must run at most once: counter updates and
+// lightweight transactions, a retry after a timeout could apply them twice
+func NonIdempotentQuery(query string, args ...interface{}) *gocql.Query {
+	return Connection.Session.Query(query, args...).Idempotent(false).RetryPolicy(nil)
+}
+
+// ExecuteBatch runs the statements in one logged batch: a single round trip,
+// and either all of them are applied or none
+func ExecuteBatch(stmts ...Statement) error {
+	batch := Connection.Session.NewBatch(gocql.LoggedBatch)
+	for _, stmt := range stmts {
+		batch.Entries = append(batch.Entries, gocql.BatchEntry{Stmt: stmt.Query, Args: stmt.Args, Idempotent: true})
+	}
+	batch.SpeculativeExecutionPolicy(speculative)
+	return Connection.Session.ExecuteBatch(batch)
+}
+
+// Ping checks that the cluster answers a query, within the query timeout
+func Ping() error {
+	if Connection.Session == nil || Connection.Session.Closed() {
+		return gocql.ErrSessionClosed
+	}
+	return SelectQuery("SELECT release_version FROM system.local").Exec()
+}
+
+// ForEach calls fn for every index in [0, n) from concurrent goroutines, at most
+// concurrency at a time, so a fan-out over many partitions costs a few round trips
+// instead of n sequential ones; returns the first error
+func ForEach(n int, fn func(i int) error) error {
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	sem := make(chan struct{}, concurrency)
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			if err := fn(i); err != nil {
+				once.Do(func() { firstErr = err })
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
 }
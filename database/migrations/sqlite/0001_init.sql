@@ -0,0 +1,153 @@
+-- schema of the relational backend, mirrors db.cql
+-- lists (attachments, mentions) are stored as JSON arrays
+
+CREATE TABLE users(
+    id       TEXT NOT NULL,
+    username TEXT PRIMARY KEY
+);
+-- accounts are looked up by id to resolve the uid cookie
+CREATE UNIQUE INDEX users_id ON users(id);
+
+CREATE TABLE room(
+    id        TEXT NOT NULL,
+    room_name TEXT PRIMARY KEY
+);
+
+CREATE TABLE room_members(
+    room_name TEXT NOT NULL,
+    username  TEXT NOT NULL,
+    PRIMARY KEY(room_name, username)
+);
+-- the rooms of a user are read whenever the user connects
+CREATE INDEX room_members_username ON room_members(username);
+
+CREATE TABLE user_mapping(
+    username  TEXT PRIMARY KEY,
+    server_id TEXT NOT NULL
+);
+
+CREATE TABLE private_chat(
+    id          TEXT PRIMARY KEY,
+    sender      TEXT NOT NULL,
+    receiver    TEXT NOT NULL,
+    msg         TEXT NOT NULL,
+    reply_to    TEXT NOT NULL DEFAULT '',
+    thread_id   TEXT NOT NULL DEFAULT '',
+    attachments TEXT NOT NULL DEFAULT '[]',
+    seq         INTEGER NOT NULL DEFAULT 0,
+    created_at  TIMESTAMP NOT NULL
+);
+CREATE INDEX private_chat_sender ON private_chat(sender);
+
+CREATE TABLE group_chat(
+    id           TEXT PRIMARY KEY,
+    sender       TEXT NOT NULL,
+    msg          TEXT NOT NULL,
+    group_name   TEXT NOT NULL,
+    reply_to     TEXT NOT NULL DEFAULT '',
+    thread_id    TEXT NOT NULL DEFAULT '',
+    mentions     TEXT NOT NULL DEFAULT '[]',
+    mention_room BOOLEAN NOT NULL DEFAULT FALSE,
+    attachments  TEXT NOT NULL DEFAULT '[]',
+    seq          INTEGER NOT NULL DEFAULT 0,
+    created_at   TIMESTAMP NOT NULL
+);
+CREATE INDEX group_chat_group ON group_chat(group_name);
+
+CREATE TABLE conversation_log(
+    conversation TEXT NOT NULL,
+    seq          INTEGER NOT NULL,
+    id           TEXT NOT NULL,
+    sender       TEXT NOT NULL,
+    receiver     TEXT NOT NULL DEFAULT '',
+    group_name   TEXT NOT NULL DEFAULT '',
+    msg          TEXT NOT NULL,
+    reply_to     TEXT NOT NULL DEFAULT '',
+    thread_id    TEXT NOT NULL DEFAULT '',
+    mentions     TEXT NOT NULL DEFAULT '[]',
+    mention_room BOOLEAN NOT NULL DEFAULT FALSE,
+    attachments  TEXT NOT NULL DEFAULT '[]',
+    created_at   TIMESTAMP NOT NULL,
+    PRIMARY KEY(conversation, seq)
+);
+
+CREATE TABLE thread_messages(
+    thread_id  TEXT NOT NULL,
+    id         TEXT NOT NULL,
+    sender     TEXT NOT NULL,
+    msg        TEXT NOT NULL,
+    reply_to   TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY(thread_id, id)
+);
+
+CREATE TABLE thread_counts(
+    thread_id TEXT PRIMARY KEY,
+    replies   INTEGER NOT NULL
+);
+
+CREATE TABLE thread_subscribers(
+    thread_id TEXT NOT NULL,
+    username  TEXT NOT NULL,
+    PRIMARY KEY(thread_id, username)
+);
+
+CREATE TABLE mentions(
+    username   TEXT NOT NULL,
+    id         TEXT NOT NULL,
+    sender     TEXT NOT NULL,
+    msg        TEXT NOT NULL,
+    group_name TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY(username, id)
+);
+
+CREATE TABLE last_read(
+    username     TEXT NOT NULL,
+    conversation TEXT NOT NULL,
+    message_id   TEXT NOT NULL,
+    created_at   TIMESTAMP NOT NULL,
+    PRIMARY KEY(username, conversation)
+);
+
+-- one row per conversation of a user, replaced when a newer message arrives
+CREATE TABLE inbox(
+    username        TEXT NOT NULL,
+    conversation    TEXT NOT NULL,
+    last_message_id TEXT NOT NULL,
+    sender          TEXT NOT NULL,
+    preview         TEXT NOT NULL,
+    is_group        BOOLEAN NOT NULL,
+    created_at      TIMESTAMP NOT NULL,
+    PRIMARY KEY(username, conversation)
+);
+CREATE INDEX inbox_recent ON inbox(username, last_message_id);
+
+CREATE TABLE search_index(
+    conversation TEXT NOT NULL,
+    term         TEXT NOT NULL,
+    message_id   TEXT NOT NULL,
+    sender       TEXT NOT NULL,
+    msg          TEXT NOT NULL,
+    created_at   TIMESTAMP NOT NULL,
+    PRIMARY KEY(conversation, term, message_id)
+);
+
+CREATE TABLE attachments(
+    id              TEXT PRIMARY KEY,
+    filename        TEXT NOT NULL,
+    mime_type       TEXT NOT NULL,
+    size            INTEGER NOT NULL,
+    uploader        TEXT NOT NULL,
+    conversation    TEXT NOT NULL,
+    received        INTEGER NOT NULL DEFAULT 0,
+    complete        BOOLEAN NOT NULL DEFAULT FALSE,
+    blob_key        TEXT NOT NULL DEFAULT '',
+    width           INTEGER NOT NULL DEFAULT 0,
+    height          INTEGER NOT NULL DEFAULT 0,
+    thumbnail_key   TEXT NOT NULL DEFAULT '',
+    thumb_width     INTEGER NOT NULL DEFAULT 0,
+    thumb_height    INTEGER NOT NULL DEFAULT 0,
+    thumb_mime_type TEXT NOT NULL DEFAULT '',
+    created_at      TIMESTAMP NOT NULL
+);
@@ -0,0 +1,196 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/naman1402/distributed-chat-app/settings"
+	_ "modernc.org/sqlite"
+)
+
+//go:embed migrations
+var migrations embed.FS
+
+var (
+	// SQL is the connection pool of the sqlite or postgres backend
+	SQL *sql.DB
+	// Dialect is "sqlite" or "postgres"
+	Dialect string
+)
+
+// SetupSQL opens the relational backend and brings its schema up to date
+// Implementation:
+// 1. Opens the pool, sqlite uses a single connection in WAL mode with a busy timeout
+// 2. Applies the pool settings and checks the connection
+// 3. Runs the migrations of the dialect that were not applied yet
+// Panics if the database cannot be opened or migrated
+func SetupSQL(cfg settings.Storage) {
+	Dialect = cfg.Backend
+	driver, dsn := "pgx", cfg.DSN
+	if Dialect == "sqlite" {
+		driver = "sqlite"
+		if dsn == "" {
+			dsn = "./data/chat.db"
+		}
+		if !strings.HasPrefix(dsn, "file:") {
+			os.MkdirAll(filepath.Dir(dsn), 0o755)
+			dsn = "file:" + dsn + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+		}
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		fmt.Println("database error")
+		panic(err)
+	}
+	if Dialect == "sqlite" {
+		db.SetMaxOpenConns(1)
+	} else if cfg.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime.Duration)
+	if err := db.Ping(); err != nil {
+		fmt.Println("database error")
+		panic(err)
+	}
+	SQL = db
+	if err := migrate(); err != nil {
+		panic(err)
+	}
+}
+
+// pingTimeout bounds the connection check of Ping
+const pingTimeout = 5 * time.Second
+
+// SQLPing checks that the database accepts connections
+func SQLPing() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	return SQL.PingContext(ctx)
+}
+
+// migrationLock is the postgres advisory lock key held while migrating
+const migrationLock = 0x63686174 // "chat"
+
+// migrate applies migrations/{dialect}/*.sql in name order, each in its own transaction
+// applied versions are recorded in schema_migrations
+// on postgres the migrations run under pg_advisory_lock, servers starting together wait
+// for the first one instead of applying the same migration twice; the lock belongs to
+// the session, so everything runs on one connection
+func migrate() error {
+	ctx := context.Background()
+	conn, err := SQL.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if Dialect == "postgres" {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLock); err != nil {
+			return err
+		}
+		defer func() {
+			if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLock); err != nil {
+				fmt.Println(err)
+			}
+		}()
+	}
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations(version TEXT PRIMARY KEY, applied_at TIMESTAMP NOT NULL)`); err != nil {
+		return err
+	}
+	dir := "migrations/" + Dialect
+	files, err := migrations.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	for _, file := range files {
+		version := strings.TrimSuffix(file.Name(), ".sql")
+		var applied int
+		if err := conn.QueryRowContext(ctx, Rebind(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`), version).Scan(&applied); err != nil {
+			return err
+		}
+		if applied > 0 {
+			continue
+		}
+		script, err := migrations.ReadFile(dir + "/" + file.Name())
+		if err != nil {
+			return err
+		}
+		if err := applyMigration(ctx, conn, version, string(script)); err != nil {
+			return fmt.Errorf("migration %s: %w", version, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, version, script string) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range strings.Split(script, ";\n") {
+		if strings.TrimSpace(stripComments(statement)) == "" {
+			continue
+		}
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(Rebind(`INSERT INTO schema_migrations(version, applied_at) VALUES (?, ?)`), version, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// stripComments drops "--" comment lines
+func stripComments(statement string) string {
+	lines := []string{}
+	for _, line := range strings.Split(statement, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// IsConflict reports whether err is a unique or primary key violation, on both dialects
+// (SQLSTATE 23505 on postgres, SQLITE_CONSTRAINT_PRIMARYKEY or _UNIQUE on sqlite)
+func IsConflict(err error) bool {
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		return pgErr.SQLState() == "23505"
+	}
+	var sqliteErr interface{ Code() int }
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code() == 1555 || sqliteErr.Code() == 2067)
+}
+
+// Rebind rewrites the ? placeholders of query to $1, $2... for postgres
+func Rebind(query string) string {
+	if Dialect != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -1,9 +1,26 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+
 	"github.com/naman1402/distributed-chat-app/router"
+	"github.com/naman1402/distributed-chat-app/settings"
 )
 
 func main() {
-	router.Start()
+	// defaults < config file < environment < flags
+	cfg, err := settings.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	cfg.Print(os.Stdout)
+	if err := router.Start(cfg); err != nil {
+		log.Fatalf("failed to start: %v", err)
+	}
 }
@@ -0,0 +1,261 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// JPEG markers and EXIF tags used while stripping location data
+const (
+	markerTEM  = 0x01
+	markerRST0 = 0xD0
+	markerRST7 = 0xD7
+	markerSOI  = 0xD8
+	markerEOI  = 0xD9
+	markerSOS  = 0xDA
+	markerAPP1 = 0xE1
+	tagGPSIFD  = 0x8825
+)
+
+// ErrMalformed is returned for images whose container cannot be fully parsed, their
+// metadata cannot be stripped so they are refused (decoders accept more than the strippers)
+var ErrMalformed = errors.New("image container cannot be parsed")
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// stripJPEG removes location data from a JPEG
+// the GPS IFD inside the EXIF segment is wiped in place (other EXIF data such as
+// orientation is kept), EXIF segments that cannot be walked are dropped whole and XMP
+// segments are dropped since they can carry GPS tags too
+// every segment up to EOI is visited, scans included, so segments placed between scans
+// are stripped as well; fill bytes before markers are skipped and data after EOI is dropped
+// returns ErrMalformed if the structure cannot be followed to EOI
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return nil, ErrMalformed
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	i := 2
+	for {
+		if i >= len(data) || data[i] != 0xFF {
+			return nil, ErrMalformed
+		}
+		// any number of 0xFF fill bytes may precede a marker
+		for i+1 < len(data) && data[i+1] == 0xFF {
+			i++
+		}
+		if i+2 > len(data) {
+			return nil, ErrMalformed
+		}
+		marker := data[i+1]
+		if marker == markerEOI {
+			return append(out, 0xFF, markerEOI), nil
+		}
+		if marker == markerTEM || (marker >= markerRST0 && marker <= markerRST7) {
+			out = append(out, 0xFF, marker)
+			i += 2
+			continue
+		}
+		if i+4 > len(data) {
+			return nil, ErrMalformed
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, ErrMalformed
+		}
+		segment := data[i:end]
+		payload := segment[4:]
+		switch {
+		case marker == markerAPP1 && bytes.HasPrefix(payload, xmpHeader):
+		case marker == markerAPP1 && bytes.HasPrefix(payload, exifHeader):
+			segment = append([]byte{}, segment...)
+			if wipeGPS(segment[4+len(exifHeader):]) {
+				out = append(out, segment...)
+			}
+		default:
+			out = append(out, segment...)
+		}
+		i = end
+		if marker == markerSOS {
+			// the entropy-coded data runs until a marker other than RSTn (0xFF00 is a stuffed byte)
+			j := i
+			for {
+				if j+1 >= len(data) {
+					return nil, ErrMalformed
+				}
+				next := data[j+1]
+				if data[j] == 0xFF && next != 0 && next != 0xFF && (next < markerRST0 || next > markerRST7) {
+					break
+				}
+				j++
+			}
+			out = append(out, data[i:j]...)
+			i = j
+		}
+	}
+}
+
+// typeSizes is the byte size of each TIFF field type
+var typeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// wipeGPS zeroes every value of the GPS IFD of a TIFF structure and empties the IFD
+// it reports false if the structure cannot be walked (the offsets come from the upload and
+// may point past the segment), the caller then drops the whole segment
+func wipeGPS(tiff []byte) bool {
+	if len(tiff) < 8 {
+		return false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return false
+	}
+	ifd0 := int(order.Uint32(tiff[4:8]))
+	gps := -1
+	ok := forEachEntry(tiff, order, ifd0, func(entry []byte) bool {
+		if order.Uint16(entry[0:2]) == tagGPSIFD {
+			gps = int(order.Uint32(entry[8:12]))
+		}
+		return true
+	})
+	if !ok {
+		return false
+	}
+	if gps < 0 {
+		return true
+	}
+	ok = forEachEntry(tiff, order, gps, func(entry []byte) bool {
+		size := typeSizes[order.Uint16(entry[2:4])] * int(order.Uint32(entry[4:8]))
+		if size > 4 {
+			offset := int(order.Uint32(entry[8:12]))
+			if offset < 0 || size < 0 || offset+size > len(tiff) {
+				return false
+			}
+			clear(tiff[offset : offset+size])
+		}
+		clear(entry)
+		return true
+	})
+	if !ok {
+		return false
+	}
+	order.PutUint16(tiff[gps:gps+2], 0)
+	return true
+}
+
+// forEachEntry calls fn with each 12-byte entry of the IFD starting at offset
+// it reports false if the IFD does not fit in tiff or fn returns false
+func forEachEntry(tiff []byte, order binary.ByteOrder, offset int, fn func(entry []byte) bool) bool {
+	if offset < 0 || offset+2 > len(tiff) {
+		return false
+	}
+	count := int(order.Uint16(tiff[offset : offset+2]))
+	for n := 0; n < count; n++ {
+		start := offset + 2 + n*12
+		if start+12 > len(tiff) || !fn(tiff[start:start+12]) {
+			return false
+		}
+	}
+	return true
+}
+
+// pngMetadataKeywords are the keywords of PNG text chunks holding XMP or EXIF data
+// (XMP as specified, EXIF and XMP as written by ImageMagick), both can carry GPS tags
+var pngMetadataKeywords = map[string]bool{
+	"XML:com.adobe.xmp":     true,
+	"Raw profile type exif": true,
+	"Raw profile type APP1": true,
+	"Raw profile type xmp":  true,
+}
+
+// isPNGMetadata reports whether the chunk carries EXIF or XMP data
+func isPNGMetadata(chunkType string, payload []byte) bool {
+	switch chunkType {
+	case "eXIf":
+		return true
+	case "iTXt", "tEXt", "zTXt":
+		keyword, _, _ := bytes.Cut(payload, []byte{0})
+		return pngMetadataKeywords[string(keyword)]
+	}
+	return false
+}
+
+// stripPNG drops eXIf chunks and the text chunks holding XMP or EXIF, which can carry GPS tags
+// data after IEND is dropped, ErrMalformed is returned if the chunks cannot be followed to IEND
+func stripPNG(data []byte) ([]byte, error) {
+	signature := []byte("\x89PNG\r\n\x1a\n")
+	if !bytes.HasPrefix(data, signature) {
+		return nil, ErrMalformed
+	}
+	out := append([]byte{}, signature...)
+	i := len(signature)
+	for i+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, ErrMalformed
+		}
+		chunkType := string(data[i+4 : i+8])
+		if !isPNGMetadata(chunkType, data[i+8:i+8+length]) {
+			out = append(out, data[i:end]...)
+		}
+		if chunkType == "IEND" {
+			return out, nil
+		}
+		i = end
+	}
+	return nil, ErrMalformed
+}
+
+// VP8X flags announcing the metadata chunks of an extended WebP
+const (
+	webpFlagXMP  = 0x04
+	webpFlagEXIF = 0x08
+)
+
+// stripWebP drops the EXIF and XMP chunks of a WebP, which can carry GPS tags,
+// and clears their flags in the VP8X header
+// returns ErrMalformed if the chunks do not exactly cover the file
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, ErrMalformed
+	}
+	out := append([]byte{}, data[:12]...)
+	i := 12
+	for i < len(data) {
+		if i+8 > len(data) {
+			return nil, ErrMalformed
+		}
+		fourCC := string(data[i : i+4])
+		size := int(binary.LittleEndian.Uint32(data[i+4 : i+8]))
+		if size < 0 || i+8+size > len(data) {
+			return nil, ErrMalformed
+		}
+		// payloads are padded to an even size, a missing final padding byte is tolerated
+		end := min(i+8+size+size%2, len(data))
+		switch fourCC {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte{}, data[i:end]...)
+			if size > 0 {
+				chunk[8] &^= webpFlagEXIF | webpFlagXMP
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out, nil
+}
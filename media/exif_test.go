@@ -0,0 +1,273 @@
+package media
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// tiffWithGPS builds a little-endian TIFF whose IFD0 points at a GPS IFD at gpsOffset,
+// the GPS IFD (if inside the buffer) holds one GPSLatitude entry of 3 rationals
+func tiffWithGPS(gpsOffset uint32) []byte {
+	tiff := make([]byte, 64)
+	copy(tiff, "II*\x00")
+	binary.LittleEndian.PutUint32(tiff[4:8], 8)
+	// IFD0: one entry, GPS IFD pointer (LONG)
+	binary.LittleEndian.PutUint16(tiff[8:10], 1)
+	entry := tiff[10:22]
+	binary.LittleEndian.PutUint16(entry[0:2], tagGPSIFD)
+	binary.LittleEndian.PutUint16(entry[2:4], 4)
+	binary.LittleEndian.PutUint32(entry[4:8], 1)
+	binary.LittleEndian.PutUint32(entry[8:12], gpsOffset)
+	if int(gpsOffset)+14 <= 40 {
+		// GPSLatitude, RATIONAL x3 stored at 40
+		binary.LittleEndian.PutUint16(tiff[gpsOffset:], 1)
+		gpsEntry := tiff[gpsOffset+2 : gpsOffset+14]
+		binary.LittleEndian.PutUint16(gpsEntry[0:2], 2)
+		binary.LittleEndian.PutUint16(gpsEntry[2:4], 5)
+		binary.LittleEndian.PutUint32(gpsEntry[4:8], 3)
+		binary.LittleEndian.PutUint32(gpsEntry[8:12], 40)
+		copy(tiff[40:64], bytes.Repeat([]byte{0x2A}, 24))
+	}
+	return tiff
+}
+
+// jpegWithEXIF encodes a small JPEG with tiff as its EXIF segment
+func jpegWithEXIF(t *testing.T, tiff []byte) []byte {
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	payload := append(append([]byte{}, exifHeader...), tiff...)
+	segment := []byte{0xFF, markerAPP1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:4], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+	data := b.Bytes()
+	return append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
+}
+
+func TestStripJPEG(t *testing.T) {
+	tests := []struct {
+		name      string
+		gpsOffset uint32
+	}{
+		{"gps ifd inside the segment", 22},
+		{"gps ifd offset past the segment", 0xFFFFFF00},
+		{"gps ifd offset at the end of the segment", 63},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := jpegWithEXIF(t, tiffWithGPS(tt.gpsOffset))
+			img, err := Process(data, "image/jpeg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(img.Data, bytes.Repeat([]byte{0x2A}, 24)) {
+				t.Fatal("GPS values were not wiped")
+			}
+		})
+	}
+}
+
+// minimal 1x1 lossless WebP
+const webp1x1 = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+func webpChunk(fourCC string, payload []byte) []byte {
+	chunk := append([]byte(fourCC), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(chunk[4:8], uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func TestStripWebP(t *testing.T) {
+	simple, _ := base64.StdEncoding.DecodeString(webp1x1)
+	vp8x := make([]byte, 10)
+	vp8x[0] = webpFlagEXIF | webpFlagXMP
+	body := []byte("WEBP")
+	body = append(body, webpChunk("VP8X", vp8x)...)
+	body = append(body, simple[12:]...)
+	body = append(body, webpChunk("EXIF", []byte("Exif\x00\x00GPS-SECRET"))...)
+	body = append(body, webpChunk("XMP ", []byte("<x:xmpmeta>GPS-SECRET</x:xmpmeta>"))...)
+	data := append([]byte("RIFF\x00\x00\x00\x00"), body...)
+	binary.LittleEndian.PutUint32(data[4:8], uint32(len(body)))
+
+	img, err := Process(data, "image/webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(img.Data, []byte("GPS-SECRET")) {
+		t.Fatal("EXIF or XMP chunk kept")
+	}
+	if flags := img.Data[20]; flags&(webpFlagEXIF|webpFlagXMP) != 0 {
+		t.Fatalf("VP8X flags %#x still announce metadata", flags)
+	}
+	if size := binary.LittleEndian.Uint32(img.Data[4:8]); int(size) != len(img.Data)-8 {
+		t.Fatalf("RIFF size %d, want %d", size, len(img.Data)-8)
+	}
+	if img.Width != 1 || img.Height != 1 {
+		t.Fatalf("dimensions %dx%d, want 1x1", img.Width, img.Height)
+	}
+}
+
+// pngChunk encodes a PNG chunk with its CRC
+func pngChunk(chunkType string, payload []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, payload...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func TestStripPNG(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	src.Set(1, 1, color.RGBA{255, 0, 0, 255})
+	var b bytes.Buffer
+	if err := png.Encode(&b, src); err != nil {
+		t.Fatal(err)
+	}
+	encoded := b.Bytes()
+	// after the signature (8) and IHDR (25)
+	head, tail := encoded[:33], encoded[33:]
+	metadata := [][]byte{
+		pngChunk("eXIf", []byte("MM\x00*GPS-SECRET")),
+		pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta>GPS-SECRET</x:xmpmeta>")),
+		pngChunk("zTXt", []byte("Raw profile type exif\x00\x00GPS-SECRET")),
+	}
+	comment := pngChunk("tEXt", []byte("Comment\x00kept"))
+	data := append([]byte{}, head...)
+	for _, chunk := range metadata {
+		data = append(data, chunk...)
+	}
+	data = append(append(data, comment...), tail...)
+
+	img, err := Process(data, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(img.Data, []byte("GPS-SECRET")) {
+		t.Fatal("metadata chunk kept")
+	}
+	if !bytes.Contains(img.Data, comment) {
+		t.Fatal("unrelated text chunk dropped")
+	}
+	if _, err := png.Decode(bytes.NewReader(img.Data)); err != nil {
+		t.Fatalf("stripped PNG does not decode: %v", err)
+	}
+}
+
+// jpegSegment builds a JPEG segment with its length
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:4], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// hasJPEGMetadata reports whether any APP1 segment holding EXIF GPS values or XMP is left
+func hasJPEGMetadata(data []byte) bool {
+	return bytes.Contains(data, []byte("GPS-SECRET")) || bytes.Contains(data, xmpHeader) ||
+		bytes.Contains(data, bytes.Repeat([]byte{0x2A}, 24))
+}
+
+func TestStripJPEGStructure(t *testing.T) {
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := b.Bytes()
+	exif := jpegSegment(markerAPP1, append(append([]byte{}, exifHeader...), tiffWithGPS(22)...))
+	xmp := jpegSegment(markerAPP1, append(append([]byte{}, xmpHeader...), "<x:xmpmeta>GPS-SECRET</x:xmpmeta>"...))
+	badTIFF := jpegSegment(markerAPP1, append(append([]byte{}, exifHeader...), "XX*\x00GPS-SECRET"...))
+	// insert places extra bytes right after SOI
+	insert := func(extra ...[]byte) []byte {
+		data := append([]byte{}, encoded[:2]...)
+		for _, e := range extra {
+			data = append(data, e...)
+		}
+		return append(data, encoded[2:]...)
+	}
+	eoi := len(encoded) - 2
+
+	tests := []struct {
+		name    string
+		data    []byte
+		invalid bool
+	}{
+		{"fill bytes before the exif segment", insert([]byte{0xFF, 0xFF, 0xFF}, exif), false},
+		{"fill bytes before the xmp segment", insert([]byte{0xFF}, xmp), false},
+		{"unparseable exif is dropped", insert(badTIFF), false},
+		{"segments after the scan", append(append(append([]byte{}, encoded[:eoi]...), append(exif, xmp...)...), encoded[eoi:]...), false},
+		{"data after eoi", append(append([]byte{}, encoded...), xmp...), false},
+		{"garbage between segments", insert([]byte{0x00}, xmp), true},
+		{"truncated segment", append(append([]byte{}, encoded[:2]...), xmp[:20]...), true},
+		// the length swallows the scan, no marker follows it
+		{"segment covering the rest of the file", insert(xmp[:4]), true},
+		{"missing eoi", insert(xmp)[:len(encoded)+len(xmp)-2], true},
+		{"no soi", encoded[2:], true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := Process(tt.data, "image/jpeg")
+			if tt.invalid {
+				if !errors.Is(err, ErrMalformed) {
+					t.Fatalf("got %v, want ErrMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hasJPEGMetadata(img.Data) {
+				t.Fatal("EXIF GPS or XMP kept")
+			}
+		})
+	}
+}
+
+func TestStripMalformed(t *testing.T) {
+	simple, _ := base64.StdEncoding.DecodeString(webp1x1)
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	encoded := b.Bytes()
+	exif := pngChunk("eXIf", []byte("MM\x00*GPS-SECRET"))
+
+	tests := []struct {
+		name     string
+		mimeType string
+		data     []byte
+	}{
+		{"png truncated chunk", "image/png", append(append([]byte{}, encoded[:33]...), exif[:len(exif)-3]...)},
+		{"png without iend", "image/png", append(append([]byte{}, encoded[:len(encoded)-12]...), exif...)},
+		{"png chunk length past the file", "image/png", append(append([]byte{}, encoded[:33]...), 0x7F, 0xFF, 0xFF, 0xFF, 'e', 'X', 'I', 'f')},
+		{"webp truncated chunk", "image/webp", append(append([]byte{}, simple...), webpChunk("EXIF", []byte("GPS-SECRET"))[:12]...)},
+		{"webp trailing bytes", "image/webp", append(append([]byte{}, simple...), "EXI"...)},
+		{"webp bad header", "image/webp", append([]byte("RIFX"), simple[4:]...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Process(tt.data, tt.mimeType); !errors.Is(err, ErrMalformed) {
+				t.Fatalf("got %v, want ErrMalformed", err)
+			}
+		})
+	}
+
+	// data after IEND is dropped
+	data := append(append([]byte{}, encoded...), exif...)
+	img, err := Process(data, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(img.Data, []byte("GPS-SECRET")) {
+		t.Fatal("data after IEND kept")
+	}
+}
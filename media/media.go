@@ -0,0 +1,111 @@
+// Package media extracts metadata from uploaded images and generates their thumbnails
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif" // registers the GIF decoder
+	"image/jpeg"
+	"image/png"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // registers the WebP decoder
+)
+
+// thumbnail bounds and decoding limits
+const (
+	// ThumbnailSize is the largest width and height of a thumbnail
+	ThumbnailSize = 320
+	// maxPixels refuses images that would take too much memory to decode
+	maxPixels = 40_000_000
+	// thumbnailQuality is the JPEG quality of thumbnails
+	thumbnailQuality = 80
+)
+
+// ErrTooLarge is returned for images with more than maxPixels pixels
+var ErrTooLarge = errors.New("image dimensions too large")
+
+// Image is the result of processing an uploaded image
+// Data: the image with location metadata removed, store this instead of the upload
+// Thumbnail: encoded thumbnail (JPEG, or PNG when the source can be transparent)
+type Image struct {
+	Data          []byte
+	Width         int
+	Height        int
+	Thumbnail     []byte
+	ThumbnailMime string
+	ThumbWidth    int
+	ThumbHeight   int
+}
+
+// IsImage reports whether the MIME type is handled by Process
+func IsImage(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// Process strips location metadata from the image, reads its dimensions and generates a thumbnail
+// Implementation:
+// 1. Removes GPS and XMP metadata (JPEG) or the EXIF and XMP chunks (PNG, WebP), pixels are untouched,
+// images whose container cannot be parsed are refused with ErrMalformed
+// 2. Reads the dimensions and rejects images above maxPixels before decoding
+// 3. Scales the image to fit ThumbnailSize x ThumbnailSize, never upscaling
+func Process(data []byte, mimeType string) (*Image, error) {
+	var err error
+	switch mimeType {
+	case "image/jpeg":
+		data, err = stripJPEG(data)
+	case "image/png":
+		data, err = stripPNG(data)
+	case "image/webp":
+		data, err = stripWebP(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, ErrTooLarge
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	res := &Image{Data: data, Width: cfg.Width, Height: cfg.Height}
+	res.ThumbWidth, res.ThumbHeight = fit(cfg.Width, cfg.Height, ThumbnailSize)
+	thumb := image.NewRGBA(image.Rect(0, 0, res.ThumbWidth, res.ThumbHeight))
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), src, src.Bounds(), draw.Over, nil)
+
+	var buf bytes.Buffer
+	if strings.HasSuffix(mimeType, "/jpeg") {
+		res.ThumbnailMime = "image/jpeg"
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: thumbnailQuality})
+	} else {
+		res.ThumbnailMime = "image/png"
+		err = png.Encode(&buf, thumb)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.Thumbnail = buf.Bytes()
+	return res, nil
+}
+
+// fit returns the dimensions of width x height scaled down to fit a bound x bound box
+func fit(width, height, bound int) (int, int) {
+	if width <= bound && height <= bound {
+		return width, height
+	}
+	if width >= height {
+		return bound, max(1, height*bound/width)
+	}
+	return max(1, width*bound/height), bound
+}
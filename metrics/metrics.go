@@ -0,0 +1,108 @@
+// Package metrics defines the Prometheus metrics of the server, served on /metrics
+package metrics
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// message types used as the type label: "private" and "group" for chat messages,
+// the event name (thread_reply, mention, unread, ...) for events
+
+var (
+	// registerer adds the server label to every metric, see Setup
+	registerer prometheus.Registerer = prometheus.DefaultRegisterer
+
+	// callBuckets covers 0.5ms to about 4s, for storage and Redis calls
+	callBuckets = prometheus.ExponentialBuckets(0.0005, 2, 14)
+
+	// MessagesReceived counts the messages read from WebSocket clients, by type
+	MessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chat",
+		Name:      "messages_received_total",
+		Help:      "Messages received from WebSocket clients, by type.",
+	}, []string{"type"})
+
+	// MessagesPublished counts the messages published to the broker, by type
+	MessagesPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chat",
+		Name:      "messages_published_total",
+		Help:      "Messages published to the broker for the servers of their receivers, by type.",
+	}, []string{"type"})
+
+	// MessagesDelivered counts the messages written to WebSocket clients, by type
+	MessagesDelivered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chat",
+		Name:      "messages_delivered_total",
+		Help:      "Messages written to WebSocket clients, by type.",
+	}, []string{"type"})
+
+	// MessagesDroppedOffline counts the messages not delivered because the receiver was offline
+	MessagesDroppedOffline = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chat",
+		Name:      "messages_dropped_offline_total",
+		Help:      "Messages not delivered live because their receiver was offline, by type.",
+	}, []string{"type"})
+
+	// DeliveryLatency is the time from a message being accepted to being written to a receiver
+	DeliveryLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "chat",
+		Name:      "delivery_latency_seconds",
+		Help:      "Time from a message being accepted by its sender's server to being written to a receiver, by type.",
+		Buckets:   []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"type"})
+
+	// CassandraDuration is the duration of each Cassandra query attempt
+	CassandraDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "chat",
+		Name:      "cassandra_query_duration_seconds",
+		Help:      "Duration of Cassandra query attempts, by operation, table and status.",
+		Buckets:   callBuckets,
+	}, []string{"operation", "table", "status"})
+
+	// RedisDuration is the duration of each Redis command or pipeline
+	RedisDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "chat",
+		Name:      "redis_command_duration_seconds",
+		Help:      "Duration of Redis commands and pipelines, by command and status.",
+		Buckets:   callBuckets,
+	}, []string{"command", "status"})
+)
+
+// Setup registers the metrics with the server label set to serverId, it must run
+// before GaugeFunc
+func Setup(serverId string) {
+	registerer = prometheus.WrapRegistererWith(prometheus.Labels{"server": serverId}, prometheus.DefaultRegisterer)
+	registerer.MustRegister(
+		MessagesReceived,
+		MessagesPublished,
+		MessagesDelivered,
+		MessagesDroppedOffline,
+		DeliveryLatency,
+		CassandraDuration,
+		RedisDuration,
+	)
+}
+
+// GaugeFunc registers a gauge whose value is read from fn on every scrape
+func GaugeFunc(name, help string, fn func() float64) {
+	registerer.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "chat",
+		Name:      name,
+		Help:      help,
+	}, fn))
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
+
+// status is the status label of a call
+func status(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/redis/go-redis/v9"
+)
+
+// CassandraObserver records the duration of every query and batch attempt of a session,
+// retries and speculative executions are recorded separately
+type CassandraObserver struct{}
+
+func (CassandraObserver) ObserveQuery(_ context.Context, q gocql.ObservedQuery) {
+	operation, table := statementLabels(q.Statement)
+	CassandraDuration.WithLabelValues(operation, table, status(q.Err)).Observe(q.End.Sub(q.Start).Seconds())
+}
+
+func (CassandraObserver) ObserveBatch(_ context.Context, b gocql.ObservedBatch) {
+	CassandraDuration.WithLabelValues("batch", "", status(b.Err)).Observe(b.End.Sub(b.Start).Seconds())
+}
+
+// statementLabels returns the operation (select, insert, ...) and the table of a CQL statement
+func statementLabels(statement string) (string, string) {
+	words := strings.Fields(statement)
+	if len(words) == 0 {
+		return "", ""
+	}
+	operation := strings.ToLower(words[0])
+	after := ""
+	switch operation {
+	case "select", "delete":
+		after = "from"
+	case "insert":
+		after = "into"
+	case "update":
+		if len(words) > 1 {
+			return operation, tableName(words[1])
+		}
+	}
+	for i := 1; i < len(words)-1; i++ {
+		if strings.EqualFold(words[i], after) {
+			return operation, tableName(words[i+1])
+		}
+	}
+	return operation, ""
+}
+
+// tableName strips a column list glued to the table name, as in "messages(id, ...)"
+func tableName(word string) string {
+	name, _, _ := strings.Cut(word, "(")
+	return strings.ToLower(name)
+}
+
+// RedisHook records the duration of every Redis command and pipeline,
+// a missing key (redis.Nil) is not an error
+// blocking reads such as XREADGROUP include the time spent waiting
+type RedisHook struct{}
+
+func (RedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (RedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		RedisDuration.WithLabelValues(cmd.Name(), redisStatus(err)).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+func (RedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		RedisDuration.WithLabelValues("pipeline", redisStatus(err)).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+func redisStatus(err error) string {
+	if err == redis.Nil {
+		return "ok"
+	}
+	return status(err)
+}
@@ -0,0 +1,36 @@
+package model
+
+import (
+	"errors"
+	"sort"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
+// FieldError describes an invalid input field, also used for WebSocket error messages
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ErrorResponse is the body of every failed HTTP request
+// Error: what went wrong, Fields: the invalid inputs when the request failed validation
+type ErrorResponse struct {
+	Error  string       `json:"error"`
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// FieldErrors converts validation errors to field errors sorted by field name
+// other errors are returned as a single error without a field
+func FieldErrors(err error) []FieldError {
+	var errs validation.Errors
+	if !errors.As(err, &errs) {
+		return []FieldError{{Message: err.Error()}}
+	}
+	fields := []FieldError{}
+	for field, e := range errs {
+		fields = append(fields, FieldError{Field: field, Message: e.Error()})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Field < fields[j].Field })
+	return fields
+}
@@ -0,0 +1,71 @@
+package model
+
+import "time"
+
+// ChatMessage is a message as stored in private_chat, group_chat or thread_messages
+type ChatMessage struct {
+	Id          string    `json:"id"`
+	Message     string    `json:"msg"`
+	Sender      string    `json:"sender"`
+	Receiver    string    `json:"receiver,omitempty"`
+	GroupName   string    `json:"group_name,omitempty"`
+	ReplyTo     string    `json:"reply_to,omitempty"`
+	ThreadId    string    `json:"thread_id,omitempty"`
+	ReplyCount  int       `json:"reply_count,omitempty"`
+	Mentions    []string  `json:"mentions,omitempty"`
+	MentionRoom bool      `json:"mention_room,omitempty"`
+	Attachments []string  `json:"attachments,omitempty"`
+	Seq         int64     `json:"seq,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// ThreadSubscription is the request body used to follow or unfollow a thread,
+// for the logged in user
+type ThreadSubscription struct {
+	ThreadId string `json:"thread_id"`
+}
+
+// InboxEntry is one conversation of a user's inbox
+type InboxEntry struct {
+	Conversation  string    `json:"conversation"`
+	Group         bool      `json:"is_group"`
+	LastMessageId string    `json:"last_message_id"`
+	Sender        string    `json:"sender"`
+	Preview       string    `json:"preview"`
+	Unread        int64     `json:"unread"`
+	Mentions      int64     `json:"mentions"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// Attachment is a file uploaded for a message
+// Width, Height and the thumbnail fields are only set for images
+// ThumbnailUrl is a signed link valid for a limited time
+// Uploader, Conversation, Offset, Complete, Key and ThumbnailKey are internal upload state
+type Attachment struct {
+	Id           string `json:"id"`
+	Filename     string `json:"filename,omitempty"`
+	MimeType     string `json:"mime_type,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	ThumbnailUrl string `json:"thumbnail_url,omitempty"`
+	ThumbWidth   int    `json:"thumb_width,omitempty"`
+	ThumbHeight  int    `json:"thumb_height,omitempty"`
+	ThumbMime    string `json:"thumb_mime_type,omitempty"`
+	Uploader     string `json:"-"`
+	Conversation string `json:"-"`
+	Offset       int64  `json:"-"`
+	Complete     bool   `json:"-"`
+	Key          string `json:"-"`
+	ThumbnailKey string `json:"-"`
+}
+
+// UploadReq starts a resumable upload for a conversation (receiver for DMs, group_name for rooms),
+// the uploader is the logged in user
+type UploadReq struct {
+	Receiver  string `json:"receiver,omitempty"`
+	GroupName string `json:"group_name,omitempty"`
+	Filename  string `json:"filename"`
+	MimeType  string `json:"mime_type"`
+	Size      int64  `json:"size"`
+}
@@ -1,7 +1,36 @@
 package model
 
+import (
+	"fmt"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
 type Room struct {
 	Id   string `json:"room_id"`
 	Name string `json:"name"`
 	User string `json:"user"`
 }
+
+// MaxRoomNameLength is the longest room name accepted, set from the limits settings
+var MaxRoomNameLength = 25
+
+// Validate checks a create request
+// - Name: Required, at most MaxRoomNameLength chars of letters, digits, '_', '-' and '.'
+func (r Room) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Name,
+			validation.Required.Error("name is required"),
+			validation.RuneLength(1, MaxRoomNameLength).Error(fmt.Sprintf("character length should be between 1 and %d", MaxRoomNameLength)),
+			nameRule,
+		),
+	)
+}
+
+// ValidateJoin checks a join request, the room name and the joining user are required
+func (r Room) ValidateJoin() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Name, validation.Required.Error("name is required")),
+		validation.Field(&r.User, validation.Required.Error("user is required")),
+	)
+}
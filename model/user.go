@@ -1,5 +1,12 @@
 package model
 
+import (
+	"fmt"
+	"regexp"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
 type User struct {
 	Id       string `json:"user_id"`
 	Username string `json:"username"`
@@ -9,6 +16,32 @@ type LoginReq struct {
 	Id string `json:"id"`
 }
 
+// names of users and rooms end up in conversation ids ("dm:{user}:{user}", "group:{room}")
+// and Redis keys, so they are restricted to letters, digits, '_', '-' and '.'
+var nameRule = validation.Match(regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)).Error("may only contain letters, digits, '_', '-' and '.'")
+
+// MaxUsernameLength is the longest username accepted at sign up
+const MaxUsernameLength = 32
+
+// Validate checks the sign up request
+// - Username: Required, at most MaxUsernameLength chars of letters, digits, '_', '-' and '.'
+func (u User) Validate() error {
+	return validation.ValidateStruct(&u,
+		validation.Field(&u.Username,
+			validation.Required.Error("username is required"),
+			validation.RuneLength(1, MaxUsernameLength).Error(fmt.Sprintf("character length should be between 1 and %d", MaxUsernameLength)),
+			nameRule,
+		),
+	)
+}
+
+// Validate checks the login request
+func (l LoginReq) Validate() error {
+	return validation.ValidateStruct(&l,
+		validation.Field(&l.Id, validation.Required.Error("id is required")),
+	)
+}
+
 // func CreateUser(userId string, username string) {
 // 	query := `INSERT INTO users(id, username) VALUES(?, ?)`
 // 	database.ExecuteQuery(query, userId, username)
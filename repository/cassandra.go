@@ -0,0 +1,393 @@
+package repository
+
+import (
+	"sync"
+
+	"github.com/gocql/gocql"
+	"github.com/naman1402/distributed-chat-app/database"
+	"github.com/naman1402/distributed-chat-app/model"
+)
+
+// Cassandra stores everything in the chat keyspace, see db.cql
+type Cassandra struct{}
+
+func (Cassandra) Ping() error {
+	return database.Ping()
+}
+
+// notFound maps gocql's missing row error to ErrNotFound
+func notFound(err error) error {
+	if err == gocql.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+// CreateUser claims the username with a lightweight transaction (ErrExists if taken),
+// then indexes the account by id (users_by_id)
+func (Cassandra) CreateUser(id, username string) error {
+	query := `INSERT INTO users(id, username) VALUES(?, ?) IF NOT EXISTS`
+	if err := insertIfNotExists(query, id, username); err != nil {
+		return err
+	}
+	return database.ExecuteQuery(`INSERT INTO users_by_id(id, username) VALUES(?, ?)`, id, username)
+}
+
+// insertIfNotExists runs an INSERT ... IF NOT EXISTS, ErrExists if the row was already there
+func insertIfNotExists(query string, args ...interface{}) error {
+	applied, err := database.NonIdempotentQuery(query, args...).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return ErrExists
+	}
+	return nil
+}
+
+func (Cassandra) GetUser(username string) (model.User, error) {
+	u := model.User{}
+	query := `SELECT id, username FROM users WHERE username = ?`
+	err := database.SelectQuery(query, username).Scan(&u.Id, &u.Username)
+	return u, notFound(err)
+}
+
+func (Cassandra) GetUserById(id string) (model.User, error) {
+	u := model.User{}
+	query := `SELECT id, username FROM users_by_id WHERE id = ?`
+	err := database.SelectQuery(query, id).Scan(&u.Id, &u.Username)
+	return u, notFound(err)
+}
+
+func (Cassandra) CreateRoom(id, name string) error {
+	query := `INSERT INTO room (id, room_name) VALUES (?, ?) IF NOT EXISTS`
+	return insertIfNotExists(query, id, name)
+}
+
+func (Cassandra) RoomExists(name string) (bool, error) {
+	var id string
+	query := `SELECT id FROM room WHERE room_name = ?`
+	err := database.SelectQuery(query, name).Scan(&id)
+	if err == gocql.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// AddMember writes the membership to room_members and user_rooms in one logged batch
+func (Cassandra) AddMember(room, username string) error {
+	return database.ExecuteBatch(
+		database.Statement{Query: `INSERT INTO room_members(room_name,username)VALUES(?,?)`, Args: []interface{}{room, username}},
+		database.Statement{Query: `INSERT INTO user_rooms(username,room_name)VALUES(?,?)`, Args: []interface{}{username, room}},
+	)
+}
+
+func (Cassandra) Members(room string) ([]string, error) {
+	var username string
+	members := []string{}
+	query := `SELECT username FROM room_members WHERE room_name = ?`
+	iter := database.SelectQuery(query, room).Iter()
+	for iter.Scan(&username) {
+		members = append(members, username)
+	}
+	return members, iter.Close()
+}
+
+func (Cassandra) Rooms(username string) ([]string, error) {
+	var room string
+	rooms := []string{}
+	query := `SELECT room_name FROM user_rooms WHERE username = ?`
+	iter := database.SelectQuery(query, username).Iter()
+	for iter.Scan(&room) {
+		rooms = append(rooms, room)
+	}
+	return rooms, iter.Close()
+}
+
+func (Cassandra) IsMember(room, username string) (bool, error) {
+	var member string
+	query := `SELECT username FROM room_members WHERE room_name = ? AND username = ?`
+	err := database.SelectQuery(query, room, username).Scan(&member)
+	if err == gocql.ErrNotFound {
+		return false, nil
+	}
+	return member != "", err
+}
+
+func (Cassandra) SetServer(username, serverId string) error {
+	query := `INSERT INTO user_mapping (username, server_id) VALUES (?, ?)`
+	return database.ExecuteQuery(query, username, serverId)
+}
+
+// ClearServer deletes the mapping with a lightweight transaction
+func (Cassandra) ClearServer(username, serverId string) error {
+	query := `DELETE FROM user_mapping WHERE username = ? IF server_id = ?`
+	_, err := database.NonIdempotentQuery(query, username, serverId).MapScanCAS(map[string]interface{}{})
+	return err
+}
+
+func (Cassandra) GetServer(username string) (string, error) {
+	var serverId string
+	query := `SELECT server_id FROM user_mapping WHERE username = ?`
+	err := database.SelectQuery(query, username).Scan(&serverId)
+	return serverId, notFound(err)
+}
+
+// GetServers reads the mappings concurrently, each lookup goes straight to a replica
+// of the user's partition, unlike an IN query that makes one coordinator gather them all
+func (Cassandra) GetServers(usernames []string) (map[string]string, error) {
+	var mu sync.Mutex
+	servers := make(map[string]string, len(usernames))
+	query := `SELECT server_id FROM user_mapping WHERE username = ?`
+	err := database.ForEach(len(usernames), func(i int) error {
+		var serverId string
+		err := database.SelectQuery(query, usernames[i]).Scan(&serverId)
+		if err == gocql.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		servers[usernames[i]] = serverId
+		mu.Unlock()
+		return nil
+	})
+	return servers, err
+}
+
+// SavePrivate writes the message and its log entry in one logged batch
+func (Cassandra) SavePrivate(conversation string, m model.ChatMessage) error {
+	query := `INSERT INTO private_chat(id, msg, sender, receiver, reply_to, thread_id, attachments, seq, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?, toTimeStamp(now()))`
+	return database.ExecuteBatch(
+		database.Statement{Query: query, Args: []interface{}{m.Id, m.Message, m.Sender, m.Receiver, m.ReplyTo, m.ThreadId, m.Attachments, m.Seq}},
+		logStatement(conversation, m),
+	)
+}
+
+// SaveGroup writes the message and its log entry in one logged batch
+func (Cassandra) SaveGroup(conversation string, m model.ChatMessage) error {
+	query := `INSERT INTO group_chat(id, msg, sender, group, reply_to, thread_id, mentions, mention_room, attachments, seq, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, toTimeStamp(now()))`
+	return database.ExecuteBatch(
+		database.Statement{Query: query, Args: []interface{}{m.Id, m.Message, m.Sender, m.GroupName, m.ReplyTo, m.ThreadId, m.Mentions, m.MentionRoom, m.Attachments, m.Seq}},
+		logStatement(conversation, m),
+	)
+}
+
+// logStatement stores the message under its sequence number in conversation_log
+func logStatement(conversation string, m model.ChatMessage) database.Statement {
+	query := `INSERT INTO conversation_log(conversation, seq, id, msg, sender, receiver, group, reply_to, thread_id, mentions, mention_room, attachments, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, toTimeStamp(now()))`
+	return database.Statement{Query: query, Args: []interface{}{conversation, m.Seq, m.Id, m.Message, m.Sender, m.Receiver, m.GroupName, m.ReplyTo, m.ThreadId, m.Mentions, m.MentionRoom, m.Attachments}}
+}
+
+// GetMessage looks the message up by id, first in private_chat and then in group_chat
+func (Cassandra) GetMessage(id string) (model.ChatMessage, error) {
+	m := model.ChatMessage{}
+	query := `SELECT id, msg, sender, receiver, reply_to, thread_id, attachments, seq, timestamp FROM private_chat WHERE id = ?`
+	err := database.SelectQuery(query, id).Scan(&m.Id, &m.Message, &m.Sender, &m.Receiver, &m.ReplyTo, &m.ThreadId, &m.Attachments, &m.Seq, &m.Timestamp)
+	if err != gocql.ErrNotFound {
+		return m, err
+	}
+	m = model.ChatMessage{}
+	query = `SELECT id, msg, sender, group, reply_to, thread_id, mentions, mention_room, attachments, seq, timestamp FROM group_chat WHERE id = ?`
+	err = database.SelectQuery(query, id).Scan(&m.Id, &m.Message, &m.Sender, &m.GroupName, &m.ReplyTo, &m.ThreadId, &m.Mentions, &m.MentionRoom, &m.Attachments, &m.Seq, &m.Timestamp)
+	return m, notFound(err)
+}
+
+// MaxSeq reads the first row of the partition, the log is clustered by seq DESC
+func (Cassandra) MaxSeq(conversation string) (int64, error) {
+	var seq int64
+	query := `SELECT seq FROM conversation_log WHERE conversation = ? LIMIT 1`
+	iter := database.SelectQuery(query, conversation).Iter()
+	iter.Scan(&seq)
+	return seq, iter.Close()
+}
+
+func (Cassandra) Log(conversation string, after int64, limit int) ([]model.ChatMessage, error) {
+	messages := []model.ChatMessage{}
+	query := `SELECT seq, id, msg, sender, receiver, group, reply_to, thread_id, mentions, mention_room, attachments, timestamp FROM conversation_log WHERE conversation = ? AND seq > ? ORDER BY seq ASC LIMIT ?`
+	iter := database.SelectQuery(query, conversation, after, limit).Iter()
+	m := model.ChatMessage{}
+	for iter.Scan(&m.Seq, &m.Id, &m.Message, &m.Sender, &m.Receiver, &m.GroupName, &m.ReplyTo, &m.ThreadId, &m.Mentions, &m.MentionRoom, &m.Attachments, &m.Timestamp) {
+		messages = append(messages, m)
+		m = model.ChatMessage{}
+	}
+	return messages, iter.Close()
+}
+
+// SaveReply stores the reply under its thread (clustered by id, so ksuid order = time order)
+// and bumps the reply counter of the parent
+func (Cassandra) SaveReply(threadId string, m model.ChatMessage) error {
+	query := `INSERT INTO thread_messages(thread_id, id, msg, sender, reply_to, timestamp) VALUES (?, ?, ?, ?, ?, toTimeStamp(now()))`
+	if err := database.ExecuteQuery(query, threadId, m.Id, m.Message, m.Sender, m.ReplyTo); err != nil {
+		return err
+	}
+	query = `UPDATE thread_counts SET replies = replies + 1 WHERE thread_id = ?`
+	return database.NonIdempotentQuery(query, threadId).Exec()
+}
+
+func (Cassandra) ReplyCount(threadId string) (int, error) {
+	var replies int64
+	query := `SELECT replies FROM thread_counts WHERE thread_id = ?`
+	err := database.SelectQuery(query, threadId).Scan(&replies)
+	if err == gocql.ErrNotFound {
+		return 0, nil
+	}
+	return int(replies), err
+}
+
+func (Cassandra) Replies(threadId, after string, limit int) ([]model.ChatMessage, error) {
+	replies := []model.ChatMessage{}
+	query := `SELECT id, msg, sender, reply_to, timestamp FROM thread_messages WHERE thread_id = ? AND id > ? LIMIT ?`
+	iter := database.SelectQuery(query, threadId, after, limit).Iter()
+	m := model.ChatMessage{ThreadId: threadId}
+	for iter.Scan(&m.Id, &m.Message, &m.Sender, &m.ReplyTo, &m.Timestamp) {
+		replies = append(replies, m)
+		m = model.ChatMessage{ThreadId: threadId}
+	}
+	return replies, iter.Close()
+}
+
+func (Cassandra) Subscribe(threadId, username string) error {
+	query := `INSERT INTO thread_subscribers(thread_id, username) VALUES (?, ?)`
+	return database.ExecuteQuery(query, threadId, username)
+}
+
+func (Cassandra) Unsubscribe(threadId, username string) error {
+	query := `DELETE FROM thread_subscribers WHERE thread_id = ? AND username = ?`
+	return database.ExecuteQuery(query, threadId, username)
+}
+
+func (Cassandra) Subscribers(threadId string) ([]string, error) {
+	var username string
+	subscribers := []string{}
+	query := `SELECT username FROM thread_subscribers WHERE thread_id = ?`
+	iter := database.SelectQuery(query, threadId).Iter()
+	for iter.Scan(&username) {
+		subscribers = append(subscribers, username)
+	}
+	return subscribers, iter.Close()
+}
+
+func (Cassandra) SaveMention(username string, m model.ChatMessage) error {
+	query := `INSERT INTO mentions(username, id, msg, sender, group, timestamp) VALUES (?, ?, ?, ?, ?, toTimeStamp(now()))`
+	return database.ExecuteQuery(query, username, m.Id, m.Message, m.Sender, m.GroupName)
+}
+
+func (Cassandra) Mentions(username, before string, limit int) ([]model.ChatMessage, error) {
+	mentions := []model.ChatMessage{}
+	query := `SELECT id, msg, sender, group, timestamp FROM mentions WHERE username = ? LIMIT ?`
+	args := []interface{}{username, limit}
+	if before != "" {
+		query = `SELECT id, msg, sender, group, timestamp FROM mentions WHERE username = ? AND id < ? LIMIT ?`
+		args = []interface{}{username, before, limit}
+	}
+	iter := database.SelectQuery(query, args...).Iter()
+	m := model.ChatMessage{}
+	for iter.Scan(&m.Id, &m.Message, &m.Sender, &m.GroupName, &m.Timestamp) {
+		mentions = append(mentions, m)
+		m = model.ChatMessage{}
+	}
+	return mentions, iter.Close()
+}
+
+// UpdateInbox moves the conversation to the top of the user's inbox
+// Implementation:
+// 1. Reads the conversation's current position from inbox_latest
+// 2. Skips the update if a newer message is already there (ksuid order)
+// 3. In one logged batch: deletes the old inbox row, inserts the new one and
+// records the new position in inbox_latest
+func (Cassandra) UpdateInbox(username string, e model.InboxEntry) error {
+	var latest string
+	query := `SELECT last_message_id FROM inbox_latest WHERE username = ? AND conversation = ?`
+	database.SelectQuery(query, username, e.Conversation).Scan(&latest)
+	if latest >= e.LastMessageId {
+		return nil
+	}
+	stmts := []database.Statement{}
+	if latest != "" {
+		query = `DELETE FROM inbox WHERE username = ? AND last_message_id = ?`
+		stmts = append(stmts, database.Statement{Query: query, Args: []interface{}{username, latest}})
+	}
+	query = `INSERT INTO inbox(username, last_message_id, conversation, sender, preview, is_group, timestamp) VALUES (?, ?, ?, ?, ?, ?, toTimeStamp(now()))`
+	stmts = append(stmts, database.Statement{Query: query, Args: []interface{}{username, e.LastMessageId, e.Conversation, e.Sender, e.Preview, e.Group}})
+	query = `INSERT INTO inbox_latest(username, conversation, last_message_id) VALUES (?, ?, ?)`
+	stmts = append(stmts, database.Statement{Query: query, Args: []interface{}{username, e.Conversation, e.LastMessageId}})
+	return database.ExecuteBatch(stmts...)
+}
+
+// Inbox reads the inbox newest first, concurrent updates can briefly leave two rows
+// for a conversation, only the newest is returned
+func (Cassandra) Inbox(username, before string, limit int) ([]model.InboxEntry, error) {
+	entries := []model.InboxEntry{}
+	query := `SELECT last_message_id, conversation, sender, preview, is_group, timestamp FROM inbox WHERE username = ? LIMIT ?`
+	args := []interface{}{username, limit}
+	if before != "" {
+		query = `SELECT last_message_id, conversation, sender, preview, is_group, timestamp FROM inbox WHERE username = ? AND last_message_id < ? LIMIT ?`
+		args = []interface{}{username, before, limit}
+	}
+	seen := make(map[string]bool)
+	iter := database.SelectQuery(query, args...).Iter()
+	e := model.InboxEntry{}
+	for iter.Scan(&e.LastMessageId, &e.Conversation, &e.Sender, &e.Preview, &e.Group, &e.Timestamp) {
+		if !seen[e.Conversation] {
+			seen[e.Conversation] = true
+			entries = append(entries, e)
+		}
+		e = model.InboxEntry{}
+	}
+	return entries, iter.Close()
+}
+
+func (Cassandra) Conversations(username string) ([]string, error) {
+	var conversation string
+	conversations := []string{}
+	query := `SELECT conversation FROM inbox_latest WHERE username = ?`
+	iter := database.SelectQuery(query, username).Iter()
+	for iter.Scan(&conversation) {
+		conversations = append(conversations, conversation)
+	}
+	return conversations, iter.Close()
+}
+
+func (Cassandra) SetLastRead(username, conversation, messageId string) error {
+	query := `INSERT INTO last_read(username, conversation, message_id, timestamp) VALUES (?, ?, ?, toTimeStamp(now()))`
+	return database.ExecuteQuery(query, username, conversation, messageId)
+}
+
+func (Cassandra) LastRead(username string) (map[string]string, error) {
+	var conversation, messageId string
+	markers := make(map[string]string)
+	query := `SELECT conversation, message_id FROM last_read WHERE username = ?`
+	iter := database.SelectQuery(query, username).Iter()
+	for iter.Scan(&conversation, &messageId) {
+		markers[conversation] = messageId
+	}
+	return markers, iter.Close()
+}
+
+func (Cassandra) CreateAttachment(a model.Attachment) error {
+	query := `INSERT INTO attachments(id, filename, mime_type, size, uploader, conversation, received, complete, blob_key, timestamp) VALUES (?, ?, ?, ?, ?, ?, 0, false, '', toTimeStamp(now()))`
+	return database.ExecuteQuery(query, a.Id, a.Filename, a.MimeType, a.Size, a.Uploader, a.Conversation)
+}
+
+func (Cassandra) GetAttachment(id string) (model.Attachment, error) {
+	a := model.Attachment{}
+	query := `SELECT id, filename, mime_type, size, uploader, conversation, received, complete, blob_key, width, height, thumbnail_key, thumb_width, thumb_height, thumb_mime_type FROM attachments WHERE id = ?`
+	err := database.SelectQuery(query, id).Scan(&a.Id, &a.Filename, &a.MimeType, &a.Size, &a.Uploader, &a.Conversation, &a.Offset, &a.Complete, &a.Key,
+		&a.Width, &a.Height, &a.ThumbnailKey, &a.ThumbWidth, &a.ThumbHeight, &a.ThumbMime)
+	return a, notFound(err)
+}
+
+// AdvanceUpload moves the offset with a lightweight transaction
+func (Cassandra) AdvanceUpload(id string, from, to int64) (bool, int64, error) {
+	var current int64
+	query := `UPDATE attachments SET received = ? WHERE id = ? IF received = ?`
+	applied, err := database.NonIdempotentQuery(query, to, id, from).ScanCAS(&current)
+	return applied, current, err
+}
+
+func (Cassandra) CompleteAttachment(a model.Attachment) error {
+	query := `UPDATE attachments SET complete = true, mime_type = ?, blob_key = ?, size = ?, width = ?, height = ?, thumbnail_key = ?, thumb_width = ?, thumb_height = ?, thumb_mime_type = ? WHERE id = ?`
+	return database.ExecuteQuery(query, a.MimeType, a.Key, a.Size, a.Width, a.Height, a.ThumbnailKey, a.ThumbWidth, a.ThumbHeight, a.ThumbMime, a.Id)
+}
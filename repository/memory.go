@@ -0,0 +1,428 @@
+package repository
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/naman1402/distributed-chat-app/model"
+)
+
+// Memory keeps everything in process, it is safe for concurrent use
+// lists are sorted the way the Cassandra tables cluster them
+type Memory struct {
+	mu          sync.RWMutex
+	users       map[string]model.User                   // username -> user
+	usersById   map[string]model.User                   // id -> user
+	rooms       map[string]string                       // room name -> id
+	members     map[string]map[string]bool              // room -> usernames
+	servers     map[string]string                       // username -> server id
+	messages    map[string]model.ChatMessage            // id -> message
+	logs        map[string]map[int64]model.ChatMessage  // conversation -> seq -> message
+	replies     map[string]map[string]model.ChatMessage // thread id -> reply id -> reply
+	subscribers map[string]map[string]bool              // thread id -> usernames
+	mentions    map[string]map[string]model.ChatMessage // username -> message id -> mention
+	inbox       map[string]map[string]model.InboxEntry  // username -> conversation -> entry
+	lastRead    map[string]map[string]string            // username -> conversation -> message id
+	attachments map[string]model.Attachment             // id -> attachment
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		users:       make(map[string]model.User),
+		usersById:   make(map[string]model.User),
+		rooms:       make(map[string]string),
+		members:     make(map[string]map[string]bool),
+		servers:     make(map[string]string),
+		messages:    make(map[string]model.ChatMessage),
+		logs:        make(map[string]map[int64]model.ChatMessage),
+		replies:     make(map[string]map[string]model.ChatMessage),
+		subscribers: make(map[string]map[string]bool),
+		mentions:    make(map[string]map[string]model.ChatMessage),
+		inbox:       make(map[string]map[string]model.InboxEntry),
+		lastRead:    make(map[string]map[string]string),
+		attachments: make(map[string]model.Attachment),
+	}
+}
+
+// Ping always succeeds, the store lives in process
+func (s *Memory) Ping() error {
+	return nil
+}
+
+// inner returns the nested map under key, creating it if needed, caller holds mu
+func inner[K comparable, V any](m map[string]map[K]V, key string) map[K]V {
+	if m[key] == nil {
+		m[key] = make(map[K]V)
+	}
+	return m[key]
+}
+
+// keys returns the keys of the set, sorted
+func keys(set map[string]bool) []string {
+	list := make([]string, 0, len(set))
+	for k := range set {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (s *Memory) CreateUser(id, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[username]; ok {
+		return ErrExists
+	}
+	s.users[username] = model.User{Id: id, Username: username}
+	s.usersById[id] = s.users[username]
+	return nil
+}
+
+func (s *Memory) GetUser(username string) (model.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[username]
+	if !ok {
+		return model.User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+func (s *Memory) GetUserById(id string) (model.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.usersById[id]
+	if !ok {
+		return model.User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+func (s *Memory) CreateRoom(id, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[name]; ok {
+		return ErrExists
+	}
+	s.rooms[name] = id
+	return nil
+}
+
+func (s *Memory) RoomExists(name string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.rooms[name]
+	return ok, nil
+}
+
+func (s *Memory) AddMember(room, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inner(s.members, room)[username] = true
+	return nil
+}
+
+func (s *Memory) Members(room string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return keys(s.members[room]), nil
+}
+
+func (s *Memory) Rooms(username string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rooms := []string{}
+	for room, members := range s.members {
+		if members[username] {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms, nil
+}
+
+func (s *Memory) IsMember(room, username string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.members[room][username], nil
+}
+
+func (s *Memory) SetServer(username, serverId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servers[username] = serverId
+	return nil
+}
+
+func (s *Memory) ClearServer(username, serverId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.servers[username] == serverId {
+		delete(s.servers, username)
+	}
+	return nil
+}
+
+func (s *Memory) GetServer(username string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	serverId, ok := s.servers[username]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return serverId, nil
+}
+
+func (s *Memory) saveMessage(conversation string, m model.ChatMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := inner(s.logs, conversation)
+	if _, ok := s.messages[m.Id]; ok {
+		return ErrExists
+	}
+	if _, ok := entries[m.Seq]; ok {
+		return ErrExists
+	}
+	m.Timestamp = time.Now()
+	s.messages[m.Id] = m
+	entries[m.Seq] = m
+	return nil
+}
+
+func (s *Memory) GetServers(usernames []string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	servers := make(map[string]string, len(usernames))
+	for _, username := range usernames {
+		if serverId, ok := s.servers[username]; ok {
+			servers[username] = serverId
+		}
+	}
+	return servers, nil
+}
+
+func (s *Memory) SavePrivate(conversation string, m model.ChatMessage) error {
+	return s.saveMessage(conversation, m)
+}
+
+func (s *Memory) SaveGroup(conversation string, m model.ChatMessage) error {
+	return s.saveMessage(conversation, m)
+}
+
+func (s *Memory) GetMessage(id string) (model.ChatMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.messages[id]
+	if !ok {
+		return model.ChatMessage{}, ErrNotFound
+	}
+	return m, nil
+}
+
+func (s *Memory) MaxSeq(conversation string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var max int64
+	for seq := range s.logs[conversation] {
+		if seq > max {
+			max = seq
+		}
+	}
+	return max, nil
+}
+
+func (s *Memory) Log(conversation string, after int64, limit int) ([]model.ChatMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	messages := []model.ChatMessage{}
+	for seq, m := range s.logs[conversation] {
+		if seq > after {
+			messages = append(messages, m)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Seq < messages[j].Seq })
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (s *Memory) SaveReply(threadId string, m model.ChatMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inner(s.replies, threadId)[m.Id] = model.ChatMessage{
+		Id: m.Id, Message: m.Message, Sender: m.Sender, ReplyTo: m.ReplyTo, ThreadId: threadId, Timestamp: time.Now(),
+	}
+	return nil
+}
+
+func (s *Memory) ReplyCount(threadId string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.replies[threadId]), nil
+}
+
+func (s *Memory) Replies(threadId, after string, limit int) ([]model.ChatMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	replies := []model.ChatMessage{}
+	for id, m := range s.replies[threadId] {
+		if id > after {
+			replies = append(replies, m)
+		}
+	}
+	sort.Slice(replies, func(i, j int) bool { return replies[i].Id < replies[j].Id })
+	if len(replies) > limit {
+		replies = replies[:limit]
+	}
+	return replies, nil
+}
+
+func (s *Memory) Subscribe(threadId, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inner(s.subscribers, threadId)[username] = true
+	return nil
+}
+
+func (s *Memory) Unsubscribe(threadId, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers[threadId], username)
+	return nil
+}
+
+func (s *Memory) Subscribers(threadId string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return keys(s.subscribers[threadId]), nil
+}
+
+func (s *Memory) SaveMention(username string, m model.ChatMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inner(s.mentions, username)[m.Id] = model.ChatMessage{
+		Id: m.Id, Message: m.Message, Sender: m.Sender, GroupName: m.GroupName, Timestamp: time.Now(),
+	}
+	return nil
+}
+
+func (s *Memory) Mentions(username, before string, limit int) ([]model.ChatMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	mentions := []model.ChatMessage{}
+	for id, m := range s.mentions[username] {
+		if before == "" || id < before {
+			mentions = append(mentions, m)
+		}
+	}
+	sort.Slice(mentions, func(i, j int) bool { return mentions[i].Id > mentions[j].Id })
+	if len(mentions) > limit {
+		mentions = mentions[:limit]
+	}
+	return mentions, nil
+}
+
+func (s *Memory) UpdateInbox(username string, e model.InboxEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := inner(s.inbox, username)
+	if entries[e.Conversation].LastMessageId >= e.LastMessageId {
+		return nil
+	}
+	e.Timestamp = time.Now()
+	entries[e.Conversation] = e
+	return nil
+}
+
+func (s *Memory) Inbox(username, before string, limit int) ([]model.InboxEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := []model.InboxEntry{}
+	for _, e := range s.inbox[username] {
+		if before == "" || e.LastMessageId < before {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastMessageId > entries[j].LastMessageId })
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (s *Memory) Conversations(username string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	conversations := []string{}
+	for conversation := range s.inbox[username] {
+		conversations = append(conversations, conversation)
+	}
+	sort.Strings(conversations)
+	return conversations, nil
+}
+
+func (s *Memory) SetLastRead(username, conversation, messageId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inner(s.lastRead, username)[conversation] = messageId
+	return nil
+}
+
+func (s *Memory) LastRead(username string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	markers := make(map[string]string)
+	for conversation, messageId := range s.lastRead[username] {
+		markers[conversation] = messageId
+	}
+	return markers, nil
+}
+
+func (s *Memory) CreateAttachment(a model.Attachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a.Offset, a.Complete, a.Key = 0, false, ""
+	s.attachments[a.Id] = a
+	return nil
+}
+
+func (s *Memory) GetAttachment(id string) (model.Attachment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.attachments[id]
+	if !ok {
+		return model.Attachment{}, ErrNotFound
+	}
+	return a, nil
+}
+
+func (s *Memory) AdvanceUpload(id string, from, to int64) (bool, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.attachments[id]
+	if !ok {
+		return false, 0, ErrNotFound
+	}
+	if a.Offset != from {
+		return false, a.Offset, nil
+	}
+	a.Offset = to
+	s.attachments[id] = a
+	return true, to, nil
+}
+
+func (s *Memory) CompleteAttachment(a model.Attachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.attachments[a.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	stored.Complete = true
+	stored.MimeType, stored.Key, stored.Size = a.MimeType, a.Key, a.Size
+	stored.Width, stored.Height = a.Width, a.Height
+	stored.ThumbnailKey, stored.ThumbWidth, stored.ThumbHeight, stored.ThumbMime = a.ThumbnailKey, a.ThumbWidth, a.ThumbHeight, a.ThumbMime
+	s.attachments[a.Id] = stored
+	return nil
+}
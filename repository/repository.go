@@ -0,0 +1,145 @@
+// Package repository abstracts the storage of users, rooms, messages and the data derived from them
+// Controllers go through Default, the backend is selected by the storage settings
+package repository
+
+import (
+	"errors"
+
+	"github.com/naman1402/distributed-chat-app/database"
+	"github.com/naman1402/distributed-chat-app/model"
+	"github.com/naman1402/distributed-chat-app/search"
+	"github.com/naman1402/distributed-chat-app/settings"
+)
+
+// errors returned by every backend
+var (
+	// ErrNotFound is returned when the requested row does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrExists is returned when creating a user or room whose name is taken
+	ErrExists = errors.New("already exists")
+)
+
+// UserRepository stores accounts, usernames are unique
+type UserRepository interface {
+	CreateUser(id, username string) error
+	GetUser(username string) (model.User, error)
+	// GetUserById resolves the id stored in the uid cookie
+	GetUserById(id string) (model.User, error)
+}
+
+// RoomRepository stores rooms, room names are unique
+type RoomRepository interface {
+	CreateRoom(id, name string) error
+	RoomExists(name string) (bool, error)
+}
+
+// MembershipRepository stores which users joined which room
+// Rooms returns the rooms the user joined
+type MembershipRepository interface {
+	AddMember(room, username string) error
+	Members(room string) ([]string, error)
+	Rooms(username string) ([]string, error)
+	IsMember(room, username string) (bool, error)
+}
+
+// MappingRepository stores the server each user is connected to
+// GetServers looks many users up at once, users without a mapping are left out
+// ClearServer removes the mapping if it still points at serverId
+type MappingRepository interface {
+	SetServer(username, serverId string) error
+	GetServer(username string) (string, error)
+	GetServers(usernames []string) (map[string]string, error)
+	ClearServer(username, serverId string) error
+}
+
+// MessageRepository stores messages and the per-conversation log used for replay
+// SavePrivate and SaveGroup store the message together with its conversation log entry,
+// ErrExists if the id or the seq of the conversation is taken (Cassandra overwrites instead)
+// Log returns up to limit entries with a sequence number greater than after, oldest first
+// MaxSeq returns 0 for a conversation without messages
+type MessageRepository interface {
+	SavePrivate(conversation string, m model.ChatMessage) error
+	SaveGroup(conversation string, m model.ChatMessage) error
+	GetMessage(id string) (model.ChatMessage, error)
+	MaxSeq(conversation string) (int64, error)
+	Log(conversation string, after int64, limit int) ([]model.ChatMessage, error)
+}
+
+// ThreadRepository stores thread replies, reply counters and subscribers
+// Replies returns up to limit replies with an id greater than after, in send order
+type ThreadRepository interface {
+	SaveReply(threadId string, m model.ChatMessage) error
+	ReplyCount(threadId string) (int, error)
+	Replies(threadId, after string, limit int) ([]model.ChatMessage, error)
+	Subscribe(threadId, username string) error
+	Unsubscribe(threadId, username string) error
+	Subscribers(threadId string) ([]string, error)
+}
+
+// MentionRepository stores the mentions inbox
+// Mentions returns up to limit mentions with an id smaller than before ("" = newest), newest first
+type MentionRepository interface {
+	SaveMention(username string, m model.ChatMessage) error
+	Mentions(username, before string, limit int) ([]model.ChatMessage, error)
+}
+
+// InboxRepository stores the inbox and the read markers of each user
+// UpdateInbox ignores entries older than the conversation's current one
+// Inbox returns up to limit conversations with activity older than before ("" = newest), newest first
+// Conversations and LastRead are keyed by the user's conversation key ("group:{room}" or "dm:{user}")
+type InboxRepository interface {
+	UpdateInbox(username string, e model.InboxEntry) error
+	Inbox(username, before string, limit int) ([]model.InboxEntry, error)
+	Conversations(username string) ([]string, error)
+	SetLastRead(username, conversation, messageId string) error
+	LastRead(username string) (map[string]string, error)
+}
+
+// AttachmentRepository stores attachments and their upload state
+// AdvanceUpload moves the received offset from from to to only if it is still from,
+// it returns whether it did and the current offset otherwise
+type AttachmentRepository interface {
+	CreateAttachment(a model.Attachment) error
+	GetAttachment(id string) (model.Attachment, error)
+	AdvanceUpload(id string, from, to int64) (bool, int64, error)
+	CompleteAttachment(a model.Attachment) error
+}
+
+// Store is a storage backend implementing every repository
+type Store interface {
+	UserRepository
+	RoomRepository
+	MembershipRepository
+	MappingRepository
+	MessageRepository
+	ThreadRepository
+	MentionRepository
+	InboxRepository
+	AttachmentRepository
+	// Ping checks that the backend answers, for the readiness check
+	Ping() error
+}
+
+// Default is the store used by the controllers
+var Default Store
+
+// Setup initializes Default (and the search engine) for the configured backend
+// - "cassandra" (default): connects to the cluster, see database.SetupConnection
+// - "sqlite", "postgres": opens and migrates the database, see database.SetupSQL
+// - "memory": everything in process, lost on restart, for tests and single-node trials
+// (the state shared by the servers is then in process too, see config.SetupState)
+func Setup(storage settings.Storage, cassandra settings.Cassandra) {
+	switch storage.Backend {
+	case "memory":
+		Default = NewMemory()
+		search.Engine = search.NewMemoryIndex()
+	case "sqlite", "postgres":
+		database.SetupSQL(storage)
+		Default = SQL{}
+		search.Engine = search.SQLIndex{}
+	default:
+		database.SetupConnection(cassandra)
+		Default = Cassandra{}
+		search.Engine = search.CassandraIndex{}
+	}
+}
@@ -0,0 +1,395 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/naman1402/distributed-chat-app/database"
+	"github.com/naman1402/distributed-chat-app/model"
+	"github.com/naman1402/distributed-chat-app/settings"
+)
+
+// backends open an empty store of every backend that runs in process
+var backends = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{"memory", func(t *testing.T) Store { return NewMemory() }},
+	{"sqlite", func(t *testing.T) Store {
+		database.SetupSQL(settings.Storage{Backend: "sqlite", DSN: filepath.Join(t.TempDir(), "chat.db")})
+		t.Cleanup(func() { database.SQL.Close() })
+		return SQL{}
+	}},
+}
+
+// TestRepository runs the same checks against every backend, each check on an empty store
+func TestRepository(t *testing.T) {
+	checks := []struct {
+		name string
+		run  func(t *testing.T, s Store)
+	}{
+		{"users", testUsers},
+		{"rooms", testRooms},
+		{"servers", testServers},
+		{"log", testLog},
+		{"threads", testThreads},
+		{"mentions", testMentions},
+		{"inbox", testInbox},
+		{"attachments", testAttachments},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			for _, check := range checks {
+				t.Run(check.name, func(t *testing.T) {
+					check.run(t, backend.open(t))
+				})
+			}
+		})
+	}
+}
+
+func ids(messages []model.ChatMessage) []string {
+	list := []string{}
+	for _, m := range messages {
+		list = append(list, m.Id)
+	}
+	return list
+}
+
+func testUsers(t *testing.T, s Store) {
+	if err := s.CreateUser("id-alice", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateUser("id-other", "alice"); !errors.Is(err, ErrExists) {
+		t.Fatalf("duplicate username: got %v, want ErrExists", err)
+	}
+	tests := []struct {
+		name   string
+		lookup func() (model.User, error)
+		want   model.User
+		err    error
+	}{
+		{"by username", func() (model.User, error) { return s.GetUser("alice") }, model.User{Id: "id-alice", Username: "alice"}, nil},
+		{"by id", func() (model.User, error) { return s.GetUserById("id-alice") }, model.User{Id: "id-alice", Username: "alice"}, nil},
+		{"unknown username", func() (model.User, error) { return s.GetUser("bob") }, model.User{}, ErrNotFound},
+		{"unknown id", func() (model.User, error) { return s.GetUserById("id-other") }, model.User{}, ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.lookup()
+			if !errors.Is(err, tt.err) || got != tt.want {
+				t.Fatalf("got %+v, %v, want %+v, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func testRooms(t *testing.T, s Store) {
+	if err := s.CreateRoom("r-1", "room1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateRoom("r-2", "room1"); !errors.Is(err, ErrExists) {
+		t.Fatalf("duplicate room: got %v, want ErrExists", err)
+	}
+	for _, m := range []struct{ room, user string }{{"room1", "bob"}, {"room1", "alice"}, {"room2", "alice"}, {"room1", "alice"}} {
+		if err := s.AddMember(m.room, m.user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists, _ := s.RoomExists("room1")
+	missing, _ := s.RoomExists("room3")
+	if !exists || missing {
+		t.Fatalf("RoomExists: room1 %v, room3 %v", exists, missing)
+	}
+
+	tests := []struct {
+		name string
+		got  func() (interface{}, error)
+		want interface{}
+	}{
+		{"members sorted, added once", func() (interface{}, error) { return s.Members("room1") }, []string{"alice", "bob"}},
+		{"members of unknown room", func() (interface{}, error) { return s.Members("room3") }, []string{}},
+		{"rooms of a user", func() (interface{}, error) {
+			rooms, err := s.Rooms("alice")
+			if len(rooms) == 2 && rooms[0] > rooms[1] {
+				rooms[0], rooms[1] = rooms[1], rooms[0]
+			}
+			return rooms, err
+		}, []string{"room1", "room2"}},
+		{"member", func() (interface{}, error) { return s.IsMember("room2", "alice") }, true},
+		{"not a member", func() (interface{}, error) { return s.IsMember("room2", "bob") }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.got()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func testServers(t *testing.T, s Store) {
+	s.SetServer("alice", "S1")
+	s.SetServer("bob", "S2")
+	tests := []struct {
+		name  string
+		clear [2]string // username, server id passed to ClearServer
+		want  map[string]string
+	}{
+		{"clearing another server keeps the mapping", [2]string{"alice", "S2"}, map[string]string{"alice": "S1", "bob": "S2"}},
+		{"clearing the current server removes it", [2]string{"alice", "S1"}, map[string]string{"bob": "S2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.ClearServer(tt.clear[0], tt.clear[1]); err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.GetServers([]string{"alice", "bob", "carol"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, err := s.GetServer("alice"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("cleared mapping: got %v, want ErrNotFound", err)
+	}
+}
+
+func testLog(t *testing.T, s Store) {
+	// saved out of order, as concurrent senders may
+	for _, seq := range []int64{2, 1, 4, 3} {
+		m := model.ChatMessage{Id: fmt.Sprintf("m%d", seq), Sender: "alice", GroupName: "room1", Seq: seq}
+		if err := s.SaveGroup("group:room1", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.SavePrivate("dm:alice:bob", model.ChatMessage{Id: "p1", Sender: "alice", Receiver: "bob", Seq: 1})
+
+	tests := []struct {
+		name         string
+		conversation string
+		after        int64
+		limit        int
+		want         []string
+	}{
+		{"whole log in seq order", "group:room1", 0, 10, []string{"m1", "m2", "m3", "m4"}},
+		{"after a seq", "group:room1", 2, 10, []string{"m3", "m4"}},
+		{"limited", "group:room1", 0, 2, []string{"m1", "m2"}},
+		{"caught up", "group:room1", 4, 10, []string{}},
+		{"other conversation", "dm:alice:bob", 0, 10, []string{"p1"}},
+		{"unknown conversation", "group:room2", 0, 10, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Log(tt.conversation, tt.after, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ids(got), tt.want) {
+				t.Fatalf("got %v, want %v", ids(got), tt.want)
+			}
+		})
+	}
+
+	for conversation, want := range map[string]int64{"group:room1": 4, "dm:alice:bob": 1, "group:room2": 0} {
+		if got, _ := s.MaxSeq(conversation); got != want {
+			t.Fatalf("MaxSeq(%s) = %d, want %d", conversation, got, want)
+		}
+	}
+	if m, err := s.GetMessage("m3"); err != nil || m.Seq != 3 || m.Timestamp.IsZero() {
+		t.Fatalf("GetMessage: %+v, %v", m, err)
+	}
+	if _, err := s.GetMessage("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("missing message: got %v, want ErrNotFound", err)
+	}
+
+	// a seq or an id already used is refused, the stored entry is kept
+	conflicts := []model.ChatMessage{
+		{Id: "other", Sender: "bob", GroupName: "room1", Seq: 3},
+		{Id: "m3", Sender: "bob", GroupName: "room1", Seq: 5},
+	}
+	for _, m := range conflicts {
+		if err := s.SaveGroup("group:room1", m); !errors.Is(err, ErrExists) {
+			t.Fatalf("SaveGroup(%s, seq %d): got %v, want ErrExists", m.Id, m.Seq, err)
+		}
+	}
+	if err := s.SavePrivate("dm:alice:bob", model.ChatMessage{Id: "p2", Sender: "bob", Receiver: "alice", Seq: 1}); !errors.Is(err, ErrExists) {
+		t.Fatalf("SavePrivate with a used seq: got %v, want ErrExists", err)
+	}
+	got, _ := s.Log("group:room1", 2, 10)
+	if !reflect.DeepEqual(ids(got), []string{"m3", "m4"}) {
+		t.Fatalf("log after conflicts: %v", ids(got))
+	}
+	if _, err := s.GetMessage("other"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("refused message stored: %v", err)
+	}
+}
+
+func testThreads(t *testing.T, s Store) {
+	for _, id := range []string{"r2", "r1", "r3"} {
+		s.SaveReply("t1", model.ChatMessage{Id: id, Message: "reply " + id, Sender: "bob", ReplyTo: "t1"})
+	}
+	if n, _ := s.ReplyCount("t1"); n != 3 {
+		t.Fatalf("ReplyCount = %d, want 3", n)
+	}
+	tests := []struct {
+		name  string
+		after string
+		limit int
+		want  []string
+	}{
+		{"first page", "", 2, []string{"r1", "r2"}},
+		{"next page", "r2", 2, []string{"r3"}},
+		{"past the end", "r3", 2, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Replies("t1", tt.after, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ids(got), tt.want) {
+				t.Fatalf("got %v, want %v", ids(got), tt.want)
+			}
+		})
+	}
+
+	s.Subscribe("t1", "carol")
+	s.Subscribe("t1", "alice")
+	s.Subscribe("t1", "bob")
+	s.Unsubscribe("t1", "bob")
+	if got, _ := s.Subscribers("t1"); !reflect.DeepEqual(got, []string{"alice", "carol"}) {
+		t.Fatalf("Subscribers = %v, want [alice carol]", got)
+	}
+}
+
+func testMentions(t *testing.T, s Store) {
+	for _, id := range []string{"m1", "m3", "m2"} {
+		s.SaveMention("bob", model.ChatMessage{Id: id, Message: "@bob", Sender: "alice", GroupName: "room1"})
+	}
+	tests := []struct {
+		name   string
+		before string
+		limit  int
+		want   []string
+	}{
+		{"newest first", "", 2, []string{"m3", "m2"}},
+		{"before an id", "m2", 2, []string{"m1"}},
+		{"nothing older", "m1", 2, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Mentions("bob", tt.before, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ids(got), tt.want) {
+				t.Fatalf("got %v, want %v", ids(got), tt.want)
+			}
+		})
+	}
+}
+
+func testInbox(t *testing.T, s Store) {
+	updates := []model.InboxEntry{
+		{Conversation: "group:room1", LastMessageId: "m1"},
+		{Conversation: "dm:carol", LastMessageId: "m2"},
+		{Conversation: "group:room1", LastMessageId: "m3"},
+		// delivered late, older than the current entry
+		{Conversation: "dm:carol", LastMessageId: "m0"},
+	}
+	for _, e := range updates {
+		if err := s.UpdateInbox("bob", e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name   string
+		before string
+		limit  int
+		want   []string // last message ids
+	}{
+		{"newest activity first", "", 10, []string{"m3", "m2"}},
+		{"limited", "", 1, []string{"m3"}},
+		{"before an id", "m3", 10, []string{"m2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := s.Inbox("bob", tt.before, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, e := range entries {
+				got = append(got, e.LastMessageId)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if got, _ := s.Conversations("bob"); !reflect.DeepEqual(got, []string{"dm:carol", "group:room1"}) {
+		t.Fatalf("Conversations = %v", got)
+	}
+
+	s.SetLastRead("bob", "group:room1", "m1")
+	s.SetLastRead("bob", "group:room1", "m3")
+	markers, _ := s.LastRead("bob")
+	// the returned map is a copy
+	markers["dm:carol"] = "m2"
+	if got, _ := s.LastRead("bob"); !reflect.DeepEqual(got, map[string]string{"group:room1": "m3"}) {
+		t.Fatalf("LastRead = %v", got)
+	}
+}
+
+func testAttachments(t *testing.T, s Store) {
+	// the upload state set by the caller is ignored
+	if err := s.CreateAttachment(model.Attachment{Id: "a1", Size: 10, Offset: 5, Complete: true}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		from, to int64
+		advanced bool
+		offset   int64
+	}{
+		{"first chunk", 0, 4, true, 4},
+		{"stale offset", 0, 4, false, 4},
+		{"next chunk", 4, 10, true, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			advanced, offset, err := s.AdvanceUpload("a1", tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if advanced != tt.advanced || offset != tt.offset {
+				t.Fatalf("got %v at %d, want %v at %d", advanced, offset, tt.advanced, tt.offset)
+			}
+		})
+	}
+	if _, _, err := s.AdvanceUpload("missing", 0, 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unknown upload: got %v, want ErrNotFound", err)
+	}
+
+	if err := s.CompleteAttachment(model.Attachment{Id: "a1", MimeType: "text/plain", Key: "attachments/a1", Size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	a, err := s.GetAttachment("a1")
+	if err != nil || !a.Complete || a.Key != "attachments/a1" || a.MimeType != "text/plain" || a.Offset != 10 {
+		t.Fatalf("completed attachment: %+v, %v", a, err)
+	}
+	if err := s.CompleteAttachment(model.Attachment{Id: "missing"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("completing an unknown upload: got %v, want ErrNotFound", err)
+	}
+}
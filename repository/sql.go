@@ -0,0 +1,480 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/naman1402/distributed-chat-app/database"
+	"github.com/naman1402/distributed-chat-app/model"
+)
+
+// SQL stores everything in sqlite or postgres, see database/migrations
+// queries are written with ? placeholders and rebound for the dialect
+type SQL struct{}
+
+func (SQL) Ping() error {
+	return database.SQLPing()
+}
+
+func execSQL(query string, args ...interface{}) error {
+	_, err := database.SQL.Exec(database.Rebind(query), args...)
+	return err
+}
+
+func querySQL(query string, args ...interface{}) (*sql.Rows, error) {
+	return database.SQL.Query(database.Rebind(query), args...)
+}
+
+func queryRowSQL(query string, args ...interface{}) *sql.Row {
+	return database.SQL.QueryRow(database.Rebind(query), args...)
+}
+
+// inTx runs the statements in one transaction, all of them are applied or none
+func inTx(stmts ...database.Statement) error {
+	tx, err := database.SQL.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(database.Rebind(stmt.Query), stmt.Args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// sqlNotFound maps database/sql's missing row error to ErrNotFound
+func sqlNotFound(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+// sqlConflict maps a unique or primary key violation to ErrExists
+func sqlConflict(err error) error {
+	if database.IsConflict(err) {
+		return ErrExists
+	}
+	return err
+}
+
+// encodeList stores a list column as a JSON array
+func encodeList(list []string) string {
+	if len(list) == 0 {
+		return "[]"
+	}
+	data, _ := json.Marshal(list)
+	return string(data)
+}
+
+// decodeList reads a JSON array column, empty arrays become nil like Cassandra's empty lists
+func decodeList(data string) []string {
+	var list []string
+	json.Unmarshal([]byte(data), &list)
+	if len(list) == 0 {
+		return nil
+	}
+	return list
+}
+
+func now() time.Time {
+	return time.Now().UTC()
+}
+
+func (SQL) CreateUser(id, username string) error {
+	query := `INSERT INTO users(id, username) VALUES (?, ?) ON CONFLICT DO NOTHING`
+	return insertUnique(query, id, username)
+}
+
+// insertUnique runs an INSERT ... ON CONFLICT DO NOTHING, ErrExists if nothing was inserted
+func insertUnique(query string, args ...interface{}) error {
+	res, err := database.SQL.Exec(database.Rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrExists
+	}
+	return err
+}
+
+func (SQL) GetUser(username string) (model.User, error) {
+	u := model.User{}
+	query := `SELECT id, username FROM users WHERE username = ?`
+	err := queryRowSQL(query, username).Scan(&u.Id, &u.Username)
+	return u, sqlNotFound(err)
+}
+
+func (SQL) GetUserById(id string) (model.User, error) {
+	u := model.User{}
+	query := `SELECT id, username FROM users WHERE id = ?`
+	err := queryRowSQL(query, id).Scan(&u.Id, &u.Username)
+	return u, sqlNotFound(err)
+}
+
+func (SQL) CreateRoom(id, name string) error {
+	query := `INSERT INTO room(id, room_name) VALUES (?, ?) ON CONFLICT DO NOTHING`
+	return insertUnique(query, id, name)
+}
+
+func (SQL) RoomExists(name string) (bool, error) {
+	var n int
+	query := `SELECT COUNT(*) FROM room WHERE room_name = ?`
+	err := queryRowSQL(query, name).Scan(&n)
+	return n > 0, err
+}
+
+func (SQL) AddMember(room, username string) error {
+	query := `INSERT INTO room_members(room_name, username) VALUES (?, ?) ON CONFLICT DO NOTHING`
+	return execSQL(query, room, username)
+}
+
+func (SQL) Members(room string) ([]string, error) {
+	query := `SELECT username FROM room_members WHERE room_name = ? ORDER BY username`
+	return scanStrings(query, room)
+}
+
+func (SQL) Rooms(username string) ([]string, error) {
+	query := `SELECT room_name FROM room_members WHERE username = ? ORDER BY room_name`
+	return scanStrings(query, username)
+}
+
+func (SQL) IsMember(room, username string) (bool, error) {
+	var n int
+	query := `SELECT COUNT(*) FROM room_members WHERE room_name = ? AND username = ?`
+	err := queryRowSQL(query, room, username).Scan(&n)
+	return n > 0, err
+}
+
+// scanStrings returns the single text column of every row
+func scanStrings(query string, args ...interface{}) ([]string, error) {
+	list := []string{}
+	rows, err := querySQL(query, args...)
+	if err != nil {
+		return list, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return list, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+func (SQL) SetServer(username, serverId string) error {
+	query := `INSERT INTO user_mapping(username, server_id) VALUES (?, ?) ON CONFLICT (username) DO UPDATE SET server_id = excluded.server_id`
+	return execSQL(query, username, serverId)
+}
+
+func (SQL) ClearServer(username, serverId string) error {
+	query := `DELETE FROM user_mapping WHERE username = ? AND server_id = ?`
+	return execSQL(query, username, serverId)
+}
+
+func (SQL) GetServer(username string) (string, error) {
+	var serverId string
+	query := `SELECT server_id FROM user_mapping WHERE username = ?`
+	err := queryRowSQL(query, username).Scan(&serverId)
+	return serverId, sqlNotFound(err)
+}
+
+// maxInArgs keeps IN lists below sqlite's bound parameter limit
+const maxInArgs = 500
+
+// GetServers reads the mappings with IN queries of at most maxInArgs users
+func (SQL) GetServers(usernames []string) (map[string]string, error) {
+	servers := make(map[string]string, len(usernames))
+	for start := 0; start < len(usernames); start += maxInArgs {
+		chunk := usernames[start:min(start+maxInArgs, len(usernames))]
+		args := make([]interface{}, len(chunk))
+		for i, username := range chunk {
+			args[i] = username
+		}
+		query := `SELECT username, server_id FROM user_mapping WHERE username IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(chunk)), ", ") + `)`
+		rows, err := querySQL(query, args...)
+		if err != nil {
+			return servers, err
+		}
+		var username, serverId string
+		for rows.Next() {
+			if err := rows.Scan(&username, &serverId); err != nil {
+				rows.Close()
+				return servers, err
+			}
+			servers[username] = serverId
+		}
+		if err := rows.Close(); err != nil {
+			return servers, err
+		}
+	}
+	return servers, nil
+}
+
+// SavePrivate writes the message and its log entry in one transaction
+// ErrExists if the id or the seq of the conversation is already taken
+func (SQL) SavePrivate(conversation string, m model.ChatMessage) error {
+	query := `INSERT INTO private_chat(id, msg, sender, receiver, reply_to, thread_id, attachments, seq, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	return sqlConflict(inTx(
+		database.Statement{Query: query, Args: []interface{}{m.Id, m.Message, m.Sender, m.Receiver, m.ReplyTo, m.ThreadId, encodeList(m.Attachments), m.Seq, now()}},
+		sqlLogStatement(conversation, m),
+	))
+}
+
+// SaveGroup writes the message and its log entry in one transaction
+// ErrExists if the id or the seq of the conversation is already taken
+func (SQL) SaveGroup(conversation string, m model.ChatMessage) error {
+	query := `INSERT INTO group_chat(id, msg, sender, group_name, reply_to, thread_id, mentions, mention_room, attachments, seq, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	return sqlConflict(inTx(
+		database.Statement{Query: query, Args: []interface{}{m.Id, m.Message, m.Sender, m.GroupName, m.ReplyTo, m.ThreadId, encodeList(m.Mentions), m.MentionRoom, encodeList(m.Attachments), m.Seq, now()}},
+		sqlLogStatement(conversation, m),
+	))
+}
+
+// GetMessage looks the message up by id, first in private_chat and then in group_chat
+func (SQL) GetMessage(id string) (model.ChatMessage, error) {
+	m := model.ChatMessage{}
+	var attachments, mentions string
+	query := `SELECT id, msg, sender, receiver, reply_to, thread_id, attachments, seq, created_at FROM private_chat WHERE id = ?`
+	err := queryRowSQL(query, id).Scan(&m.Id, &m.Message, &m.Sender, &m.Receiver, &m.ReplyTo, &m.ThreadId, &attachments, &m.Seq, &m.Timestamp)
+	if err != sql.ErrNoRows {
+		m.Attachments = decodeList(attachments)
+		return m, err
+	}
+	m = model.ChatMessage{}
+	query = `SELECT id, msg, sender, group_name, reply_to, thread_id, mentions, mention_room, attachments, seq, created_at FROM group_chat WHERE id = ?`
+	err = queryRowSQL(query, id).Scan(&m.Id, &m.Message, &m.Sender, &m.GroupName, &m.ReplyTo, &m.ThreadId, &mentions, &m.MentionRoom, &attachments, &m.Seq, &m.Timestamp)
+	m.Mentions, m.Attachments = decodeList(mentions), decodeList(attachments)
+	return m, sqlNotFound(err)
+}
+
+// sqlLogStatement inserts the log entry, a seq already used in the conversation fails the
+// transaction instead of replacing the entry another message was saved under
+func sqlLogStatement(conversation string, m model.ChatMessage) database.Statement {
+	query := `INSERT INTO conversation_log(conversation, seq, id, msg, sender, receiver, group_name, reply_to, thread_id, mentions, mention_room, attachments, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	return database.Statement{Query: query, Args: []interface{}{conversation, m.Seq, m.Id, m.Message, m.Sender, m.Receiver, m.GroupName, m.ReplyTo, m.ThreadId, encodeList(m.Mentions), m.MentionRoom, encodeList(m.Attachments), now()}}
+}
+
+func (SQL) MaxSeq(conversation string) (int64, error) {
+	var seq int64
+	query := `SELECT COALESCE(MAX(seq), 0) FROM conversation_log WHERE conversation = ?`
+	err := queryRowSQL(query, conversation).Scan(&seq)
+	return seq, err
+}
+
+func (SQL) Log(conversation string, after int64, limit int) ([]model.ChatMessage, error) {
+	messages := []model.ChatMessage{}
+	query := `SELECT seq, id, msg, sender, receiver, group_name, reply_to, thread_id, mentions, mention_room, attachments, created_at FROM conversation_log WHERE conversation = ? AND seq > ? ORDER BY seq ASC LIMIT ?`
+	rows, err := querySQL(query, conversation, after, limit)
+	if err != nil {
+		return messages, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m := model.ChatMessage{}
+		var mentions, attachments string
+		if err := rows.Scan(&m.Seq, &m.Id, &m.Message, &m.Sender, &m.Receiver, &m.GroupName, &m.ReplyTo, &m.ThreadId, &mentions, &m.MentionRoom, &attachments, &m.Timestamp); err != nil {
+			return messages, err
+		}
+		m.Mentions, m.Attachments = decodeList(mentions), decodeList(attachments)
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// SaveReply stores the reply and bumps the reply counter in one transaction
+func (SQL) SaveReply(threadId string, m model.ChatMessage) error {
+	tx, err := database.SQL.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := `INSERT INTO thread_messages(thread_id, id, msg, sender, reply_to, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(database.Rebind(query), threadId, m.Id, m.Message, m.Sender, m.ReplyTo, now()); err != nil {
+		return err
+	}
+	query = `INSERT INTO thread_counts(thread_id, replies) VALUES (?, 1) ON CONFLICT (thread_id) DO UPDATE SET replies = thread_counts.replies + 1`
+	if _, err := tx.Exec(database.Rebind(query), threadId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (SQL) ReplyCount(threadId string) (int, error) {
+	var replies int64
+	query := `SELECT replies FROM thread_counts WHERE thread_id = ?`
+	err := queryRowSQL(query, threadId).Scan(&replies)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return int(replies), err
+}
+
+func (SQL) Replies(threadId, after string, limit int) ([]model.ChatMessage, error) {
+	replies := []model.ChatMessage{}
+	query := `SELECT id, msg, sender, reply_to, created_at FROM thread_messages WHERE thread_id = ? AND id > ? ORDER BY id ASC LIMIT ?`
+	rows, err := querySQL(query, threadId, after, limit)
+	if err != nil {
+		return replies, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m := model.ChatMessage{ThreadId: threadId}
+		if err := rows.Scan(&m.Id, &m.Message, &m.Sender, &m.ReplyTo, &m.Timestamp); err != nil {
+			return replies, err
+		}
+		replies = append(replies, m)
+	}
+	return replies, rows.Err()
+}
+
+func (SQL) Subscribe(threadId, username string) error {
+	query := `INSERT INTO thread_subscribers(thread_id, username) VALUES (?, ?) ON CONFLICT DO NOTHING`
+	return execSQL(query, threadId, username)
+}
+
+func (SQL) Unsubscribe(threadId, username string) error {
+	query := `DELETE FROM thread_subscribers WHERE thread_id = ? AND username = ?`
+	return execSQL(query, threadId, username)
+}
+
+func (SQL) Subscribers(threadId string) ([]string, error) {
+	query := `SELECT username FROM thread_subscribers WHERE thread_id = ? ORDER BY username`
+	return scanStrings(query, threadId)
+}
+
+func (SQL) SaveMention(username string, m model.ChatMessage) error {
+	query := `INSERT INTO mentions(username, id, msg, sender, group_name, created_at) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`
+	return execSQL(query, username, m.Id, m.Message, m.Sender, m.GroupName, now())
+}
+
+func (SQL) Mentions(username, before string, limit int) ([]model.ChatMessage, error) {
+	mentions := []model.ChatMessage{}
+	query := `SELECT id, msg, sender, group_name, created_at FROM mentions WHERE username = ? ORDER BY id DESC LIMIT ?`
+	args := []interface{}{username, limit}
+	if before != "" {
+		query = `SELECT id, msg, sender, group_name, created_at FROM mentions WHERE username = ? AND id < ? ORDER BY id DESC LIMIT ?`
+		args = []interface{}{username, before, limit}
+	}
+	rows, err := querySQL(query, args...)
+	if err != nil {
+		return mentions, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m := model.ChatMessage{}
+		if err := rows.Scan(&m.Id, &m.Message, &m.Sender, &m.GroupName, &m.Timestamp); err != nil {
+			return mentions, err
+		}
+		mentions = append(mentions, m)
+	}
+	return mentions, rows.Err()
+}
+
+// UpdateInbox upserts the conversation's row, an older message never replaces a newer one
+func (SQL) UpdateInbox(username string, e model.InboxEntry) error {
+	query := `INSERT INTO inbox(username, conversation, last_message_id, sender, preview, is_group, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (username, conversation) DO UPDATE SET last_message_id = excluded.last_message_id, sender = excluded.sender,
+		preview = excluded.preview, is_group = excluded.is_group, created_at = excluded.created_at
+		WHERE inbox.last_message_id < excluded.last_message_id`
+	return execSQL(query, username, e.Conversation, e.LastMessageId, e.Sender, e.Preview, e.Group, now())
+}
+
+func (SQL) Inbox(username, before string, limit int) ([]model.InboxEntry, error) {
+	entries := []model.InboxEntry{}
+	query := `SELECT last_message_id, conversation, sender, preview, is_group, created_at FROM inbox WHERE username = ? ORDER BY last_message_id DESC LIMIT ?`
+	args := []interface{}{username, limit}
+	if before != "" {
+		query = `SELECT last_message_id, conversation, sender, preview, is_group, created_at FROM inbox WHERE username = ? AND last_message_id < ? ORDER BY last_message_id DESC LIMIT ?`
+		args = []interface{}{username, before, limit}
+	}
+	rows, err := querySQL(query, args...)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := model.InboxEntry{}
+		if err := rows.Scan(&e.LastMessageId, &e.Conversation, &e.Sender, &e.Preview, &e.Group, &e.Timestamp); err != nil {
+			return entries, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (SQL) Conversations(username string) ([]string, error) {
+	query := `SELECT conversation FROM inbox WHERE username = ? ORDER BY conversation`
+	return scanStrings(query, username)
+}
+
+func (SQL) SetLastRead(username, conversation, messageId string) error {
+	query := `INSERT INTO last_read(username, conversation, message_id, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (username, conversation) DO UPDATE SET message_id = excluded.message_id, created_at = excluded.created_at`
+	return execSQL(query, username, conversation, messageId, now())
+}
+
+func (SQL) LastRead(username string) (map[string]string, error) {
+	markers := make(map[string]string)
+	query := `SELECT conversation, message_id FROM last_read WHERE username = ?`
+	rows, err := querySQL(query, username)
+	if err != nil {
+		return markers, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var conversation, messageId string
+		if err := rows.Scan(&conversation, &messageId); err != nil {
+			return markers, err
+		}
+		markers[conversation] = messageId
+	}
+	return markers, rows.Err()
+}
+
+func (SQL) CreateAttachment(a model.Attachment) error {
+	query := `INSERT INTO attachments(id, filename, mime_type, size, uploader, conversation, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	return execSQL(query, a.Id, a.Filename, a.MimeType, a.Size, a.Uploader, a.Conversation, now())
+}
+
+func (SQL) GetAttachment(id string) (model.Attachment, error) {
+	a := model.Attachment{}
+	query := `SELECT id, filename, mime_type, size, uploader, conversation, received, complete, blob_key, width, height, thumbnail_key, thumb_width, thumb_height, thumb_mime_type FROM attachments WHERE id = ?`
+	err := queryRowSQL(query, id).Scan(&a.Id, &a.Filename, &a.MimeType, &a.Size, &a.Uploader, &a.Conversation, &a.Offset, &a.Complete, &a.Key,
+		&a.Width, &a.Height, &a.ThumbnailKey, &a.ThumbWidth, &a.ThumbHeight, &a.ThumbMime)
+	return a, sqlNotFound(err)
+}
+
+// AdvanceUpload moves the offset with a conditional update
+func (SQL) AdvanceUpload(id string, from, to int64) (bool, int64, error) {
+	res, err := database.SQL.Exec(database.Rebind(`UPDATE attachments SET received = ? WHERE id = ? AND received = ?`), to, id, from)
+	if err != nil {
+		return false, 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return n == 1, to, err
+	}
+	var current int64
+	err = queryRowSQL(`SELECT received FROM attachments WHERE id = ?`, id).Scan(&current)
+	return false, current, sqlNotFound(err)
+}
+
+func (SQL) CompleteAttachment(a model.Attachment) error {
+	query := `UPDATE attachments SET complete = TRUE, mime_type = ?, blob_key = ?, size = ?, width = ?, height = ?, thumbnail_key = ?, thumb_width = ?, thumb_height = ?, thumb_mime_type = ? WHERE id = ?`
+	res, err := database.SQL.Exec(database.Rebind(query), a.MimeType, a.Key, a.Size, a.Width, a.Height, a.ThumbnailKey, a.ThumbWidth, a.ThumbHeight, a.ThumbMime, a.Id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
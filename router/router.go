@@ -1,24 +1,39 @@
 package router
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
+	"github.com/naman1402/distributed-chat-app/blob"
 	"github.com/naman1402/distributed-chat-app/config"
 	"github.com/naman1402/distributed-chat-app/controller"
-	"github.com/naman1402/distributed-chat-app/database"
+	"github.com/naman1402/distributed-chat-app/metrics"
+	"github.com/naman1402/distributed-chat-app/repository"
+	"github.com/naman1402/distributed-chat-app/settings"
 )
 
-func Start() {
+// Start sets every subsystem up from cfg and serves the API on cfg.Server.Port
+// until SIGTERM or SIGINT, then drains the connections within cfg.Server.ShutdownTimeout
+// Returns an error if a subsystem cannot be set up
+func Start(cfg *settings.Config) error {
 
 	router := gin.Default()
 
 	// Add logging middleware
 	router.Use(gin.Logger())
 
-	database.SetupConnection()
+	metrics.Setup(cfg.Server.ServerId)           // Prometheus metrics labelled with this server
+	repository.Setup(cfg.Storage, cfg.Cassandra) // cassandra or in-memory storage
+	blob.Setup(cfg.Blob)                         // attachment storage, local directory or S3-compatible bucket
+	controller.SetupAttachments(cfg.Attachments)
+	controller.SetupCookie(cfg.Cookie)
+	config.Setup(cfg.Server, cfg.WebSocket, cfg.Limits)
 
 	/**
 	sets redis client, establishing connection to a redis db
@@ -27,30 +42,77 @@ func Start() {
 	config.PubSub() receiving data and config.Send() processing and distributing it
 
 	*/
-	config.NPool()     // create the redis.Client
-	go config.PubSub() // receive message from pub sub and adds to broadcast channel
-	go config.Send()   // gets message from broadcast channel, processes it and further sends it
+	// Redis holds the state shared by the servers and carries the redis and streams brokers,
+	// a single server with the memory storage and the memory or nats broker runs without it
+	if cfg.Storage.Backend != "memory" || cfg.Broker.Kind == "redis" || cfg.Broker.Kind == "streams" {
+		config.NPool(cfg.Redis) // create the redis client (single node, sentinel or cluster)
+	}
+	config.SetupState(cfg.Storage)                         // routes, sequence numbers, retries, unread ids and leases: redis or in-memory
+	if err := config.SetupBroker(cfg.Broker); err != nil { // redis pub/sub, redis streams, nats or in-memory
+		return err
+	}
+	config.SetupRouting(cfg.Routing)   // user -> server routes in redis, cached locally
+	config.SetupRegistry(cfg.Registry) // server leases and the reaper of expired servers
+	go config.PubSub()                 // receive message from the broker and adds to broadcast channel
+	go config.RoomPubSub()             // same for the messages of the rooms with members connected here
+	go config.Send()                   // gets message from broadcast channel, processes it and further sends it
+	go config.MonitorStorage()         // pings the storage backend for the readiness check
 
-	// Add health check endpoint
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{"status": "ok"})
-	})
+	// liveness: 200 as long as the process serves requests
+	router.GET("/livez", config.Liveness)
+	// readiness: 503 with the state of every dependency while one is down or the server drains
+	router.GET("/readyz", config.Readiness)
+	router.GET("/health", config.Readiness)
+	// Prometheus metrics
+	router.GET("/metrics", metrics.Handler())
+	// live servers with their connection counts
+	router.GET("/servers", config.Servers)
 
 	router.GET("/", home)
+	router.GET("/ws", func(c *gin.Context) {
+		config.WSHandler(c.Writer, c.Request, c)
+	})
 	router.POST("/create", controller.CreateRoom)
 	router.POST("/join", controller.JoinRoom)
 	router.POST("/signin", controller.CreateUser)
 	router.POST("/login", controller.LoginUser)
+	router.GET("/thread/:thread_id", controller.GetThread)
+	router.POST("/thread/subscribe", controller.SubscribeToThread)
+	router.POST("/thread/unsubscribe", controller.UnsubscribeFromThread)
+	router.GET("/mentions", controller.GetMentionsInbox)
+	router.GET("/conversations", config.Conversations)
+	router.GET("/inbox", config.Inbox)
+	router.GET("/search", controller.SearchMessages)
+	router.POST("/attachments", controller.CreateUpload)
+	router.HEAD("/attachments/:attachment_id", controller.UploadStatus)
+	router.PATCH("/attachments/:attachment_id", controller.UploadChunk)
+	router.GET("/attachments/:attachment_id/link", controller.AttachmentLink)
+	router.GET("/attachments/:attachment_id/download", controller.DownloadAttachment)
+	router.GET("/attachments/:attachment_id/thumbnail", controller.DownloadThumbnail)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is required")
-	}
-
+	port := strconv.Itoa(cfg.Server.Port)
 	log.Printf("Server starting on port: %s", port)
-	if err := router.Run("0.0.0.0:" + port); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	srv := &http.Server{Addr: "0.0.0.0:" + port, Handler: router}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	<-stop.Done()
+	cancel()
+	log.Printf("Shutting down, draining connections within %s", cfg.Server.ShutdownTimeout)
+
+	// the listener stays open while draining so /health reports it to the load balancer
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout.Duration)
+	defer cancel()
+	config.Drain(ctx, cfg.Server.ShutdownJitter.Duration)
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("server shutdown: ", err)
 	}
+	log.Println("Server stopped")
+	return nil
 }
 
 func home(c *gin.Context) {
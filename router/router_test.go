@@ -0,0 +1,146 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/naman1402/distributed-chat-app/settings"
+)
+
+// freePort returns a port nothing listens on
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// TestStartWithoutRedis runs a single server with the memory storage and broker, the redis
+// address points nowhere: signing up, connecting and a private message must work, and SIGTERM
+// stops the server
+func TestStartWithoutRedis(t *testing.T) {
+	// the test receives SIGTERM too, so it does not kill the process before Start listens for it
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM)
+	defer signal.Stop(sigterm)
+
+	cfg := settings.Default()
+	cfg.Server.ServerId = "TEST1"
+	cfg.Server.Port = freePort(t)
+	cfg.Server.ShutdownTimeout = settings.Duration{Duration: 5 * time.Second}
+	cfg.Server.ShutdownJitter = settings.Duration{}
+	cfg.Storage.Backend = "memory"
+	cfg.Broker.Kind = "memory"
+	cfg.Blob.Dir = t.TempDir()
+	cfg.Redis.Addrs = []string{"127.0.0.1:" + strconv.Itoa(freePort(t))}
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- Start(&cfg) }()
+
+	base := "http://127.0.0.1:" + strconv.Itoa(cfg.Server.Port)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(base + "/livez")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server not listening: ", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	post := func(path, body string, want int) {
+		resp, err := http.Post(base+path, "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("POST %s: status %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+	for _, user := range []string{"alice", "bob"} {
+		post("/signin", `{"username":"`+user+`"}`, http.StatusCreated)
+		post("/login", `{"id":"`+user+`"}`, http.StatusOK)
+	}
+
+	resp, err := http.Get(base + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ready struct {
+		Checks map[string]struct {
+			Kind string `json:"kind"`
+		} `json:"checks"`
+	}
+	json.NewDecoder(resp.Body).Decode(&ready)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || ready.Checks["state"].Kind != "memory" {
+		t.Fatalf("readyz: status %d, checks %+v", resp.StatusCode, ready.Checks)
+	}
+
+	dial := func(user string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:"+strconv.Itoa(cfg.Server.Port)+"/ws?id="+user, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		// "ok" is written once the route of the user is claimed
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, data, err := conn.ReadMessage(); err != nil || string(data) != "ok" {
+			t.Fatalf("%s not connected: %q %v", user, data, err)
+		}
+		return conn
+	}
+	// next reads until a message of the given type ("" for chat messages)
+	next := func(conn *websocket.Conn, kind string) map[string]interface{} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := map[string]interface{}{}
+			json.Unmarshal(data, &msg)
+			if msg["type"] == nil && kind == "" || msg["type"] == kind {
+				return msg
+			}
+		}
+	}
+	alice, bob := dial("alice"), dial("bob")
+	alice.WriteJSON(map[string]interface{}{"msg": "hi", "receiver": "bob", "client_id": "c1"})
+	if ack := next(alice, "ack"); ack["duplicate"] != nil {
+		t.Fatalf("first send acked as duplicate: %v", ack)
+	}
+	if msg := next(bob, ""); msg["msg"] != "hi" || msg["sender"] != "alice" {
+		t.Fatalf("bob received %v", msg)
+	}
+	// a retry is acked as a duplicate
+	alice.WriteJSON(map[string]interface{}{"msg": "hi", "receiver": "bob", "client_id": "c1"})
+	if ack := next(alice, "ack"); ack["duplicate"] != true {
+		t.Fatalf("retry not acked as duplicate: %v", ack)
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("server did not stop")
+	}
+}
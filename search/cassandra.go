@@ -0,0 +1,63 @@
+package search
+
+import (
+	"github.com/naman1402/distributed-chat-app/database"
+)
+
+// CassandraIndex is an inverted index stored in the search_index table
+// one row per (conversation, term, message), so every server shares the same index
+// and a query only ever touches the partitions of the caller's conversations
+type CassandraIndex struct{}
+
+// Index writes one posting per distinct term of the message
+// postings live in different partitions, they are written concurrently rather than batched
+func (CassandraIndex) Index(doc Document) error {
+	query := `INSERT INTO search_index(conversation, term, message_id, sender, msg, timestamp) VALUES (?, ?, ?, ?, ?, ?)`
+	terms := Tokenize(doc.Message)
+	return database.ForEach(len(terms), func(i int) error {
+		return database.ExecuteQuery(query, doc.Conversation, terms[i], doc.Id, doc.Sender, doc.Message, doc.Timestamp)
+	})
+}
+
+// Search scans, in every conversation, the postings of the longest query term
+// and keeps the messages that contain all the other terms too
+// Implementation:
+// 1. Tokenizes the query, picks the longest term as the one to scan (usually the rarest)
+// 2. For each conversation reads postings newest first, older than q.Before
+// 3. Stops a conversation once it produced q.Limit hits
+// 4. Merges all conversations newest first and keeps q.Limit hits
+func (CassandraIndex) Search(q Query) ([]Hit, error) {
+	terms := Tokenize(q.Text)
+	hits := []Hit{}
+	if len(terms) == 0 {
+		return hits, nil
+	}
+	scan := terms[0]
+	for _, term := range terms[1:] {
+		if len(term) > len(scan) {
+			scan = term
+		}
+	}
+	for _, conversation := range q.Conversations {
+		query := `SELECT message_id, sender, msg, timestamp FROM search_index WHERE conversation = ? AND term = ?`
+		args := []interface{}{conversation, scan}
+		if q.Before != "" {
+			query = `SELECT message_id, sender, msg, timestamp FROM search_index WHERE conversation = ? AND term = ? AND message_id < ?`
+			args = append(args, q.Before)
+		}
+		iter := database.SelectQuery(query, args...).Iter()
+		found := 0
+		doc := Document{Conversation: conversation}
+		for found < q.Limit && iter.Scan(&doc.Id, &doc.Sender, &doc.Message, &doc.Timestamp) {
+			if containsAll(doc.Message, terms) {
+				hits = append(hits, Hit{Document: doc, Highlight: Highlight(doc.Message, terms)})
+				found++
+			}
+			doc = Document{Conversation: conversation}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return sortHits(hits, q.Limit), nil
+}
@@ -0,0 +1,51 @@
+package search
+
+import "sync"
+
+// MemoryIndex keeps the postings in process, for single-node mode and tests
+// postings: conversation -> term -> message id -> document
+type MemoryIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[string]map[string]Document
+}
+
+func NewMemoryIndex() *MemoryIndex {
+	return &MemoryIndex{postings: make(map[string]map[string]map[string]Document)}
+}
+
+// Index adds one posting per distinct term of the message
+func (m *MemoryIndex) Index(doc Document) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	terms := m.postings[doc.Conversation]
+	if terms == nil {
+		terms = make(map[string]map[string]Document)
+		m.postings[doc.Conversation] = terms
+	}
+	for _, term := range Tokenize(doc.Message) {
+		if terms[term] == nil {
+			terms[term] = make(map[string]Document)
+		}
+		terms[term][doc.Id] = doc
+	}
+	return nil
+}
+
+// Search returns the messages of q.Conversations containing every query term, newest first
+func (m *MemoryIndex) Search(q Query) ([]Hit, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	terms := Tokenize(q.Text)
+	hits := []Hit{}
+	if len(terms) == 0 {
+		return hits, nil
+	}
+	for _, conversation := range q.Conversations {
+		for id, doc := range m.postings[conversation][terms[0]] {
+			if (q.Before == "" || id < q.Before) && containsAll(doc.Message, terms) {
+				hits = append(hits, Hit{Document: doc, Highlight: Highlight(doc.Message, terms)})
+			}
+		}
+	}
+	return sortHits(hits, q.Limit), nil
+}
@@ -0,0 +1,58 @@
+package search
+
+import (
+	"testing"
+)
+
+func TestMemoryIndex(t *testing.T) {
+	index := NewMemoryIndex()
+	docs := []Document{
+		{Id: "1", Conversation: "group:r1", Sender: "alice", Message: "Deploy the release today"},
+		{Id: "2", Conversation: "group:r1", Sender: "bob", Message: "release notes are ready"},
+		{Id: "3", Conversation: "group:r2", Sender: "carol", Message: "release party"},
+		{Id: "4", Conversation: "group:r1", Sender: "alice", Message: "<b>release</b> done"},
+	}
+	for _, doc := range docs {
+		if err := index.Index(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name  string
+		query Query
+		ids   []string
+	}{
+		{"newest first", Query{Text: "release", Conversations: []string{"group:r1"}, Limit: 10}, []string{"4", "2", "1"}},
+		{"every term must match", Query{Text: "release notes", Conversations: []string{"group:r1"}, Limit: 10}, []string{"2"}},
+		{"only the given conversations", Query{Text: "party", Conversations: []string{"group:r1"}, Limit: 10}, []string{}},
+		{"several conversations", Query{Text: "release", Conversations: []string{"group:r1", "group:r2"}, Limit: 10}, []string{"4", "3", "2", "1"}},
+		{"before cursor", Query{Text: "release", Conversations: []string{"group:r1"}, Before: "4", Limit: 10}, []string{"2", "1"}},
+		{"limit", Query{Text: "release", Conversations: []string{"group:r1"}, Limit: 1}, []string{"4"}},
+		{"no terms", Query{Text: "a !", Conversations: []string{"group:r1"}, Limit: 10}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits, err := index.Search(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, hit := range hits {
+				ids = append(ids, hit.Id)
+			}
+			if len(ids) != len(tt.ids) {
+				t.Fatalf("got %v, want %v", ids, tt.ids)
+			}
+			for i := range ids {
+				if ids[i] != tt.ids[i] {
+					t.Fatalf("got %v, want %v", ids, tt.ids)
+				}
+			}
+		})
+	}
+
+	hits, _ := index.Search(Query{Text: "release", Conversations: []string{"group:r1"}, Limit: 1})
+	if want := "&lt;b&gt;<mark>release</mark>&lt;/b&gt; done"; hits[0].Highlight != want {
+		t.Fatalf("highlight %q, want %q", hits[0].Highlight, want)
+	}
+}
@@ -0,0 +1,135 @@
+// Package search implements full-text search over chat history
+// Messages are indexed by the controllers as they are saved, queries are always
+// scoped to a list of conversations so callers only see their own history
+package search
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Document is a message as seen by the indexer
+// Conversation: "group:{room}" or "dm:{user}:{user}" (users sorted, see PrivateConversation)
+type Document struct {
+	Id           string    `json:"id"`
+	Conversation string    `json:"conversation"`
+	Sender       string    `json:"sender"`
+	Message      string    `json:"msg"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// Hit is a matching message with the query terms highlighted
+type Hit struct {
+	Document
+	Highlight string `json:"highlight"`
+}
+
+// Query describes a search restricted to Conversations
+// Before: only messages with a smaller id are returned (pagination cursor)
+type Query struct {
+	Text          string
+	Conversations []string
+	Before        string
+	Limit         int
+}
+
+// Indexer stores documents and answers queries
+// Index must be safe to call from every server, Search returns hits newest first
+type Indexer interface {
+	Index(doc Document) error
+	Search(q Query) ([]Hit, error)
+}
+
+// Engine is the indexer used by the controllers
+var Engine Indexer = CassandraIndex{}
+
+// minTermLength drops single characters, they match almost everything
+const minTermLength = 2
+
+// GroupConversation returns the conversation id of a room
+func GroupConversation(room string) string {
+	return "group:" + room
+}
+
+// PrivateConversation returns the conversation id shared by both users of a DM
+func PrivateConversation(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return "dm:" + a + ":" + b
+}
+
+// Tokenize lowercases the text and splits it on anything that is not a letter or a digit
+// terms are returned once, in order of first appearance
+func Tokenize(text string) []string {
+	terms := []string{}
+	seen := make(map[string]bool)
+	for _, field := range strings.FieldsFunc(strings.ToLower(text), isSeparator) {
+		if len([]rune(field)) < minTermLength || seen[field] {
+			continue
+		}
+		seen[field] = true
+		terms = append(terms, field)
+	}
+	return terms
+}
+
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// Highlight wraps every token of text that is one of terms in <mark></mark>
+// the text is HTML escaped, the marks are the only markup in the result
+func Highlight(text string, terms []string) string {
+	match := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		match[term] = true
+	}
+	var b strings.Builder
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		if isSeparator(runes[i]) {
+			b.WriteString(html.EscapeString(string(runes[i])))
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && !isSeparator(runes[j]) {
+			j++
+		}
+		token := string(runes[i:j])
+		if match[strings.ToLower(token)] {
+			b.WriteString("<mark>" + html.EscapeString(token) + "</mark>")
+		} else {
+			b.WriteString(html.EscapeString(token))
+		}
+		i = j
+	}
+	return b.String()
+}
+
+// containsAll reports whether every term appears in the tokens of text
+func containsAll(text string, terms []string) bool {
+	tokens := make(map[string]bool)
+	for _, token := range Tokenize(text) {
+		tokens[token] = true
+	}
+	for _, term := range terms {
+		if !tokens[term] {
+			return false
+		}
+	}
+	return true
+}
+
+// sortHits orders hits newest first (ksuid order) and keeps at most limit
+func sortHits(hits []Hit, limit int) []Hit {
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Id > hits[j].Id })
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
@@ -0,0 +1,57 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		terms []string
+	}{
+		{"empty", "", []string{}},
+		{"lowercase and punctuation", "Hello, World! hello?", []string{"hello", "world"}},
+		{"single characters dropped", "a b cd e", []string{"cd"}},
+		{"digits", "room 42 at 9am", []string{"room", "42", "at", "9am"}},
+		{"unicode letters", "Ünïcode café", []string{"ünïcode", "café"}},
+		{"markup is split", "<script>alert(1)</script>", []string{"script", "alert"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Tokenize(tt.text); !reflect.DeepEqual(got, tt.terms) {
+				t.Fatalf("Tokenize(%q) = %v, want %v", tt.text, got, tt.terms)
+			}
+		})
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		terms []string
+		want  string
+	}{
+		{"no match", "hello world", []string{"bye"}, "hello world"},
+		{"case insensitive, original case kept", "Hello hello", []string{"hello"}, "<mark>Hello</mark> <mark>hello</mark>"},
+		{"whole tokens only", "helloworld hello", []string{"hello"}, "helloworld <mark>hello</mark>"},
+		{"script is escaped", "<script>alert('x')</script>", []string{"alert"}, "&lt;script&gt;<mark>alert</mark>(&#39;x&#39;)&lt;/script&gt;"},
+		{"matched script tag is escaped inside the mark", "<script>", []string{"script"}, "&lt;<mark>script</mark>&gt;"},
+		{"entities and quotes", `a & b "q"`, []string{"q"}, `a &amp; b &#34;<mark>q</mark>&#34;`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Highlight(tt.text, tt.terms); got != tt.want {
+				t.Fatalf("Highlight(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrivateConversation(t *testing.T) {
+	if PrivateConversation("bob", "alice") != "dm:alice:bob" || PrivateConversation("alice", "bob") != "dm:alice:bob" {
+		t.Fatal("both users must share the conversation id")
+	}
+}
@@ -0,0 +1,66 @@
+package search
+
+import (
+	"github.com/naman1402/distributed-chat-app/database"
+)
+
+// SQLIndex is the inverted index of the sqlite and postgres backends, stored in
+// search_index with the same layout as CassandraIndex
+type SQLIndex struct{}
+
+// Index writes one posting per distinct term of the message
+func (SQLIndex) Index(doc Document) error {
+	query := database.Rebind(`INSERT INTO search_index(conversation, term, message_id, sender, msg, created_at) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`)
+	for _, term := range Tokenize(doc.Message) {
+		if _, err := database.SQL.Exec(query, doc.Conversation, term, doc.Id, doc.Sender, doc.Message, doc.Timestamp.UTC()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Search scans the postings of the longest query term in every conversation and keeps
+// the messages that contain all the other terms too, see CassandraIndex.Search
+func (SQLIndex) Search(q Query) ([]Hit, error) {
+	terms := Tokenize(q.Text)
+	hits := []Hit{}
+	if len(terms) == 0 {
+		return hits, nil
+	}
+	scan := terms[0]
+	for _, term := range terms[1:] {
+		if len(term) > len(scan) {
+			scan = term
+		}
+	}
+	for _, conversation := range q.Conversations {
+		query := `SELECT message_id, sender, msg, created_at FROM search_index WHERE conversation = ? AND term = ? ORDER BY message_id DESC`
+		args := []interface{}{conversation, scan}
+		if q.Before != "" {
+			query = `SELECT message_id, sender, msg, created_at FROM search_index WHERE conversation = ? AND term = ? AND message_id < ? ORDER BY message_id DESC`
+			args = append(args, q.Before)
+		}
+		rows, err := database.SQL.Query(database.Rebind(query), args...)
+		if err != nil {
+			return nil, err
+		}
+		found := 0
+		for found < q.Limit && rows.Next() {
+			doc := Document{Conversation: conversation}
+			if err := rows.Scan(&doc.Id, &doc.Sender, &doc.Message, &doc.Timestamp); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if containsAll(doc.Message, terms) {
+				hits = append(hits, Hit{Document: doc, Highlight: Highlight(doc.Message, terms)})
+				found++
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sortHits(hits, q.Limit), nil
+}
@@ -0,0 +1,168 @@
+package settings
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration written as "500ms" or "2s" in files, variables and flags
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	d.Duration = v
+	return err
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Load builds the configuration for the given command line arguments
+// Implementation:
+// 1. Starts from Default
+// 2. Reads the file named by -config or CONFIG_FILE, ".toml" files as TOML and anything else as YAML
+// 3. Applies the environment variables that are set
+// 4. Applies the flags that were passed
+// 5. Validates the result
+// Returns flag.ErrHelp when -h was passed, after printing the usage
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("chat", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "path of a YAML or TOML config file")
+	passed := map[string]string{}
+	walk(reflect.ValueOf(&cfg).Elem(), func(field reflect.StructField, _ reflect.Value) {
+		name := field.Tag.Get("flag")
+		usage := field.Tag.Get("usage") + " (env " + field.Tag.Get("env") + ")"
+		fs.Func(name, usage, func(v string) error {
+			passed[name] = v
+			return nil
+		})
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		if err := loadFile(*path, &cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	walk(reflect.ValueOf(&cfg).Elem(), func(field reflect.StructField, v reflect.Value) {
+		env := field.Tag.Get("env")
+		if s, ok := os.LookupEnv(env); ok && err == nil {
+			if e := set(v, s); e != nil {
+				err = fmt.Errorf("%s: %w", env, e)
+			}
+		}
+	})
+	walk(reflect.ValueOf(&cfg).Elem(), func(field reflect.StructField, v reflect.Value) {
+		name := field.Tag.Get("flag")
+		if s, ok := passed[name]; ok && err == nil {
+			if e := set(v, s); e != nil {
+				err = fmt.Errorf("-%s: %w", name, e)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// loadFile decodes the file over cfg, keys missing from the file keep their value
+func loadFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if filepath.Ext(path) == ".toml" {
+		err = toml.Unmarshal(data, cfg)
+	} else {
+		err = yaml.Unmarshal(data, cfg)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Print writes the effective configuration as YAML, secrets are masked
+func (c Config) Print(w io.Writer) {
+	walk(reflect.ValueOf(&c).Elem(), func(field reflect.StructField, v reflect.Value) {
+		if field.Tag.Get("secret") == "true" && v.String() != "" {
+			v.SetString("********")
+		}
+	})
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Fprintf(w, "effective configuration:\n%s", data)
+}
+
+// walk calls fn for every setting of the struct, descending into the sections
+func walk(v reflect.Value, fn func(reflect.StructField, reflect.Value)) {
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+		if field.Tag.Get("env") == "" && value.Kind() == reflect.Struct {
+			walk(value, fn)
+			continue
+		}
+		fn(field, value)
+	}
+}
+
+// set parses s into the setting, lists are comma separated
+func set(v reflect.Value, s string) error {
+	if d, ok := v.Addr().Interface().(*Duration); ok {
+		return d.UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		list := []string{}
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package settings
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearEnv unsets every setting variable for the test, so the environment of the
+// machine running the tests does not leak into the layering
+func clearEnv(t *testing.T) {
+	cfg := Default()
+	walk(reflect.ValueOf(&cfg).Elem(), func(field reflect.StructField, _ reflect.Value) {
+		env := field.Tag.Get("env")
+		if _, ok := os.LookupEnv(env); ok {
+			t.Setenv(env, "")
+			os.Unsetenv(env)
+		}
+	})
+	t.Setenv("CONFIG_FILE", "")
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const yamlConfig = `
+server:
+  server_id: S1
+  port: 8080
+redis:
+  mode: cluster
+  addrs: [r1:6379, r2:6379]
+  password: from-file
+broker:
+  kind: streams
+routing:
+  ttl: 75s
+`
+
+const tomlConfig = `
+[server]
+server_id = "S1"
+port = 8080
+
+[redis]
+mode = "cluster"
+addrs = ["r1:6379", "r2:6379"]
+password = "from-file"
+
+[broker]
+kind = "streams"
+
+[routing]
+ttl = "75s"
+`
+
+func TestLoadLayers(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		// check inspects the loaded configuration
+		check func(t *testing.T, cfg *Config)
+	}{
+		{
+			name: "yaml file over defaults",
+			file: writeFile(t, "chat.yaml", yamlConfig),
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Server.ServerId != "S1" || cfg.Server.Port != 8080 || cfg.Broker.Kind != "streams" {
+					t.Fatalf("file values not applied: %+v %+v", cfg.Server, cfg.Broker)
+				}
+				if !reflect.DeepEqual(cfg.Redis.Addrs, []string{"r1:6379", "r2:6379"}) || cfg.Routing.TTL.Duration != 75*time.Second {
+					t.Fatalf("file values not applied: %+v %+v", cfg.Redis.Addrs, cfg.Routing.TTL)
+				}
+				// keys missing from the file keep their default
+				if cfg.Cassandra.Keyspace != "chat" || cfg.Routing.Heartbeat.Duration != 30*time.Second {
+					t.Fatalf("defaults lost: %q %s", cfg.Cassandra.Keyspace, cfg.Routing.Heartbeat)
+				}
+			},
+		},
+		{
+			name: "toml file over defaults",
+			file: writeFile(t, "chat.toml", tomlConfig),
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Server.ServerId != "S1" || cfg.Broker.Kind != "streams" || cfg.Routing.TTL.Duration != 75*time.Second {
+					t.Fatalf("file values not applied: %+v %+v %s", cfg.Server, cfg.Broker, cfg.Routing.TTL)
+				}
+				if !reflect.DeepEqual(cfg.Redis.Addrs, []string{"r1:6379", "r2:6379"}) || cfg.Storage.Backend != "cassandra" {
+					t.Fatalf("got %v %q", cfg.Redis.Addrs, cfg.Storage.Backend)
+				}
+			},
+		},
+		{
+			name: "env over file",
+			file: writeFile(t, "chat.yaml", yamlConfig),
+			env:  map[string]string{"SERVERID": "S2", "REDIS_ADDRS": "r3:6379, r4:6379,", "ROUTE_TTL": "1m", "REDIS_TLS": "true"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Server.ServerId != "S2" || cfg.Routing.TTL.Duration != time.Minute || !cfg.Redis.TLS {
+					t.Fatalf("env not applied: %q %s %v", cfg.Server.ServerId, cfg.Routing.TTL, cfg.Redis.TLS)
+				}
+				if !reflect.DeepEqual(cfg.Redis.Addrs, []string{"r3:6379", "r4:6379"}) {
+					t.Fatalf("list %v", cfg.Redis.Addrs)
+				}
+				// not overridden by the environment
+				if cfg.Broker.Kind != "streams" {
+					t.Fatalf("file value lost: %q", cfg.Broker.Kind)
+				}
+			},
+		},
+		{
+			name: "flags over env",
+			file: writeFile(t, "chat.yaml", yamlConfig),
+			env:  map[string]string{"SERVERID": "S2", "PORT": "9000"},
+			args: []string{"-server-id", "S3", "-broker", "nats", "-route-ttl=2m"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Server.ServerId != "S3" || cfg.Broker.Kind != "nats" || cfg.Routing.TTL.Duration != 2*time.Minute {
+					t.Fatalf("flags not applied: %q %q %s", cfg.Server.ServerId, cfg.Broker.Kind, cfg.Routing.TTL)
+				}
+				if cfg.Server.Port != 9000 {
+					t.Fatalf("env value lost: %d", cfg.Server.Port)
+				}
+			},
+		},
+		{
+			name: "config file from the environment",
+			env:  map[string]string{"CONFIG_FILE": writeFile(t, "chat.toml", tomlConfig)},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Server.ServerId != "S1" || cfg.Broker.Kind != "streams" {
+					t.Fatalf("CONFIG_FILE not read: %+v", cfg.Server)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", tt.file}, args...)
+			}
+			cfg, err := Load(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"missing server id", nil, []string{"-port", "80"}, "ServerId"},
+		{"invalid env value", map[string]string{"PORT": "eighty"}, []string{"-server-id", "S1"}, "PORT"},
+		{"invalid flag value", nil, []string{"-server-id", "S1", "-port", "80", "-route-ttl", "soon"}, "-route-ttl"},
+		{"unknown broker", nil, []string{"-server-id", "S1", "-port", "80", "-broker", "kafka"}, "Kind"},
+		{"missing file", nil, []string{"-config", "/does/not/exist.yaml"}, "exist.yaml"},
+		{"unknown flag", nil, []string{"-nope"}, "nope"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			_, err := Load(tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error about %s", err, tt.want)
+			}
+		})
+	}
+
+	clearEnv(t)
+	if _, err := Load([]string{"-h"}); !errors.Is(err, flag.ErrHelp) {
+		t.Fatalf("got %v, want flag.ErrHelp", err)
+	}
+}
+
+func TestPrintMasksSecrets(t *testing.T) {
+	cfg := Default()
+	cfg.Redis.Password = "redis-secret"
+	cfg.Blob.S3SecretKey = "s3-secret"
+	cfg.Attachments.Secret = "signing-secret"
+	cfg.Redis.Username = "chat"
+	var b bytes.Buffer
+	cfg.Print(&b)
+	out := b.String()
+	for _, secret := range []string{"redis-secret", "s3-secret", "signing-secret"} {
+		if strings.Contains(out, secret) {
+			t.Fatalf("secret %q printed:\n%s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "password: '********'") || !strings.Contains(out, "username: chat") {
+		t.Fatalf("masked or plain value missing:\n%s", out)
+	}
+	// empty secrets stay empty, and the printed config is a copy
+	if !strings.Contains(out, "sentinel_password: \"\"") || cfg.Redis.Password != "redis-secret" {
+		t.Fatalf("empty secret masked or config modified:\n%s", out)
+	}
+}
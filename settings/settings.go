@@ -0,0 +1,364 @@
+// Package settings implements the typed server configuration
+// Values are layered: defaults, then the config file (YAML or TOML), then environment
+// variables, then command line flags; see Load
+package settings
+
+import (
+	"errors"
+	"regexp"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
+// Config holds the settings of every subsystem, each Setup function receives its section
+// tags: yaml/toml name the key in the config file, env the environment variable,
+// flag the command line flag, secret:"true" hides the value when the config is printed
+type Config struct {
+	Server      Server      `yaml:"server" toml:"server"`
+	Storage     Storage     `yaml:"storage" toml:"storage"`
+	Cassandra   Cassandra   `yaml:"cassandra" toml:"cassandra"`
+	Redis       Redis       `yaml:"redis" toml:"redis"`
+	Broker      Broker      `yaml:"broker" toml:"broker"`
+	Routing     Routing     `yaml:"routing" toml:"routing"`
+	Registry    Registry    `yaml:"registry" toml:"registry"`
+	Blob        Blob        `yaml:"blob" toml:"blob"`
+	Attachments Attachments `yaml:"attachments" toml:"attachments"`
+	WebSocket   WebSocket   `yaml:"websocket" toml:"websocket"`
+	Cookie      Cookie      `yaml:"cookie" toml:"cookie"`
+	Limits      Limits      `yaml:"limits" toml:"limits"`
+}
+
+// Server identifies this instance
+// ServerId names the broker channel the server receives its messages on, unique per server
+// on SIGTERM the server drains its connections within ShutdownTimeout, closing them
+// spread over ShutdownJitter
+type Server struct {
+	ServerId        string   `yaml:"server_id" toml:"server_id" env:"SERVERID" flag:"server-id" usage:"unique id of this server"`
+	Port            int      `yaml:"port" toml:"port" env:"PORT" flag:"port" usage:"HTTP port"`
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"deadline for draining connections on shutdown"`
+	ShutdownJitter  Duration `yaml:"shutdown_jitter" toml:"shutdown_jitter" env:"SHUTDOWN_JITTER" flag:"shutdown-jitter" usage:"window over which connections are closed on shutdown"`
+}
+
+// Storage selects where users, rooms and messages are kept: "cassandra", "sqlite", "postgres" or "memory"
+// memory keeps everything in process and loses it on restart, for tests and single-node trials
+// DSN: database file for sqlite (default ./data/chat.db), connection URL for postgres
+// zero pool settings keep the database/sql defaults (sqlite always uses a single connection)
+type Storage struct {
+	Backend         string   `yaml:"backend" toml:"backend" env:"STORAGE_BACKEND" flag:"storage-backend" usage:"cassandra, sqlite, postgres or memory"`
+	DSN             string   `yaml:"dsn" toml:"dsn" env:"STORAGE_DSN" flag:"storage-dsn" usage:"sqlite file or postgres URL" secret:"true"`
+	MaxOpenConns    int      `yaml:"max_open_conns" toml:"max_open_conns" env:"STORAGE_MAX_OPEN_CONNS" flag:"storage-max-open-conns" usage:"open SQL connections"`
+	MaxIdleConns    int      `yaml:"max_idle_conns" toml:"max_idle_conns" env:"STORAGE_MAX_IDLE_CONNS" flag:"storage-max-idle-conns" usage:"idle SQL connections"`
+	ConnMaxLifetime Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime" env:"STORAGE_CONN_MAX_LIFETIME" flag:"storage-conn-max-lifetime" usage:"lifetime of an SQL connection"`
+}
+
+// Cassandra configures the database session
+// Consistency: any, one, two, three, quorum, all, local_quorum, each_quorum or local_one
+type Cassandra struct {
+	Hosts       []string `yaml:"hosts" toml:"hosts" env:"CASSANDRA_HOSTS" flag:"cassandra-hosts" usage:"comma separated Cassandra contact points"`
+	Keyspace    string   `yaml:"keyspace" toml:"keyspace" env:"CASSANDRA_KEYSPACE" flag:"cassandra-keyspace" usage:"Cassandra keyspace"`
+	Consistency string   `yaml:"consistency" toml:"consistency" env:"CASSANDRA_CONSISTENCY" flag:"cassandra-consistency" usage:"Cassandra consistency level"`
+	Username    string   `yaml:"username" toml:"username" env:"CASSANDRA_USERNAME" flag:"cassandra-username" usage:"Cassandra username"`
+	Password    string   `yaml:"password" toml:"password" env:"CASSANDRA_PASSWORD" flag:"cassandra-password" usage:"Cassandra password" secret:"true"`
+	Timeout     Duration `yaml:"timeout" toml:"timeout" env:"CASSANDRA_TIMEOUT" flag:"cassandra-timeout" usage:"Cassandra query timeout"`
+	LocalDC     string   `yaml:"local_dc" toml:"local_dc" env:"CASSANDRA_LOCAL_DC" flag:"cassandra-local-dc" usage:"datacenter preferred when picking replicas (empty = any)"`
+	NumConns    int      `yaml:"num_conns" toml:"num_conns" env:"CASSANDRA_NUM_CONNS" flag:"cassandra-num-conns" usage:"connections per Cassandra host"`
+
+	MaxPreparedStmts int `yaml:"max_prepared_stmts" toml:"max_prepared_stmts" env:"CASSANDRA_MAX_PREPARED_STMTS" flag:"cassandra-max-prepared-stmts" usage:"prepared statements cached per session"`
+
+	Retries         int      `yaml:"retries" toml:"retries" env:"CASSANDRA_RETRIES" flag:"cassandra-retries" usage:"retries of a failed query (0 = none)"`
+	RetryMinBackoff Duration `yaml:"retry_min_backoff" toml:"retry_min_backoff" env:"CASSANDRA_RETRY_MIN_BACKOFF" flag:"cassandra-retry-min-backoff" usage:"wait before the first retry"`
+	RetryMaxBackoff Duration `yaml:"retry_max_backoff" toml:"retry_max_backoff" env:"CASSANDRA_RETRY_MAX_BACKOFF" flag:"cassandra-retry-max-backoff" usage:"longest wait between retries"`
+
+	SpeculativeAttempts int      `yaml:"speculative_attempts" toml:"speculative_attempts" env:"CASSANDRA_SPECULATIVE_ATTEMPTS" flag:"cassandra-speculative-attempts" usage:"extra executions of a slow idempotent query (0 = off)"`
+	SpeculativeDelay    Duration `yaml:"speculative_delay" toml:"speculative_delay" env:"CASSANDRA_SPECULATIVE_DELAY" flag:"cassandra-speculative-delay" usage:"wait before each speculative execution"`
+
+	Concurrency int `yaml:"concurrency" toml:"concurrency" env:"CASSANDRA_CONCURRENCY" flag:"cassandra-concurrency" usage:"parallel queries of a fan-out lookup"`
+}
+
+// Redis configures the Redis client
+// Mode: "single", "sentinel" (Addrs are the Sentinels) or "cluster" (Addrs are seed nodes)
+// zero pool sizes and timeouts keep the go-redis defaults
+type Redis struct {
+	Mode             string   `yaml:"mode" toml:"mode" env:"REDIS_MODE" flag:"redis-mode" usage:"single, sentinel or cluster"`
+	Addrs            []string `yaml:"addrs" toml:"addrs" env:"REDIS_ADDRS" flag:"redis-addrs" usage:"comma separated host:port list"`
+	MasterName       string   `yaml:"master_name" toml:"master_name" env:"REDIS_MASTER_NAME" flag:"redis-master-name" usage:"master monitored by Sentinel"`
+	Username         string   `yaml:"username" toml:"username" env:"REDIS_USERNAME" flag:"redis-username" usage:"Redis ACL username"`
+	Password         string   `yaml:"password" toml:"password" env:"REDIS_PASSWORD" flag:"redis-password" usage:"Redis password" secret:"true"`
+	SentinelUsername string   `yaml:"sentinel_username" toml:"sentinel_username" env:"REDIS_SENTINEL_USERNAME" flag:"redis-sentinel-username" usage:"Sentinel ACL username"`
+	SentinelPassword string   `yaml:"sentinel_password" toml:"sentinel_password" env:"REDIS_SENTINEL_PASSWORD" flag:"redis-sentinel-password" usage:"Sentinel password" secret:"true"`
+	DB               int      `yaml:"db" toml:"db" env:"REDIS_DB" flag:"redis-db" usage:"Redis database number"`
+	TLS              bool     `yaml:"tls" toml:"tls" env:"REDIS_TLS" flag:"redis-tls" usage:"connect to Redis over TLS"`
+	TLSServerName    string   `yaml:"tls_server_name" toml:"tls_server_name" env:"REDIS_TLS_SERVER_NAME" flag:"redis-tls-server-name" usage:"host name verified by TLS"`
+	PoolSize         int      `yaml:"pool_size" toml:"pool_size" env:"REDIS_POOL_SIZE" flag:"redis-pool-size" usage:"connections per node"`
+	MinIdleConns     int      `yaml:"min_idle_conns" toml:"min_idle_conns" env:"REDIS_MIN_IDLE_CONNS" flag:"redis-min-idle-conns" usage:"idle connections kept per node"`
+	DialTimeout      Duration `yaml:"dial_timeout" toml:"dial_timeout" env:"REDIS_DIAL_TIMEOUT" flag:"redis-dial-timeout" usage:"Redis dial timeout"`
+	ReadTimeout      Duration `yaml:"read_timeout" toml:"read_timeout" env:"REDIS_READ_TIMEOUT" flag:"redis-read-timeout" usage:"Redis read timeout"`
+	WriteTimeout     Duration `yaml:"write_timeout" toml:"write_timeout" env:"REDIS_WRITE_TIMEOUT" flag:"redis-write-timeout" usage:"Redis write timeout"`
+	PoolTimeout      Duration `yaml:"pool_timeout" toml:"pool_timeout" env:"REDIS_POOL_TIMEOUT" flag:"redis-pool-timeout" usage:"wait for a free connection"`
+}
+
+// Broker selects the transport between servers: "redis", "streams", "nats" or "memory"
+type Broker struct {
+	Kind         string `yaml:"kind" toml:"kind" env:"BROKER" flag:"broker" usage:"redis, streams, nats or memory"`
+	StreamMaxLen int64  `yaml:"stream_max_len" toml:"stream_max_len" env:"STREAM_MAXLEN" flag:"stream-max-len" usage:"approximate length Redis Streams are trimmed to"`
+	NatsURL      string `yaml:"nats_url" toml:"nats_url" env:"NATS_URL" flag:"nats-url" usage:"NATS server URL"`
+}
+
+// Routing configures the user to server routing table kept in Redis
+// a route lives for TTL and is renewed every Heartbeat while the user is connected,
+// lookups are cached in process for up to CacheTTL and invalidated earlier through pub/sub
+type Routing struct {
+	TTL       Duration `yaml:"ttl" toml:"ttl" env:"ROUTE_TTL" flag:"route-ttl" usage:"lifetime of a route without heartbeat"`
+	Heartbeat Duration `yaml:"heartbeat" toml:"heartbeat" env:"ROUTE_HEARTBEAT" flag:"route-heartbeat" usage:"interval at which the routes of connected users are renewed"`
+	CacheSize int      `yaml:"cache_size" toml:"cache_size" env:"ROUTE_CACHE_SIZE" flag:"route-cache-size" usage:"routes cached in process"`
+	CacheTTL  Duration `yaml:"cache_ttl" toml:"cache_ttl" env:"ROUTE_CACHE_TTL" flag:"route-cache-ttl" usage:"longest time a cached route is used"`
+}
+
+// Registry configures the list of live servers kept in Redis
+// every server renews a lease of Lease every Heartbeat, and checks every ReapInterval
+// for servers whose lease expired to clean up after them
+type Registry struct {
+	Heartbeat    Duration `yaml:"heartbeat" toml:"heartbeat" env:"SERVER_HEARTBEAT" flag:"server-heartbeat" usage:"interval at which the server renews its lease"`
+	Lease        Duration `yaml:"lease" toml:"lease" env:"SERVER_LEASE" flag:"server-lease" usage:"time after which a server without heartbeat is considered dead"`
+	ReapInterval Duration `yaml:"reap_interval" toml:"reap_interval" env:"SERVER_REAP_INTERVAL" flag:"server-reap-interval" usage:"interval at which dead servers are looked for"`
+}
+
+// Blob selects the attachment store: "local" (Dir) or "s3"
+type Blob struct {
+	Store       string `yaml:"store" toml:"store" env:"BLOB_STORE" flag:"blob-store" usage:"local or s3"`
+	Dir         string `yaml:"dir" toml:"dir" env:"BLOB_DIR" flag:"blob-dir" usage:"directory of the local store"`
+	S3Endpoint  string `yaml:"s3_endpoint" toml:"s3_endpoint" env:"S3_ENDPOINT" flag:"s3-endpoint" usage:"S3 endpoint"`
+	S3Bucket    string `yaml:"s3_bucket" toml:"s3_bucket" env:"S3_BUCKET" flag:"s3-bucket" usage:"S3 bucket"`
+	S3AccessKey string `yaml:"s3_access_key" toml:"s3_access_key" env:"S3_ACCESS_KEY" flag:"s3-access-key" usage:"S3 access key"`
+	S3SecretKey string `yaml:"s3_secret_key" toml:"s3_secret_key" env:"S3_SECRET_KEY" flag:"s3-secret-key" usage:"S3 secret key" secret:"true"`
+	S3UseSSL    bool   `yaml:"s3_use_ssl" toml:"s3_use_ssl" env:"S3_USE_SSL" flag:"s3-use-ssl" usage:"connect to S3 over TLS"`
+}
+
+// Attachments holds the key signing download links, shared by every server
+type Attachments struct {
+	Secret string `yaml:"secret" toml:"secret" env:"ATTACHMENT_SECRET" flag:"attachment-secret" usage:"key signing download links" secret:"true"`
+}
+
+// WebSocket configures the connection upgrader
+type WebSocket struct {
+	ReadBufferSize  int `yaml:"read_buffer_size" toml:"read_buffer_size" env:"WS_READ_BUFFER_SIZE" flag:"ws-read-buffer-size" usage:"WebSocket read buffer in bytes"`
+	WriteBufferSize int `yaml:"write_buffer_size" toml:"write_buffer_size" env:"WS_WRITE_BUFFER_SIZE" flag:"ws-write-buffer-size" usage:"WebSocket write buffer in bytes"`
+}
+
+// Cookie configures the session cookie set at login
+type Cookie struct {
+	Domain string `yaml:"domain" toml:"domain" env:"COOKIE_DOMAIN" flag:"cookie-domain" usage:"domain of the uid cookie"`
+	MaxAge int    `yaml:"max_age" toml:"max_age" env:"COOKIE_MAX_AGE" flag:"cookie-max-age" usage:"lifetime of the uid cookie in seconds"`
+	Secure bool   `yaml:"secure" toml:"secure" env:"COOKIE_SECURE" flag:"cookie-secure" usage:"only send the uid cookie over HTTPS"`
+}
+
+// Limits bounds what clients can send
+type Limits struct {
+	MaxMessageLength   int `yaml:"max_message_length" toml:"max_message_length" env:"MAX_MESSAGE_LENGTH" flag:"max-message-length" usage:"characters per message"`
+	MaxGroupNameLength int `yaml:"max_group_name_length" toml:"max_group_name_length" env:"MAX_GROUP_NAME_LENGTH" flag:"max-group-name-length" usage:"characters per room name"`
+	MaxAttachments     int `yaml:"max_attachments" toml:"max_attachments" env:"MAX_ATTACHMENTS" flag:"max-attachments" usage:"attachments per message"`
+}
+
+// Default returns the settings used when nothing overrides them
+// they match the values the server used before it was configurable
+func Default() Config {
+	return Config{
+		Server:  Server{ShutdownTimeout: Duration{30 * time.Second}, ShutdownJitter: Duration{5 * time.Second}},
+		Storage: Storage{Backend: "cassandra"},
+		Cassandra: Cassandra{
+			Hosts:            []string{"cassandra:9042"},
+			Keyspace:         "chat",
+			Consistency:      "quorum",
+			MaxPreparedStmts: 1000,
+			Retries:          3,
+			RetryMinBackoff:  Duration{100 * time.Millisecond},
+			RetryMaxBackoff:  Duration{2 * time.Second},
+			SpeculativeDelay: Duration{100 * time.Millisecond},
+			Concurrency:      16,
+		},
+		Redis:  Redis{Mode: "single", Addrs: []string{"redis:6379"}, MasterName: "mymaster"},
+		Broker: Broker{Kind: "redis", StreamMaxLen: 10000, NatsURL: "nats://nats:4222"},
+		Routing: Routing{
+			TTL:       Duration{90 * time.Second},
+			Heartbeat: Duration{30 * time.Second},
+			CacheSize: 10000,
+			CacheTTL:  Duration{30 * time.Second},
+		},
+		Registry: Registry{
+			Heartbeat:    Duration{10 * time.Second},
+			Lease:        Duration{30 * time.Second},
+			ReapInterval: Duration{15 * time.Second},
+		},
+		Blob:      Blob{Store: "local", Dir: "./data/blobs"},
+		WebSocket: WebSocket{ReadBufferSize: 1024, WriteBufferSize: 1024},
+		Cookie:    Cookie{Domain: "localhost", MaxAge: 36000},
+		Limits:    Limits{MaxMessageLength: 1000, MaxGroupNameLength: 25, MaxAttachments: 10},
+	}
+}
+
+// Validate checks every section
+func (c Config) Validate() error {
+	return validation.ValidateStruct(&c,
+		validation.Field(&c.Server),
+		validation.Field(&c.Storage),
+		validation.Field(&c.Cassandra),
+		validation.Field(&c.Redis),
+		validation.Field(&c.Broker),
+		validation.Field(&c.Routing),
+		validation.Field(&c.Registry),
+		validation.Field(&c.Blob),
+		validation.Field(&c.WebSocket),
+		validation.Field(&c.Cookie),
+		validation.Field(&c.Limits),
+	)
+}
+
+func (s Server) Validate() error {
+	return validation.ValidateStruct(&s,
+		validation.Field(&s.ServerId, validation.Required),
+		validation.Field(&s.Port, validation.Required, validation.Min(1), validation.Max(65535)),
+		validation.Field(&s.ShutdownTimeout, validation.By(positive)),
+		validation.Field(&s.ShutdownJitter, validation.By(func(interface{}) error {
+			if s.ShutdownJitter.Duration < 0 || s.ShutdownJitter.Duration >= s.ShutdownTimeout.Duration {
+				return errors.New("must be between 0 and the shutdown timeout")
+			}
+			return nil
+		})),
+	)
+}
+
+func (s Storage) Validate() error {
+	dsnRules := []validation.Rule{}
+	if s.Backend == "postgres" {
+		dsnRules = append(dsnRules, validation.Required)
+	}
+	return validation.ValidateStruct(&s,
+		validation.Field(&s.Backend, validation.Required, validation.In("cassandra", "sqlite", "postgres", "memory")),
+		validation.Field(&s.DSN, dsnRules...),
+		validation.Field(&s.MaxOpenConns, validation.Min(0)),
+		validation.Field(&s.MaxIdleConns, validation.Min(0)),
+	)
+}
+
+func (c Cassandra) Validate() error {
+	return validation.ValidateStruct(&c,
+		validation.Field(&c.Hosts, validation.Required),
+		validation.Field(&c.Keyspace, validation.Required, validation.Match(regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,47}$`))),
+		validation.Field(&c.Consistency, validation.Required,
+			validation.In("any", "one", "two", "three", "quorum", "all", "local_quorum", "each_quorum", "local_one")),
+		validation.Field(&c.NumConns, validation.Min(0)),
+		validation.Field(&c.MaxPreparedStmts, validation.Min(0)),
+		validation.Field(&c.Retries, validation.Min(0)),
+		validation.Field(&c.SpeculativeAttempts, validation.Min(0)),
+		validation.Field(&c.Concurrency, validation.Required, validation.Min(1)),
+	)
+}
+
+func (r Redis) Validate() error {
+	addrRules := []validation.Rule{validation.Required}
+	dbRules := []validation.Rule{validation.Min(0)}
+	switch r.Mode {
+	case "single":
+		addrRules = append(addrRules, validation.Length(1, 1).Error("single mode takes one address"))
+	case "cluster":
+		dbRules = append(dbRules, validation.In(0).Error("cluster mode only supports database 0"))
+	}
+	masterRules := []validation.Rule{}
+	if r.Mode == "sentinel" {
+		masterRules = append(masterRules, validation.Required)
+	}
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Mode, validation.Required, validation.In("single", "sentinel", "cluster")),
+		validation.Field(&r.Addrs, addrRules...),
+		validation.Field(&r.MasterName, masterRules...),
+		validation.Field(&r.DB, dbRules...),
+		validation.Field(&r.PoolSize, validation.Min(0)),
+		validation.Field(&r.MinIdleConns, validation.Min(0)),
+	)
+}
+
+func (b Broker) Validate() error {
+	natsRules := []validation.Rule{}
+	if b.Kind == "nats" {
+		natsRules = append(natsRules, validation.Required)
+	}
+	return validation.ValidateStruct(&b,
+		validation.Field(&b.Kind, validation.Required, validation.In("redis", "streams", "nats", "memory")),
+		validation.Field(&b.StreamMaxLen, validation.Required, validation.Min(int64(1))),
+		validation.Field(&b.NatsURL, natsRules...),
+	)
+}
+
+func (b Blob) Validate() error {
+	dirRules, s3Rules := []validation.Rule{}, []validation.Rule{}
+	if b.Store == "s3" {
+		s3Rules = append(s3Rules, validation.Required)
+	} else {
+		dirRules = append(dirRules, validation.Required)
+	}
+	return validation.ValidateStruct(&b,
+		validation.Field(&b.Store, validation.Required, validation.In("local", "s3")),
+		validation.Field(&b.Dir, dirRules...),
+		validation.Field(&b.S3Endpoint, s3Rules...),
+		validation.Field(&b.S3Bucket, s3Rules...),
+	)
+}
+
+func (w WebSocket) Validate() error {
+	return validation.ValidateStruct(&w,
+		validation.Field(&w.ReadBufferSize, validation.Required, validation.Min(1)),
+		validation.Field(&w.WriteBufferSize, validation.Required, validation.Min(1)),
+	)
+}
+
+func (c Cookie) Validate() error {
+	return validation.ValidateStruct(&c,
+		validation.Field(&c.MaxAge, validation.Min(0)),
+	)
+}
+
+// Validate requires a route to survive a missed heartbeat
+func (r Routing) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.TTL, validation.By(func(interface{}) error {
+			if r.TTL.Duration < 2*r.Heartbeat.Duration {
+				return errors.New("must be at least twice the heartbeat")
+			}
+			return nil
+		})),
+		validation.Field(&r.Heartbeat, validation.By(positive)),
+		validation.Field(&r.CacheSize, validation.Required, validation.Min(1)),
+		validation.Field(&r.CacheTTL, validation.By(positive)),
+	)
+}
+
+// Validate requires a lease to survive a missed heartbeat
+func (r Registry) Validate() error {
+	return validation.ValidateStruct(&r,
+		validation.Field(&r.Heartbeat, validation.By(positive)),
+		validation.Field(&r.Lease, validation.By(func(interface{}) error {
+			if r.Lease.Duration < 2*r.Heartbeat.Duration {
+				return errors.New("must be at least twice the heartbeat")
+			}
+			return nil
+		})),
+		validation.Field(&r.ReapInterval, validation.By(positive)),
+	)
+}
+
+// positive rejects zero and negative durations
+func positive(value interface{}) error {
+	if d, _ := value.(Duration); d.Duration <= 0 {
+		return errors.New("must be positive")
+	}
+	return nil
+}
+
+func (l Limits) Validate() error {
+	return validation.ValidateStruct(&l,
+		validation.Field(&l.MaxMessageLength, validation.Required, validation.Min(1)),
+		validation.Field(&l.MaxGroupNameLength, validation.Required, validation.Min(1)),
+		validation.Field(&l.MaxAttachments, validation.Min(0)),
+	)
+}
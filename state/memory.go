@@ -0,0 +1,353 @@
+package state
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryInvalidationBuffer is the number of route invalidations queued per subscriber,
+// a subscriber falling further behind misses them and relies on the cache TTL
+const memoryInvalidationBuffer = 1024
+
+// expiring is a value that disappears at expires (never if zero)
+type expiring[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// Memory keeps the state in the process, for a single server and tests
+// entries with a TTL expire according to Now, which tests may replace with a fake clock
+type Memory struct {
+	// Now is the clock used for expiry, time.Now by default
+	Now func() time.Time
+
+	mu            sync.Mutex
+	seqs          map[string]int64
+	clientIds     map[string]expiring[clientMsg]
+	unread        map[string]map[string]bool
+	mentions      map[string]map[string]bool
+	conversations map[string]map[string]bool
+	routes        map[string]expiring[string]
+	serverUsers   map[string]map[string]bool
+	servers       map[string]bool
+	leases        map[string]expiring[ServerInfo]
+	reapLocks     map[string]expiring[string]
+	invalidations []chan string
+}
+
+// clientMsg is what a claimed client id records
+type clientMsg struct {
+	messageId string
+	seq       int64
+}
+
+// NewMemory returns an empty store
+func NewMemory() *Memory {
+	return &Memory{
+		Now:           time.Now,
+		seqs:          make(map[string]int64),
+		clientIds:     make(map[string]expiring[clientMsg]),
+		unread:        make(map[string]map[string]bool),
+		mentions:      make(map[string]map[string]bool),
+		conversations: make(map[string]map[string]bool),
+		routes:        make(map[string]expiring[string]),
+		serverUsers:   make(map[string]map[string]bool),
+		servers:       make(map[string]bool),
+		leases:        make(map[string]expiring[ServerInfo]),
+		reapLocks:     make(map[string]expiring[string]),
+	}
+}
+
+// expiry returns when an entry set now with ttl expires, zero for no ttl
+func (m *Memory) expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return m.Now().Add(ttl)
+}
+
+// lookup returns the entry of key unless it expired, expired entries are removed
+func lookup[V any](m *Memory, entries map[string]expiring[V], key string) (V, bool) {
+	e, ok := entries[key]
+	if ok && !e.expires.IsZero() && !m.Now().Before(e.expires) {
+		delete(entries, key)
+		ok = false
+	}
+	return e.value, ok
+}
+
+// set returns the set stored under key, created if missing
+func set(sets map[string]map[string]bool, key string) map[string]bool {
+	if sets[key] == nil {
+		sets[key] = make(map[string]bool)
+	}
+	return sets[key]
+}
+
+// members returns the members of the set, sorted
+func members(s map[string]bool) []string {
+	list := make([]string, 0, len(s))
+	for member := range s {
+		list = append(list, member)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (m *Memory) NextSeq(ctx context.Context, conversation string, seed func() (int64, error)) (int64, error) {
+	m.mu.Lock()
+	_, ok := m.seqs[conversation]
+	m.mu.Unlock()
+	// the seed is read without the lock, as with Redis the first counter stored wins
+	if !ok {
+		last, err := seed()
+		if err != nil {
+			return 0, err
+		}
+		m.mu.Lock()
+		if _, ok := m.seqs[conversation]; !ok {
+			m.seqs[conversation] = last
+		}
+		m.mu.Unlock()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seqs[conversation]++
+	return m.seqs[conversation], nil
+}
+
+func (m *Memory) ClaimClientId(ctx context.Context, sender, clientId, messageId string, ttl time.Duration) (string, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := clientMsgKey(sender, clientId)
+	if claimed, ok := lookup(m, m.clientIds, key); ok {
+		return claimed.messageId, claimed.seq, nil
+	}
+	m.clientIds[key] = expiring[clientMsg]{value: clientMsg{messageId: messageId}, expires: m.expiry(ttl)}
+	return "", 0, nil
+}
+
+func (m *Memory) RecordClientSeq(ctx context.Context, sender, clientId, messageId string, seq int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := clientMsgKey(sender, clientId)
+	if _, ok := lookup(m, m.clientIds, key); ok {
+		e := m.clientIds[key]
+		e.value = clientMsg{messageId: messageId, seq: seq}
+		m.clientIds[key] = e
+	}
+	return nil
+}
+
+func (m *Memory) ReleaseClientId(ctx context.Context, sender, clientId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.clientIds, clientMsgKey(sender, clientId))
+	return nil
+}
+
+func (m *Memory) TrackUnread(ctx context.Context, user, conversation, messageId string, mentioned bool, max int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := unreadKey(user, conversation)
+	sets := []map[string]bool{set(m.unread, key)}
+	if mentioned {
+		sets = append(sets, set(m.mentions, key))
+	}
+	for _, ids := range sets {
+		ids[messageId] = true
+		if len(ids) > max {
+			for _, id := range members(ids)[:len(ids)-max] {
+				delete(ids, id)
+			}
+		}
+	}
+	set(m.conversations, user)[conversation] = true
+	return nil
+}
+
+func (m *Memory) UnreadCounts(ctx context.Context, user, conversation string) (int64, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := unreadKey(user, conversation)
+	return int64(len(m.unread[key])), int64(len(m.mentions[key])), nil
+}
+
+func (m *Memory) MarkRead(ctx context.Context, user, conversation, messageId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := unreadKey(user, conversation)
+	for _, ids := range []map[string]bool{m.unread[key], m.mentions[key]} {
+		for id := range ids {
+			if id <= messageId {
+				delete(ids, id)
+			}
+		}
+	}
+	set(m.conversations, user)[conversation] = true
+	return nil
+}
+
+func (m *Memory) Conversations(ctx context.Context, user string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return members(m.conversations[user]), nil
+}
+
+func (m *Memory) ClaimRoute(ctx context.Context, user, serverId string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.routes[user] = expiring[string]{value: serverId, expires: m.expiry(ttl)}
+	set(m.serverUsers, serverId)[user] = true
+	return nil
+}
+
+func (m *Memory) ReleaseRoute(ctx context.Context, user, serverId string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.serverUsers[serverId], user)
+	if current, ok := lookup(m, m.routes, user); ok && current == serverId {
+		delete(m.routes, user)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (m *Memory) GetRoutes(ctx context.Context, users []string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	routes := make(map[string]string, len(users))
+	for _, user := range users {
+		if serverId, ok := lookup(m, m.routes, user); ok {
+			routes[user] = serverId
+		}
+	}
+	return routes, nil
+}
+
+func (m *Memory) RenewRoutes(ctx context.Context, serverId string, users []string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, user := range users {
+		if current, ok := lookup(m, m.routes, user); ok && current != serverId {
+			continue
+		}
+		m.routes[user] = expiring[string]{value: serverId, expires: m.expiry(ttl)}
+		set(m.serverUsers, serverId)[user] = true
+	}
+	return nil
+}
+
+// InvalidateRoute hands the user to every subscriber that has room for it
+func (m *Memory) InvalidateRoute(ctx context.Context, user string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, ch := range m.invalidations {
+		select {
+		case ch <- user:
+		default:
+		}
+	}
+	return nil
+}
+
+// RouteInvalidations subscribes until ctx ends, the channel is closed then
+func (m *Memory) RouteInvalidations(ctx context.Context) (<-chan string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch := make(chan string, memoryInvalidationBuffer)
+	m.invalidations = append(m.invalidations, ch)
+	go func() {
+		<-ctx.Done()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for i, sub := range m.invalidations {
+			if sub == ch {
+				m.invalidations = append(m.invalidations[:i], m.invalidations[i+1:]...)
+				close(ch)
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (m *Memory) Register(ctx context.Context, info ServerInfo, lease time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.leases[info.Id] = expiring[ServerInfo]{value: info, expires: m.expiry(lease)}
+	m.servers[info.Id] = true
+	return nil
+}
+
+func (m *Memory) Listed(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return members(m.servers), nil
+}
+
+func (m *Memory) Servers(ctx context.Context) ([]ServerInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	servers := []ServerInfo{}
+	for _, serverId := range members(m.servers) {
+		if info, ok := lookup(m, m.leases, serverId); ok {
+			servers = append(servers, info)
+		}
+	}
+	return servers, nil
+}
+
+func (m *Memory) Alive(ctx context.Context, serverId string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := lookup(m, m.leases, serverId)
+	return ok, nil
+}
+
+func (m *Memory) LockReap(ctx context.Context, serverId, owner string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := lookup(m, m.reapLocks, serverId); ok {
+		return false, nil
+	}
+	m.reapLocks[serverId] = expiring[string]{value: owner, expires: m.expiry(ttl)}
+	return true, nil
+}
+
+func (m *Memory) UnlockReap(ctx context.Context, serverId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.reapLocks, serverId)
+	return nil
+}
+
+func (m *Memory) ServerUsers(ctx context.Context, serverId string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return members(m.serverUsers[serverId]), nil
+}
+
+func (m *Memory) Unlist(ctx context.Context, serverId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.serverUsers, serverId)
+	delete(m.servers, serverId)
+	return nil
+}
+
+func (m *Memory) Deregister(ctx context.Context, serverId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.leases, serverId)
+	delete(m.serverUsers, serverId)
+	delete(m.servers, serverId)
+	return nil
+}
+
+// Ping always succeeds, there is no connection to lose
+func (m *Memory) Ping(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,362 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis keys
+// seq:{conversation}                    last assigned sequence number
+// client_msg:{sender}:{client_id}       "{message id}" once claimed, "{message id}:{seq}" once sequenced
+// unread:{user}:{conversation}          sorted set of unread message ids (lexicographic = ksuid order)
+// unread_mentions:{user}:{conversation} sorted set of unread message ids mentioning the user
+// conversations:{user}                  set of conversation keys of the user
+// route:{user}                          server id, expiring without heartbeat
+// server_users:{id}                     set of the users routed to the server
+// servers                               set of the registered servers
+// server:{id}                           lease, the ServerInfo as JSON
+// reaping:{id}                          reaper lock of an expired server
+// routes:invalidate                     channel carrying the users whose route changed
+
+// routeInvalidations is the channel carrying the users whose route changed
+const routeInvalidations = "routes:invalidate"
+
+// serversKey is the set listing every registered server
+const serversKey = "servers"
+
+// renewRouteScript extends the route, or sets it if it expired, unless another server took it over
+var renewRouteScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current == false or current == ARGV[1] then
+	return redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+end
+return false`)
+
+// releaseRouteScript deletes the route if it still points at the server
+var releaseRouteScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`)
+
+func seqKey(conversation string) string {
+	return "seq:" + conversation
+}
+
+func clientMsgKey(sender, clientId string) string {
+	return "client_msg:" + sender + ":" + clientId
+}
+
+func unreadKey(user, conversation string) string {
+	return "unread:" + user + ":" + conversation
+}
+
+func unreadMentionsKey(user, conversation string) string {
+	return "unread_mentions:" + user + ":" + conversation
+}
+
+func conversationsKey(user string) string {
+	return "conversations:" + user
+}
+
+func routeKey(user string) string {
+	return "route:" + user
+}
+
+func serverKey(serverId string) string {
+	return "server:" + serverId
+}
+
+func serverUsersKey(serverId string) string {
+	return "server_users:" + serverId
+}
+
+func reapLockKey(serverId string) string {
+	return "reaping:" + serverId
+}
+
+// Redis keeps the state in Redis, shared by every server using the same Redis
+type Redis struct {
+	Client redis.UniversalClient
+}
+
+// NextSeq uses INCR, atomic across servers; a missing key is seeded with SETNX
+func (r Redis) NextSeq(ctx context.Context, conversation string, seed func() (int64, error)) (int64, error) {
+	key := seqKey(conversation)
+	exists, err := r.Client.Exists(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if exists == 0 {
+		last, err := seed()
+		if err != nil {
+			return 0, err
+		}
+		if err := r.Client.SetNX(ctx, key, last, 0).Err(); err != nil {
+			return 0, err
+		}
+	}
+	return r.Client.Incr(ctx, key).Result()
+}
+
+// ClaimClientId uses SETNX with the ttl, the value of a taken id is read back
+func (r Redis) ClaimClientId(ctx context.Context, sender, clientId, messageId string, ttl time.Duration) (string, int64, error) {
+	key := clientMsgKey(sender, clientId)
+	claimed, err := r.Client.SetNX(ctx, key, messageId, ttl).Result()
+	if err != nil || claimed {
+		return "", 0, err
+	}
+	value, err := r.Client.Get(ctx, key).Result()
+	if err != nil {
+		return "", 0, err
+	}
+	id, seq, _ := strings.Cut(value, ":")
+	n, _ := strconv.ParseInt(seq, 10, 64)
+	return id, n, nil
+}
+
+// RecordClientSeq only updates an existing key (XX) and keeps its TTL
+func (r Redis) RecordClientSeq(ctx context.Context, sender, clientId, messageId string, seq int64) error {
+	value := messageId + ":" + strconv.FormatInt(seq, 10)
+	err := r.Client.SetArgs(ctx, clientMsgKey(sender, clientId), value, redis.SetArgs{Mode: "XX", KeepTTL: true}).Err()
+	if err == redis.Nil {
+		return nil
+	}
+	return err
+}
+
+func (r Redis) ReleaseClientId(ctx context.Context, sender, clientId string) error {
+	return r.Client.Del(ctx, clientMsgKey(sender, clientId)).Err()
+}
+
+// TrackUnread adds the id with score 0, trims the sets and registers the conversation in one pipeline
+func (r Redis) TrackUnread(ctx context.Context, user, conversation, messageId string, mentioned bool, max int) error {
+	keys := []string{unreadKey(user, conversation)}
+	if mentioned {
+		keys = append(keys, unreadMentionsKey(user, conversation))
+	}
+	pipe := r.Client.Pipeline()
+	for _, key := range keys {
+		pipe.ZAdd(ctx, key, redis.Z{Score: 0, Member: messageId})
+		pipe.ZRemRangeByRank(ctx, key, 0, int64(-(max + 1)))
+	}
+	pipe.SAdd(ctx, conversationsKey(user), conversation)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r Redis) UnreadCounts(ctx context.Context, user, conversation string) (int64, int64, error) {
+	pipe := r.Client.Pipeline()
+	unread := pipe.ZCard(ctx, unreadKey(user, conversation))
+	mentions := pipe.ZCard(ctx, unreadMentionsKey(user, conversation))
+	_, err := pipe.Exec(ctx)
+	return unread.Val(), mentions.Val(), err
+}
+
+// MarkRead removes the ids lexicographically up to messageId
+func (r Redis) MarkRead(ctx context.Context, user, conversation, messageId string) error {
+	pipe := r.Client.Pipeline()
+	pipe.ZRemRangeByLex(ctx, unreadKey(user, conversation), "-", "["+messageId)
+	pipe.ZRemRangeByLex(ctx, unreadMentionsKey(user, conversation), "-", "["+messageId)
+	pipe.SAdd(ctx, conversationsKey(user), conversation)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r Redis) Conversations(ctx context.Context, user string) ([]string, error) {
+	return r.Client.SMembers(ctx, conversationsKey(user)).Result()
+}
+
+func (r Redis) ClaimRoute(ctx context.Context, user, serverId string, ttl time.Duration) error {
+	pipe := r.Client.Pipeline()
+	pipe.Set(ctx, routeKey(user), serverId, ttl)
+	pipe.SAdd(ctx, serverUsersKey(serverId), user)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r Redis) ReleaseRoute(ctx context.Context, user, serverId string) (bool, error) {
+	deleted, err := releaseRouteScript.Run(ctx, r.Client, []string{routeKey(user)}, serverId).Int()
+	if err != nil {
+		return false, err
+	}
+	return deleted > 0, r.Client.SRem(ctx, serverUsersKey(serverId), user).Err()
+}
+
+// GetRoutes reads the routes in one pipeline
+// a failed connection fails the pipeline without setting the error of each command
+func (r Redis) GetRoutes(ctx context.Context, users []string) (map[string]string, error) {
+	routes := make(map[string]string, len(users))
+	pipe := r.Client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(users))
+	for i, user := range users {
+		cmds[i] = pipe.Get(ctx, routeKey(user))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		serverId, err := cmd.Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		routes[users[i]] = serverId
+	}
+	return routes, nil
+}
+
+// RenewRoutes runs renewRouteScript for every user in one pipeline, a route held by
+// another server replies nil, that is not a failure; the renewed users are listed again
+func (r Redis) RenewRoutes(ctx context.Context, serverId string, users []string, ttl time.Duration) error {
+	if len(users) == 0 {
+		return nil
+	}
+	pipe := r.Client.Pipeline()
+	cmds := make([]*redis.Cmd, len(users))
+	for i, user := range users {
+		cmds[i] = renewRouteScript.Eval(ctx, pipe, []string{routeKey(user)}, serverId, ttl.Milliseconds())
+	}
+	pipe.Exec(ctx)
+	renewed := []interface{}{}
+	for i, cmd := range cmds {
+		err := cmd.Err()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		renewed = append(renewed, users[i])
+	}
+	if len(renewed) == 0 {
+		return nil
+	}
+	return r.Client.SAdd(ctx, serverUsersKey(serverId), renewed...).Err()
+}
+
+// InvalidateRoute publishes the user on routes:invalidate
+func (r Redis) InvalidateRoute(ctx context.Context, user string) error {
+	return r.Client.Publish(ctx, routeInvalidations, user).Err()
+}
+
+// RouteInvalidations subscribes to routes:invalidate, the channel is closed when the
+// connection breaks or ctx ends
+func (r Redis) RouteInvalidations(ctx context.Context) (<-chan string, error) {
+	pubsub := r.Client.Subscribe(ctx, routeInvalidations)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	users := make(chan string)
+	// a blocked read does not watch ctx, closing the subscription ends it
+	go func() {
+		<-ctx.Done()
+		pubsub.Close()
+	}()
+	go func() {
+		defer close(users)
+		defer pubsub.Close()
+		for {
+			msg, err := pubsub.ReceiveMessage(ctx)
+			if err != nil {
+				return
+			}
+			select {
+			case users <- msg.Payload:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return users, nil
+}
+
+func (r Redis) Register(ctx context.Context, info ServerInfo, lease time.Duration) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	pipe := r.Client.Pipeline()
+	pipe.Set(ctx, serverKey(info.Id), data, lease)
+	pipe.SAdd(ctx, serversKey, info.Id)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (r Redis) Listed(ctx context.Context) ([]string, error) {
+	return r.Client.SMembers(ctx, serversKey).Result()
+}
+
+// Servers reads the leases of the listed servers in one pipeline, expired ones are left out
+func (r Redis) Servers(ctx context.Context) ([]ServerInfo, error) {
+	serverIds, err := r.Listed(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pipe := r.Client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(serverIds))
+	for i, serverId := range serverIds {
+		cmds[i] = pipe.Get(ctx, serverKey(serverId))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	servers := []ServerInfo{}
+	for _, cmd := range cmds {
+		data, err := cmd.Bytes()
+		if err != nil {
+			continue
+		}
+		info := ServerInfo{}
+		if err := json.Unmarshal(data, &info); err != nil {
+			continue
+		}
+		servers = append(servers, info)
+	}
+	return servers, nil
+}
+
+func (r Redis) Alive(ctx context.Context, serverId string) (bool, error) {
+	n, err := r.Client.Exists(ctx, serverKey(serverId)).Result()
+	return n > 0, err
+}
+
+func (r Redis) LockReap(ctx context.Context, serverId, owner string, ttl time.Duration) (bool, error) {
+	return r.Client.SetNX(ctx, reapLockKey(serverId), owner, ttl).Result()
+}
+
+func (r Redis) UnlockReap(ctx context.Context, serverId string) error {
+	return r.Client.Del(ctx, reapLockKey(serverId)).Err()
+}
+
+func (r Redis) ServerUsers(ctx context.Context, serverId string) ([]string, error) {
+	return r.Client.SMembers(ctx, serverUsersKey(serverId)).Result()
+}
+
+func (r Redis) Unlist(ctx context.Context, serverId string) error {
+	pipe := r.Client.Pipeline()
+	pipe.Del(ctx, serverUsersKey(serverId))
+	pipe.SRem(ctx, serversKey, serverId)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r Redis) Deregister(ctx context.Context, serverId string) error {
+	pipe := r.Client.Pipeline()
+	pipe.Del(ctx, serverKey(serverId), serverUsersKey(serverId))
+	pipe.SRem(ctx, serversKey, serverId)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r Redis) Ping(ctx context.Context) error {
+	return r.Client.Ping(ctx).Err()
+}
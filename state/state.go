@@ -0,0 +1,96 @@
+// Package state holds the short-lived state the servers share: sequence counters, client
+// message ids, unread ids, user routes and the server registry
+// Every server must use the same store: Redis is shared between servers, Memory lives in
+// the process and serves a single server (and tests)
+package state
+
+import (
+	"context"
+	"time"
+)
+
+// Sequences assigns the sequence numbers of the conversations
+// NextSeq returns the next number of the conversation; a conversation without counter (new,
+// or the store lost it) is first seeded with the number returned by seed, so numbers never go back
+type Sequences interface {
+	NextSeq(ctx context.Context, conversation string, seed func() (int64, error)) (int64, error)
+}
+
+// ClientIds remembers the client message ids of the recent messages, so retries are not sent twice
+// ClaimClientId registers the id of a new message for ttl; if the id was already claimed it
+// returns the message id and seq recorded by the first claim (seq is 0 until RecordClientSeq)
+// RecordClientSeq adds the seq to a claimed id, without extending it
+// ReleaseClientId forgets the id, so a retry goes through
+type ClientIds interface {
+	ClaimClientId(ctx context.Context, sender, clientId, messageId string, ttl time.Duration) (string, int64, error)
+	RecordClientSeq(ctx context.Context, sender, clientId, messageId string, seq int64) error
+	ReleaseClientId(ctx context.Context, sender, clientId string) error
+}
+
+// Unread keeps the ids of the messages each user has not read, per conversation
+// (ids are ksuids, their order is the send order)
+// TrackUnread adds the id (and to the mentions when mentioned), keeping the newest max ids
+// MarkRead removes every id up to and including messageId
+// Conversations lists the conversations the user received messages in or read
+type Unread interface {
+	TrackUnread(ctx context.Context, user, conversation, messageId string, mentioned bool, max int) error
+	UnreadCounts(ctx context.Context, user, conversation string) (int64, int64, error)
+	MarkRead(ctx context.Context, user, conversation, messageId string) error
+	Conversations(ctx context.Context, user string) ([]string, error)
+}
+
+// Routes maps each connected user to the server holding its connection
+// ClaimRoute points the route at serverId for ttl (a new connection always wins) and lists
+// the user among the users of serverId
+// ReleaseRoute removes the route if it still points at serverId and unlists the user,
+// it reports whether the route was removed
+// GetRoutes returns the routes of the users, users without a route (offline) are left out
+// RenewRoutes extends the routes of serverId's users, or sets them if they expired, unless
+// another server took them over, and lists them again
+// InvalidateRoute announces that the user's route changed, RouteInvalidations receives
+// the announced users until ctx ends or the subscription breaks (the channel is closed then)
+type Routes interface {
+	ClaimRoute(ctx context.Context, user, serverId string, ttl time.Duration) error
+	ReleaseRoute(ctx context.Context, user, serverId string) (bool, error)
+	GetRoutes(ctx context.Context, users []string) (map[string]string, error)
+	RenewRoutes(ctx context.Context, serverId string, users []string, ttl time.Duration) error
+	InvalidateRoute(ctx context.Context, user string) error
+	RouteInvalidations(ctx context.Context) (<-chan string, error)
+}
+
+// ServerInfo is the lease of a server, as listed by the registry
+type ServerInfo struct {
+	Id          string    `json:"id"`
+	Connections int       `json:"connections"`
+	StartedAt   time.Time `json:"started_at"`
+	Heartbeat   time.Time `json:"heartbeat"`
+}
+
+// Registry keeps track of the live servers
+// Register writes the lease of the server, valid for lease, and lists it
+// Listed returns every listed server, also those whose lease expired; Servers returns the leases
+// LockReap takes the lock of the expired server for ttl, a single reaper cleans up after it
+// ServerUsers lists the users routed to the server, see Routes
+// Unlist removes the server and its user list, Deregister also removes its lease
+type Registry interface {
+	Register(ctx context.Context, info ServerInfo, lease time.Duration) error
+	Listed(ctx context.Context) ([]string, error)
+	Servers(ctx context.Context) ([]ServerInfo, error)
+	Alive(ctx context.Context, serverId string) (bool, error)
+	LockReap(ctx context.Context, serverId, owner string, ttl time.Duration) (bool, error)
+	UnlockReap(ctx context.Context, serverId string) error
+	ServerUsers(ctx context.Context, serverId string) ([]string, error)
+	Unlist(ctx context.Context, serverId string) error
+	Deregister(ctx context.Context, serverId string) error
+}
+
+// Store implements every part of the shared state
+type Store interface {
+	Sequences
+	ClientIds
+	Unread
+	Routes
+	Registry
+	// Ping checks that the store answers, for the readiness check
+	Ping(ctx context.Context) error
+}
@@ -0,0 +1,328 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+var ctx = context.Background()
+
+// stores open an empty store of every kind, advance moves its clock forward
+var stores = []struct {
+	name string
+	open func(t *testing.T) (s Store, advance func(time.Duration))
+}{
+	{"memory", func(t *testing.T) (Store, func(time.Duration)) {
+		m := NewMemory()
+		now := time.Now()
+		m.Now = func() time.Time { return now }
+		return m, func(d time.Duration) { now = now.Add(d) }
+	}},
+	{"redis", func(t *testing.T) (Store, func(time.Duration)) {
+		mr := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { client.Close() })
+		return Redis{Client: client}, mr.FastForward
+	}},
+}
+
+// TestStore runs the same checks against every store, each check on an empty store
+func TestStore(t *testing.T) {
+	checks := []struct {
+		name string
+		run  func(t *testing.T, s Store, advance func(time.Duration))
+	}{
+		{"sequences", testSequences},
+		{"client ids", testClientIds},
+		{"unread", testUnread},
+		{"routes", testRoutes},
+		{"route invalidations", testRouteInvalidations},
+		{"registry", testRegistry},
+	}
+	for _, store := range stores {
+		t.Run(store.name, func(t *testing.T) {
+			for _, check := range checks {
+				t.Run(check.name, func(t *testing.T) {
+					s, advance := store.open(t)
+					check.run(t, s, advance)
+				})
+			}
+		})
+	}
+}
+
+func testSequences(t *testing.T, s Store, _ func(time.Duration)) {
+	seeds := 0
+	seed := func(last int64) func() (int64, error) {
+		return func() (int64, error) {
+			seeds++
+			return last, nil
+		}
+	}
+	// a conversation without counter starts after the highest logged number, once
+	for want := int64(42); want <= 44; want++ {
+		got, err := s.NextSeq(ctx, "group:room1", seed(41))
+		if err != nil || got != want {
+			t.Fatalf("NextSeq = %d, %v, want %d", got, err, want)
+		}
+	}
+	if seeds != 1 {
+		t.Fatalf("seeded %d times, want once", seeds)
+	}
+	if got, _ := s.NextSeq(ctx, "dm:alice:bob", seed(0)); got != 1 {
+		t.Fatalf("new conversation: got %d, want 1", got)
+	}
+	failing := func() (int64, error) { return 0, errors.New("log unavailable") }
+	if _, err := s.NextSeq(ctx, "group:room2", failing); err == nil {
+		t.Fatal("seed error not returned")
+	}
+	if got, _ := s.NextSeq(ctx, "group:room2", seed(7)); got != 8 {
+		t.Fatalf("after a failed seed: got %d, want 8", got)
+	}
+}
+
+func testClientIds(t *testing.T, s Store, advance func(time.Duration)) {
+	id, seq, err := s.ClaimClientId(ctx, "alice", "c1", "m1", time.Hour)
+	if err != nil || id != "" || seq != 0 {
+		t.Fatalf("first claim: %q %d %v", id, seq, err)
+	}
+	// a duplicate gets the original id, and its seq once recorded
+	if id, seq, _ := s.ClaimClientId(ctx, "alice", "c1", "m2", time.Hour); id != "m1" || seq != 0 {
+		t.Fatalf("duplicate before the seq: %q %d", id, seq)
+	}
+	if err := s.RecordClientSeq(ctx, "alice", "c1", "m1", 7); err != nil {
+		t.Fatal(err)
+	}
+	if id, seq, _ := s.ClaimClientId(ctx, "alice", "c1", "m2", time.Hour); id != "m1" || seq != 7 {
+		t.Fatalf("duplicate: %q %d, want m1 7", id, seq)
+	}
+	// ids are per sender
+	if id, _, _ := s.ClaimClientId(ctx, "bob", "c1", "m3", time.Hour); id != "" {
+		t.Fatalf("other sender: got %q", id)
+	}
+	// a released id is claimed again
+	if err := s.ReleaseClientId(ctx, "alice", "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if id, _, _ := s.ClaimClientId(ctx, "alice", "c1", "m4", time.Hour); id != "" {
+		t.Fatalf("after release: got %q", id)
+	}
+	// recording the seq keeps the ttl, the id is forgotten after it
+	advance(30 * time.Minute)
+	s.RecordClientSeq(ctx, "alice", "c1", "m4", 9)
+	advance(31 * time.Minute)
+	if id, _, _ := s.ClaimClientId(ctx, "alice", "c1", "m5", time.Hour); id != "" {
+		t.Fatalf("after the ttl: got %q", id)
+	}
+	// recording the seq of an id that is not claimed does not claim it
+	s.RecordClientSeq(ctx, "alice", "c2", "m6", 1)
+	if id, _, _ := s.ClaimClientId(ctx, "alice", "c2", "m7", time.Hour); id != "" {
+		t.Fatalf("seq recorded without claim: got %q", id)
+	}
+}
+
+func testUnread(t *testing.T, s Store, _ func(time.Duration)) {
+	counts := func(conversation string) [2]int64 {
+		unread, mentions, err := s.UnreadCounts(ctx, "bob", conversation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return [2]int64{unread, mentions}
+	}
+	// ids in send order: m1 < m2 < ...
+	for i, id := range []string{"m3", "m1", "m2", "m4", "m5"} {
+		if err := s.TrackUnread(ctx, "bob", "group:room1", id, i%2 == 0, 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.TrackUnread(ctx, "bob", "dm:alice", "m6", false, 4)
+	// trimmed to the newest 4, m1 dropped; mentions m3 m2 m5
+	if got := counts("group:room1"); got != [2]int64{4, 3} {
+		t.Fatalf("counts %v, want [4 3]", got)
+	}
+	tests := []struct {
+		name   string
+		read   string
+		unread [2]int64
+	}{
+		{"read up to an id", "m3", [2]int64{2, 1}},
+		{"older marker changes nothing", "m2", [2]int64{2, 1}},
+		{"read everything", "m9", [2]int64{0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.MarkRead(ctx, "bob", "group:room1", tt.read); err != nil {
+				t.Fatal(err)
+			}
+			if got := counts("group:room1"); got != tt.unread {
+				t.Fatalf("counts %v, want %v", got, tt.unread)
+			}
+		})
+	}
+	if got := counts("dm:alice"); got != [2]int64{1, 0} {
+		t.Fatalf("other conversation: %v", got)
+	}
+	// reading a conversation without messages lists it too
+	s.MarkRead(ctx, "bob", "group:room2", "m1")
+	conversations, err := s.Conversations(ctx, "bob")
+	sort.Strings(conversations)
+	if err != nil || !reflect.DeepEqual(conversations, []string{"dm:alice", "group:room1", "group:room2"}) {
+		t.Fatalf("Conversations = %v, %v", conversations, err)
+	}
+}
+
+func testRoutes(t *testing.T, s Store, advance func(time.Duration)) {
+	routes := func(users ...string) map[string]string {
+		got, err := s.GetRoutes(ctx, users)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	s.ClaimRoute(ctx, "alice", "S1", time.Minute)
+	s.ClaimRoute(ctx, "bob", "S1", time.Minute)
+	if got := routes("alice", "bob", "carol"); !reflect.DeepEqual(got, map[string]string{"alice": "S1", "bob": "S1"}) {
+		t.Fatalf("routes %v", got)
+	}
+	// a new connection wins, the old server cannot release it
+	s.ClaimRoute(ctx, "alice", "S2", time.Minute)
+	if released, _ := s.ReleaseRoute(ctx, "alice", "S1"); released {
+		t.Fatal("route of S2 released by S1")
+	}
+	if got := routes("alice"); got["alice"] != "S2" {
+		t.Fatalf("alice routed to %q, want S2", got["alice"])
+	}
+	if users, _ := s.ServerUsers(ctx, "S1"); !reflect.DeepEqual(users, []string{"bob"}) {
+		t.Fatalf("users of S1 %v, want [bob]", users)
+	}
+	if released, _ := s.ReleaseRoute(ctx, "alice", "S2"); !released {
+		t.Fatal("route not released by its server")
+	}
+
+	// renewing keeps routes alive, except those another server took over
+	s.ClaimRoute(ctx, "carol", "S2", time.Minute)
+	advance(40 * time.Second)
+	if err := s.RenewRoutes(ctx, "S1", []string{"bob", "carol", "dave"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	advance(40 * time.Second)
+	want := map[string]string{"bob": "S1", "dave": "S1"}
+	if got := routes("alice", "bob", "carol", "dave"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after renewal: %v, want %v", got, want)
+	}
+	users, _ := s.ServerUsers(ctx, "S1")
+	if !reflect.DeepEqual(users, []string{"bob", "dave"}) {
+		t.Fatalf("users of S1 %v", users)
+	}
+	if err := s.RenewRoutes(ctx, "S1", nil, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testRouteInvalidations(t *testing.T, s Store, _ func(time.Duration)) {
+	subCtx, cancel := context.WithCancel(ctx)
+	users, err := s.RouteInvalidations(subCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if err := s.InvalidateRoute(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"alice", "bob"} {
+		select {
+		case got := <-users:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("invalidation of %s not received", want)
+		}
+	}
+	// the channel is closed once ctx ends
+	cancel()
+	select {
+	case _, ok := <-users:
+		for ok {
+			_, ok = <-users
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("invalidations not closed")
+	}
+}
+
+func testRegistry(t *testing.T, s Store, advance func(time.Duration)) {
+	started := time.Now().UTC().Truncate(time.Second)
+	for _, id := range []string{"S2", "S1"} {
+		info := ServerInfo{Id: id, Connections: 3, StartedAt: started, Heartbeat: started}
+		if err := s.Register(ctx, info, 30*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.ClaimRoute(ctx, "alice", "S2", time.Minute)
+	servers, err := s.Servers(ctx)
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Id < servers[j].Id })
+	if err != nil || len(servers) != 2 || servers[0].Id != "S1" || servers[1].Connections != 3 || !servers[1].StartedAt.Equal(started) {
+		t.Fatalf("Servers = %+v, %v", servers, err)
+	}
+
+	// S1 renews its lease, S2 does not
+	advance(20 * time.Second)
+	s.Register(ctx, ServerInfo{Id: "S1"}, 30*time.Second)
+	advance(20 * time.Second)
+	alive := map[string]bool{}
+	for _, id := range []string{"S1", "S2"} {
+		alive[id], _ = s.Alive(ctx, id)
+	}
+	if !alive["S1"] || alive["S2"] {
+		t.Fatalf("alive %v, want S1 only", alive)
+	}
+	listed, _ := s.Listed(ctx)
+	sort.Strings(listed)
+	if !reflect.DeepEqual(listed, []string{"S1", "S2"}) {
+		t.Fatalf("expired servers stay listed until reaped: %v", listed)
+	}
+	if servers, _ := s.Servers(ctx); len(servers) != 1 || servers[0].Id != "S1" {
+		t.Fatalf("Servers lists expired leases: %+v", servers)
+	}
+
+	// a single reaper holds the lock, until released or expired
+	if locked, _ := s.LockReap(ctx, "S2", "S1", 30*time.Second); !locked {
+		t.Fatal("lock not taken")
+	}
+	if locked, _ := s.LockReap(ctx, "S2", "S3", 30*time.Second); locked {
+		t.Fatal("lock taken twice")
+	}
+	advance(31 * time.Second)
+	if locked, _ := s.LockReap(ctx, "S2", "S3", 30*time.Second); !locked {
+		t.Fatal("expired lock not taken")
+	}
+	s.UnlockReap(ctx, "S2")
+	if locked, _ := s.LockReap(ctx, "S2", "S1", 30*time.Second); !locked {
+		t.Fatal("released lock not taken")
+	}
+
+	if err := s.Unlist(ctx, "S2"); err != nil {
+		t.Fatal(err)
+	}
+	if users, _ := s.ServerUsers(ctx, "S2"); len(users) != 0 {
+		t.Fatalf("users of an unlisted server: %v", users)
+	}
+	if err := s.Deregister(ctx, "S1"); err != nil {
+		t.Fatal(err)
+	}
+	if listed, _ := s.Listed(ctx); len(listed) != 0 {
+		t.Fatalf("still listed: %v", listed)
+	}
+	if alive, _ := s.Alive(ctx, "S1"); alive {
+		t.Fatal("lease kept after Deregister")
+	}
+}